@@ -37,7 +37,15 @@ void log_error(const char * str) {
 }
 
 int mosquitto_auth_plugin_version(void) {
-  return MOSQ_AUTH_PLUGIN_VERSION;
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 5
+    /*
+      mosquitto 2.0 headers define version 5, which the broker only loads through mosquitto_plugin_init.
+      This plugin implements the version 4 functions, which 2.0 still supports, so ask for those.
+    */
+    return 4;
+  #else
+    return MOSQ_AUTH_PLUGIN_VERSION;
+  #endif
 }
 
 int mosquitto_auth_plugin_init(void **user_data, struct mosquitto_auth_opt *auth_opts, int auth_opt_count) {
@@ -95,10 +103,20 @@ int mosquitto_auth_unpwd_check(void *userdata, const char *username, const char
     return MOSQ_ERR_AUTH;
   }
 
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 3
+    const char* clientid = mosquitto_client_id(client);
+  #else
+    const char* clientid = NULL;
+  #endif
+  if (clientid == NULL) {
+    clientid = "";
+  }
+
   GoString go_username = {username, strlen(username)};
   GoString go_password = {password, strlen(password)};
+  GoString go_clientid = {clientid, strlen(clientid)};
 
-  if(AuthUnpwdCheck(go_username, go_password)){
+  if(AuthUnpwdCheck(go_username, go_password, go_clientid)){
     return MOSQ_ERR_SUCCESS;
   }
 
@@ -148,6 +166,17 @@ int mosquitto_auth_acl_check(void *userdata, const char *clientid, const char *u
     return MOSQ_ERR_SUCCESS;
   }
 
+  #if defined(LIBMOSQUITTO_MAJOR) && LIBMOSQUITTO_MAJOR >= 2
+    /*
+      mosquitto 2.0 brokers let plugins disconnect clients, so those whose credentials expired
+      have to connect again with fresh ones instead of just being denied.
+    */
+    if(AuthClientExpired(go_clientid, go_username)){
+      log_info("disconnecting client with expired credentials");
+      mosquitto_kick_client_by_clientid(clientid, false);
+    }
+  #endif
+
   return MOSQ_ERR_ACL_DENIED;
 }
 
@@ -1,7 +1,12 @@
 package backends
 
 import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
 )
 
 type Backend interface {
@@ -12,7 +17,71 @@ type Backend interface {
 	Halt()
 	Reload()
 }
+
+//UserChecker is implemented by backends that can tell if a user exists without checking a password,
+//as needed when the user has already been authenticated by other means, e.g. a JWT token.
+type UserChecker interface {
+	UserExists(username string) bool
+}
+
+//ClientAuthenticator is implemented by backends that may remember what each client authenticated with, e.g. the claims
+//of a token given as password, to check its superuser status and acls later. When RemembersClients is true, the client id
+//is passed along and every connection is checked, as results cached by username and password can't tell clients apart.
+type ClientAuthenticator interface {
+	RemembersClients() bool
+	GetClientUser(username, password, clientid string) bool
+	GetClientSuperuser(username, clientid string) bool
+}
+
+//AclCacheBypasser is implemented by backends whose grants may be withdrawn before cached results expire, e.g. when tokens
+//may be revoked. When BypassesAclCache is true, their superuser and acl checks are never answered by the acl cache.
+type AclCacheBypasser interface {
+	BypassesAclCache() bool
+}
+
+//ClientExpirer is implemented by backends whose clients' credentials may expire while connected, e.g. tokens, so the plugin may
+//disconnect expired clients and make them connect again with fresh credentials.
+type ClientExpirer interface {
+	ClientExpired(username, clientid string) bool
+}
+
+//ClientKeeper is implemented by backends that remember clients, so an instance restarted with new secrets keeps knowing
+//the clients that authenticated with the previous one, instead of denying them until they connect again.
+type ClientKeeper interface {
+	KeepClients(previous Backend)
+}
+
+//QueryRunner is implemented by SQL backends, so others may look up rows in the same database.
+type QueryRunner interface {
+	QueryExists(query string, args ...interface{}) (bool, error)
+}
+
 type createFunc func(authOpts map[string]string, logLevel log.Level) (Backend, error)
 
 var RegisteredBackends = make(map[string]createFunc)
 var Log = log.New()
+
+//aclTopicMatches checks a requested topic against an acl topic. Subscriptions are checked as filters,
+//so they're only allowed when the acl topic matches every topic they may match.
+func aclTopicMatches(aclTopic, topic string, acc int32) bool {
+	if acc == MOSQ_ACL_SUBSCRIBE {
+		return common.FilterSubsumes(aclTopic, topic)
+	}
+	return common.TopicsMatch(aclTopic, topic)
+}
+
+//queryExists runs a query returning a single value, telling if it found a row with a non empty value other than 0,
+//so the query may return a count or any column.
+func queryExists(db *sqlx.DB, query string, args ...interface{}) (bool, error) {
+	var result sql.NullString
+	err := db.Get(&result, query, args...)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return result.Valid && result.String != "" && result.String != "0", nil
+}
@@ -0,0 +1,58 @@
+package backends
+
+import "strings"
+
+//lookupClaim returns the claim at a dot separated path, e.g. mqtt.pub for {"mqtt": {"pub": [...]}}.
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+//claimToStrings returns the strings in a claim, which may be a single string or an array of them.
+//Other values are ignored.
+func claimToStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+//claimsTopicMatches checks a topic against filters taken from claims, replacing %u and %c in them.
+func claimsTopicMatches(filters []string, username, topic, clientid string, acc int32) bool {
+	for _, filter := range filters {
+		aclTopic := strings.Replace(filter, "%c", clientid, -1)
+		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
+		if aclTopicMatches(aclTopic, topic, acc) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package backends
+
+import (
+	"sync"
+	"time"
+)
+
+//rememberedClient is what a client authenticated with, e.g. a token given as password, along with any data the backend
+//got from it, such as the token's claims.
+type rememberedClient struct {
+	username string
+	token    string
+	data     interface{}
+	seen     time.Time
+}
+
+//clientStore remembers, by client id, what each client authenticated with, for backends that check later requests against it.
+//Clients that go unseen for longer than idle are forgotten, as the plugin isn't told when they disconnect.
+type clientStore struct {
+	sync.Mutex
+	clients   map[string]*rememberedClient
+	idle      time.Duration
+	sweepSize int
+}
+
+func newClientStore(idle time.Duration) *clientStore {
+	return &clientStore{
+		clients:   make(map[string]*rememberedClient),
+		idle:      idle,
+		sweepSize: 1024,
+	}
+}
+
+//set remembers a client, replacing any previous one with the same id.
+func (c *clientStore) set(clientid string, client *rememberedClient) {
+	c.Lock()
+	defer c.Unlock()
+
+	client.seen = time.Now()
+	c.clients[clientid] = client
+
+	//Idle clients are swept whenever the map doubles, so sweeping takes constant time per client on average.
+	if c.idle > 0 && len(c.clients) >= c.sweepSize {
+		c.sweep(client.seen)
+		c.sweepSize = 2 * len(c.clients)
+		if c.sweepSize < 1024 {
+			c.sweepSize = 1024
+		}
+	}
+}
+
+//get returns the client with the given id, as long as it connected with the given username.
+func (c *clientStore) get(clientid, username string) (*rememberedClient, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	client, ok := c.clients[clientid]
+	if !ok || client.username != username {
+		return nil, false
+	}
+
+	now := time.Now()
+	if c.idle > 0 && now.Sub(client.seen) > c.idle {
+		delete(c.clients, clientid)
+		return nil, false
+	}
+	client.seen = now
+
+	return client, true
+}
+
+//adopt takes over the clients remembered by previous, keeping any client already remembered by this store.
+func (c *clientStore) adopt(previous *clientStore) {
+	if previous == nil || previous == c {
+		return
+	}
+
+	previous.Lock()
+	clients := make(map[string]*rememberedClient, len(previous.clients))
+	for clientid, client := range previous.clients {
+		clients[clientid] = client
+	}
+	previous.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
+
+	for clientid, client := range clients {
+		if _, ok := c.clients[clientid]; !ok {
+			c.clients[clientid] = client
+		}
+	}
+}
+
+func (c *clientStore) sweep(now time.Time) {
+	for clientid, client := range c.clients {
+		if now.Sub(client.seen) > c.idle {
+			delete(c.clients, clientid)
+		}
+	}
+}
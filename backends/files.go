@@ -3,9 +3,10 @@
 package backends
 
 import (
-	"bufio"
-	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -16,7 +17,6 @@ import (
 
 func init() {
 	RegisteredBackends["files"] = NewFiles
-	Log.Info("files init")
 }
 
 // saltSize defines the salt size
@@ -27,18 +27,29 @@ var HashIterations = 100000
 
 //AclRecord holds a topic and access privileges.
 type AclRecord struct {
-	Topic string
-	Acc   byte //None 0x00, Read 0x01, Write 0x02, ReadWrite: Read | Write : 0x03
+	Topic    string
+	Acc      byte   //None 0x00, Read 0x01, Write 0x02, ReadWrite: Read | Write : 0x03, Subscribe 0x04
+	Deny     bool   //Deny records revoke access instead of granting it, given by the deny access in acl files and policies.
+	ClientID string //If not empty, the record only applies to this client id.
+	Comment  string
+	Source   string //File the record was read from.
+	Line     int    //Line of the record in its source file.
 }
 
 //FileBE holds paths to files, list of file users and general (no user or pattern) acl records.
 type Files struct {
 	PasswordPath   string
 	AclPath        string
+	PolicyPath     string
+	Format         string
 	CheckAcls      bool
+	Strict         bool
 	Users          map[string]string
+	UserFiles      map[string]string //Password file each user was read from, to store upgraded hashes.
+	Superusers     map[string]bool
 	UserAclRecords map[string][]AclRecord
 	AclRecords     []AclRecord
+	HashPolicy     *common.HashPolicy
 }
 
 //NewFiles initializes a files backend.
@@ -49,12 +60,52 @@ func NewFiles(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 	var files = &Files{
 		PasswordPath:   "",
 		AclPath:        "",
+		PolicyPath:     "",
+		Format:         filesFormatMosquitto,
 		CheckAcls:      false,
 		Users:          make(map[string]string),
+		UserFiles:      make(map[string]string),
+		Superusers:     make(map[string]bool),
 		UserAclRecords: make(map[string][]AclRecord),
 		AclRecords:     make([]AclRecord, 0, 0),
 	}
 
+	if format, ok := authOpts["files_format"]; ok {
+		switch format {
+		case filesFormatMosquitto, filesFormatYAML, filesFormatJSON:
+			files.Format = format
+		default:
+			return files, errors.Errorf("Files backend error: unknown files format %s.\n", format)
+		}
+	}
+
+	hashPolicy, hErr := common.NewHashPolicy(authOpts)
+	if hErr != nil {
+		return files, errors.Errorf("Files backend error: %s.\n", hErr)
+	}
+	files.HashPolicy = hashPolicy
+
+	//Structured policies hold users and acls in a single document, so acls are always checked.
+	if files.Format != filesFormatMosquitto {
+		if policyPath, ok := authOpts["policy_path"]; ok {
+			files.PolicyPath = policyPath
+		} else {
+			return files, errors.New("Files backend error: no policy path given.\n")
+		}
+
+		files.CheckAcls = true
+
+		if files.HashPolicy != nil {
+			Log.Warn("Files backend: password hashes in structured policies won't be upgraded.")
+		}
+
+		if pErr := files.readPolicy(); pErr != nil {
+			return files, errors.Errorf("Fatal: %s\n", pErr)
+		}
+
+		return files, nil
+	}
+
 	if passwordPath, ok := authOpts["password_path"]; ok {
 		files.PasswordPath = passwordPath
 	} else {
@@ -69,214 +120,108 @@ func NewFiles(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		Log.Info("Acls won't be checked.\n")
 	}
 
-	var uErr error
-	//Now initialize FileUsers by reading from password and acl files.
-	files.Users, uErr = readPasswords(files.PasswordPath)
-	if uErr != nil {
-		return files, errors.Errorf("Fatal: %s\n", uErr)
+	if strict, ok := authOpts["files_strict"]; ok && strict == "true" {
+		files.Strict = true
 	}
 
-	//Only read acls if path was given.
-	if files.CheckAcls {
-		aclCount, aclErr := files.readAcls()
-		if aclErr != nil {
-			return files, errors.Errorf("Fatal: %s\n", aclErr)
-		} else {
-			Log.Infof("Got %d lines from acl file.\n", aclCount)
-		}
+	//Now initialize FileUsers by reading from password and acl files.
+	if rErr := files.readFiles(); rErr != nil {
+		return files, errors.Errorf("Fatal: %s\n", rErr)
 	}
 
 	return files, nil
 
 }
 
-//ReadPasswords read file and populates FileUsers. Return amount of users seen and possile error.
-func readPasswords(path string) (map[string]string, error) {
+//expandPaths splits a comma separated list of files and directories into the files to read.
+//Directories are expanded to the files in them with any of the given extensions, in lexical order.
+func expandPaths(paths string, exts ...string) ([]string, error) {
+	files := make([]string, 0)
 
-	users := make(map[string]string)
-
-	file, fErr := os.Open(path)
-	defer file.Close()
-	if fErr != nil {
-		return users, fmt.Errorf("Files backend error: couldn't open passwords file: %s\n", fErr)
-	}
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-
-	index := 0
-	//Read line by line
-	for scanner.Scan() {
-		index++
-
-		//Check comment or empty line to skip them.
-		if checkCommentOrEmpty(scanner.Text()) {
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
 			continue
 		}
 
-		lineArr := strings.Split(scanner.Text(), ":")
-		if len(lineArr) != 2 {
-			Log.Warnf("Read passwords error: line %d is not well formatted.\n", index)
-			continue
+		info, err := os.Stat(path)
+		if err != nil {
+			return files, err
 		}
 
-		users[lineArr[0]] = lineArr[1]
-	}
-	Log.Infof("Read %d users from file", len(users))
-	for k := range users {
-		Log.Debugf(" %s", k)
-	}
-
-	return users, nil
-
-}
-
-//ReadAcls reads the Acl file and associates them to existing users. It omits any non existing users.
-func (o *Files) readAcls() (int, error) {
-	aclRecords := make([]AclRecord, 0, 0)
-	userAclRecords := make(map[string][]AclRecord)
-	linesCount := 0
-
-	//Set currentUser as empty string
-	currentUser := ""
-
-	file, fErr := os.Open(o.AclPath)
-	defer file.Close()
-	if fErr != nil {
-		return linesCount, errors.Errorf("Files backend error: couldn't open acl file: %s\n", fErr)
-	}
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-
-	index := 0
-
-	for scanner.Scan() {
-		index++
-		line := scanner.Text()
-
-		//Check comment or empty line to skip them.
-		if checkCommentOrEmpty(scanner.Text()) {
+		if !info.IsDir() {
+			files = append(files, path)
 			continue
 		}
 
-		//If we see a user line, change the current user.
-		if strings.Contains(line, "user") {
-			//Try to get username
-			lineArr := strings.Fields(line)
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return files, err
+		}
 
-			//Check format
-			if len(lineArr) == 2 && lineArr[0] == "user" {
-				currentUser = lineArr[1]
-			} else {
-				Log.Warnf("Files backend error: wrong acl format at line %d", index)
+		dirFiles := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if entry.IsDir() {
 				continue
 			}
-		} else if strings.Contains(line, "topic") {
-
-			//Split and check for read, write or empty (readwwrite) privileges.
-			lineArr := strings.SplitN(line, " ", 3)
-
-			if (len(lineArr) == 2 || len(lineArr) == 3) && lineArr[0] == "topic" {
-
-				var aclRecord = AclRecord{
-					Topic: "",
-					Acc:   MOSQ_ACL_NONE,
-				}
-
-				//If len is 2, then we assume ReadWrite privileges.
-				if len(lineArr) == 2 {
-					aclRecord.Topic = lineArr[1]
-					aclRecord.Acc = MOSQ_ACL_READWRITE
-				} else {
-					aclRecord.Topic = lineArr[2]
-					if lineArr[1] == "read" {
-						aclRecord.Acc = MOSQ_ACL_READ
-					} else if lineArr[1] == "write" {
-						aclRecord.Acc = MOSQ_ACL_WRITE
-					} else if lineArr[1] == "readwrite" {
-						aclRecord.Acc = MOSQ_ACL_READWRITE
-					} else if lineArr[1] == "subscribe" {
-						aclRecord.Acc = MOSQ_ACL_SUBSCRIBE
-					} else {
-						Log.Warnf("Files backend error: wrong acl format at line %d", index)
-						continue
-					}
-				}
-
-				//Append to user or general depending on currentUser.
-				if currentUser != "" {
-					//					userRecords, ok := userAclRecords[currentUser]
-					//					if !ok {
-					//						userRecords = make([]AclRecord, 0, 0)
-					//					}
-					userAclRecords[currentUser] = append(userAclRecords[currentUser], aclRecord)
-					Log.Debugf(" acl topic rule '%s' (%d) added to user %s", aclRecord.Topic, aclRecord.Acc, currentUser)
-				} else {
-					aclRecords = append(aclRecords, aclRecord)
-					Log.Debugf(" acl topic rule '%s' (%d) added to no user...", aclRecord.Topic, aclRecord.Acc)
+			for _, ext := range exts {
+				if filepath.Ext(entry.Name()) == ext {
+					dirFiles = append(dirFiles, filepath.Join(path, entry.Name()))
+					break
 				}
-
-				linesCount++
-
-			} else {
-				Log.Warnf("Files backend error: wrong acl format at line %d", index)
-				continue
 			}
+		}
+		sort.Strings(dirFiles)
 
-		} else if strings.Contains(line, "pattern") {
-
-			//Split and check for read, write or empty (readwwrite) privileges.
-			lineArr := strings.SplitN(line, " ", 3)
+		if len(dirFiles) == 0 {
+			Log.Warnf("Files backend: no %s files found in %s", strings.Join(exts, " or "), path)
+		}
 
-			if (len(lineArr) == 2 || len(lineArr) == 3) && lineArr[0] == "pattern" {
+		files = append(files, dirFiles...)
+	}
 
-				var aclRecord = AclRecord{
-					Topic: "",
-					Acc:   MOSQ_ACL_NONE,
-				}
+	return files, nil
+}
 
-				//If len is 2, then we assume ReadWrite privileges.
-				if len(lineArr) == 2 {
-					aclRecord.Topic = lineArr[1]
-					aclRecord.Acc = MOSQ_ACL_READWRITE
-				} else {
-					aclRecord.Topic = lineArr[2]
-					if lineArr[1] == "read" {
-						aclRecord.Acc = MOSQ_ACL_READ
-					} else if lineArr[1] == "write" {
-						aclRecord.Acc = MOSQ_ACL_WRITE
-					} else if lineArr[1] == "readwrite" {
-						aclRecord.Acc = MOSQ_ACL_READWRITE
-					} else if lineArr[1] == "subscribe" {
-						aclRecord.Acc = MOSQ_ACL_SUBSCRIBE
-					} else {
-						Log.Warnf("Files backend error: wrong acl format at line %d", index)
-						continue
-					}
-				}
+//readFiles reads password files and, if a path was given, acl files. Malformed lines are logged and skipped,
+//unless in strict mode, where they make it fail. On failure, current users and acls are kept.
+func (o *Files) readFiles() error {
+	p := newFilesParser()
 
-				Log.Debugf(" acl pattern rule '%s' (%d) added", aclRecord.Topic, aclRecord.Acc)
-				//Append to general acls.
-				aclRecords = append(aclRecords, aclRecord)
+	if err := p.readPasswords(o.PasswordPath); err != nil {
+		return err
+	}
 
-				linesCount++
+	//Only read acls if path was given.
+	if o.CheckAcls {
+		if err := p.readAcls(o.AclPath); err != nil {
+			return err
+		}
+	}
 
-			} else {
-				Log.Warnf("Files backend error: wrong acl format at line %d", index)
-			}
+	for _, issue := range p.issues {
+		Log.Warnf("Files backend error: %s", issue)
+	}
 
+	if o.Strict && len(p.issues) > 0 {
+		issues := make([]string, 0, len(p.issues))
+		for _, issue := range p.issues {
+			issues = append(issues, issue.String())
 		}
+		return errors.Errorf("Files backend error: %d malformed lines:\n%s", len(issues), strings.Join(issues, "\n"))
 	}
-	o.UserAclRecords = userAclRecords
-	o.AclRecords = aclRecords
-	return linesCount, nil
 
-}
+	o.Users = p.users
+	o.UserFiles = p.userFiles
+	o.UserAclRecords = p.userAclRecords
+	o.AclRecords = p.aclRecords
 
-func checkCommentOrEmpty(line string) bool {
-	if len(strings.Replace(line, " ", "", -1)) == 0 || line[0:1] == "#" {
-		return true
+	Log.Infof("Read %d users and %d acl rules from %d files", len(p.users), p.aclCount, p.fileCount)
+	for k := range p.users {
+		Log.Debugf(" %s (%s)", k, p.userSources[k])
 	}
-	return false
+
+	return nil
 }
 
 //GetUser checks that user exists and password is correct.
@@ -288,6 +233,11 @@ func (o *Files) GetUser(username, password string) bool {
 	}
 
 	if common.HashCompare(password, userPassword) {
+		if o.Format == filesFormatMosquitto {
+			o.HashPolicy.Upgrade(username, password, userPassword, func(newHash string) error {
+				return o.updatePassword(username, newHash)
+			})
+		}
 		return true
 	}
 
@@ -297,12 +247,35 @@ func (o *Files) GetUser(username, password string) bool {
 
 }
 
-//GetSuperuser returns false for files backend.
+//UserExists tells if the user has a password.
+func (o *Files) UserExists(username string) bool {
+	_, ok := o.Users[username]
+	return ok
+}
+
+//updatePassword replaces the user's hash in the password file it was read from.
+func (o *Files) updatePassword(username, passwordHash string) error {
+	path, ok := o.UserFiles[username]
+	if !ok {
+		return errors.Errorf("unknown password file for user %s", username)
+	}
+
+	if err := SetFilesPassword(path, username, passwordHash); err != nil {
+		return err
+	}
+
+	o.Users[username] = passwordHash
+
+	return nil
+}
+
+//GetSuperuser checks the superuser flag of structured policies. It's always false for mosquitto formatted files.
 func (o *Files) GetSuperuser(username string) bool {
-	return false
+	return o.Superusers[username]
 }
 
 //CheckAcl checks that the topic may be read/written by the given user/clientid.
+//Deny records are checked first and take precedence over any granting record.
 func (o *Files) CheckAcl(username, topic, clientid string, acc int32) bool {
 	//If there are no acls, all access is allowed.
 	if !o.CheckAcls {
@@ -312,47 +285,74 @@ func (o *Files) CheckAcl(username, topic, clientid string, acc int32) bool {
 	accToCheck := byte(acc)
 
 	fileUserRecords, ok := o.UserAclRecords[username]
+	if !ok {
+		Log.Debugf("No acl rules in file for %s", username)
+	}
+
+	//Mosquitto's per user topics are taken literally, while structured policies replace %c and %u in every acl.
+	replaceUserTopics := o.Format != filesFormatMosquitto
+
+	if checkAclRecords(fileUserRecords, true, replaceUserTopics, username, topic, clientid, accToCheck) ||
+		checkAclRecords(o.AclRecords, true, true, username, topic, clientid, accToCheck) {
+		Log.Debugf("acl denied for user %s on topic %s", username, topic)
+		return false
+	}
 
 	//If user exists, check against his acls and common ones. If not, check against common acls only.
-	if ok {
-		for _, aclRecord := range fileUserRecords {
-			Log.Debugf("fileUserRecord.topic = %s fileUserRecord.acc = %d, check topic = %s, permission = %d", aclRecord.Topic, aclRecord.Acc, topic, acc)
-			if common.TopicsMatch(aclRecord.Topic, topic) {
-				if accToCheck == MOSQ_ACL_SUBSCRIBE || accToCheck == aclRecord.Acc {
-					return true
-				}
-				if accToCheck == MOSQ_ACL_READ && (aclRecord.Acc == MOSQ_ACL_READWRITE) {
-					return true
-				}
-				if accToCheck == MOSQ_ACL_WRITE && (aclRecord.Acc == MOSQ_ACL_READWRITE) {
-					return true
-				}
-			}
+	return checkAclRecords(fileUserRecords, false, replaceUserTopics, username, topic, clientid, accToCheck) ||
+		checkAclRecords(o.AclRecords, false, true, username, topic, clientid, accToCheck)
+
+}
+
+//checkAclRecords returns true when any deny (or granting, when deny is false) record matches topic and acc.
+//When replace is set, %c and %u are replaced by the clientid and username in the record's topic.
+func checkAclRecords(records []AclRecord, deny, replace bool, username, topic, clientid string, acc byte) bool {
+	for _, aclRecord := range records {
+		if aclRecord.Deny != deny {
+			continue
 		}
-	} else {
-		Log.Debugf("No acl rules in file for %s", username)
-	}
-	for _, aclRecord := range o.AclRecords {
-		//Replace all occurrences of %c for clientid and %u for username
-		aclTopic := strings.Replace(aclRecord.Topic, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		Log.Debugf("acltopic = %s (%s)", aclTopic, aclRecord.Topic)
-		Log.Debugf("patternRecord.topic = %s patternRecord.acc = %d, check topic = %s, permission = %d", aclRecord.Topic, aclRecord.Acc, topic, acc)
-		if common.TopicsMatch(aclRecord.Topic, topic) {
-			if accToCheck == MOSQ_ACL_SUBSCRIBE || accToCheck == aclRecord.Acc {
-				return true
-			}
-			if accToCheck == MOSQ_ACL_READ && (aclRecord.Acc == MOSQ_ACL_READWRITE) {
-				return true
+
+		if aclRecord.ClientID != "" && aclRecord.ClientID != clientid {
+			continue
+		}
+
+		aclTopic := aclRecord.Topic
+		if replace {
+			//Replace all occurrences of %c for clientid and %u for username
+			aclTopic = strings.Replace(aclTopic, "%c", clientid, -1)
+			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
+		}
+
+		Log.Debugf("aclRecord.topic = %s (%s) aclRecord.acc = %d, check topic = %s, permission = %d (%s:%d)", aclTopic, aclRecord.Topic, aclRecord.Acc, topic, acc, aclRecord.Source, aclRecord.Line)
+
+		//A subscription is denied whenever it may match a topic a deny record covers, so # can't get around a deny on secret/#.
+		if deny && acc == MOSQ_ACL_SUBSCRIBE {
+			if !common.FiltersOverlap(aclTopic, topic) {
+				continue
 			}
-			if accToCheck == MOSQ_ACL_WRITE && (aclRecord.Acc == MOSQ_ACL_READWRITE) {
+		} else if !aclTopicMatches(aclTopic, topic, int32(acc)) {
+			continue
+		}
+
+		//Deny records only revoke the exact access they list.
+		if deny {
+			if aclRecord.Acc&acc != 0 {
 				return true
 			}
+			continue
+		}
+
+		//Read records allow subscribing too, as in mosquitto's acl files.
+		if acc == MOSQ_ACL_SUBSCRIBE && aclRecord.Acc&(MOSQ_ACL_READ|MOSQ_ACL_SUBSCRIBE) != 0 {
+			return true
+		}
+
+		if aclRecord.Acc&acc != 0 {
+			return true
 		}
 	}
 
 	return false
-
 }
 
 //GetName returns the backend's name
@@ -366,10 +366,17 @@ func (o Files) Halt() {
 }
 
 func (o *Files) Reload() {
-	Log.Info("Read passwords")
-	// When reloading we assume path exists since it passed
+	if o.Format != filesFormatMosquitto {
+		Log.Info("Read policy")
+		if err := o.readPolicy(); err != nil {
+			Log.Errorf("Couldn't reload policy, keeping previous one: %s", err)
+		}
+		return
+	}
+	Log.Info("Read passwords and acls")
+	// When reloading we assume paths exist since they passed
 	// validation on startup
-	o.Users, _ = readPasswords(o.PasswordPath)
-	Log.Info("Read acls")
-	o.readAcls()
+	if err := o.readFiles(); err != nil {
+		Log.Errorf("Couldn't reload files, keeping previous ones: %s", err)
+	}
 }
@@ -1,4 +1,4 @@
-// build +files
+// +build files
 
 package backends
 
@@ -9,7 +9,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var files Files
+var files Backend
 var fbUser1 = "test1"
 
 var fbClientID = "test_client"
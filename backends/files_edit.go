@@ -0,0 +1,375 @@
+// +build files
+
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//Functions to edit mosquitto formatted password and acl files in place. Files are rewritten to a temporary file
+//which is then renamed, so a crash never leaves them half written, and lines not being edited, such as comments, are kept as they were.
+
+//AddFilesUser adds a user to a password file, creating it if needed. It fails if the user already exists.
+func AddFilesUser(path, username, passwordHash string) error {
+	if err := checkUsername(username); err != nil {
+		return err
+	}
+
+	lines, mode, err := readFileLines(path, true)
+	if err != nil {
+		return err
+	}
+
+	if found := findPasswordLines(lines, username); len(found) > 0 {
+		return errors.Errorf("user %s already exists in %s:%d", username, path, found[0]+1)
+	}
+
+	lines = append(lines, username+":"+passwordHash)
+
+	return writeFileLines(path, lines, mode)
+}
+
+//SetFilesPassword replaces a user's hash in a password file. When the user is repeated, every definition is replaced,
+//so the file agrees with the parser, which uses the last one, and no stale hash is left behind.
+func SetFilesPassword(path, username, passwordHash string) error {
+	lines, mode, err := readFileLines(path, false)
+	if err != nil {
+		return err
+	}
+
+	found := findPasswordLines(lines, username)
+	if len(found) == 0 {
+		return errors.Errorf("user %s not found in %s", username, path)
+	}
+
+	for _, i := range found {
+		lines[i] = username + ":" + passwordHash
+	}
+
+	return writeFileLines(path, lines, mode)
+}
+
+//RemoveFilesUser removes every definition of a user from a password file.
+func RemoveFilesUser(path, username string) error {
+	lines, mode, err := readFileLines(path, false)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !checkCommentOrEmpty(line) && strings.SplitN(line, ":", 2)[0] == username {
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if len(kept) == len(lines) {
+		return errors.Errorf("user %s not found in %s", username, path)
+	}
+
+	return writeFileLines(path, kept, mode)
+}
+
+//AddFilesAclRule adds a topic or pattern rule, e.g. "topic read sensors/#", to an acl file, creating it if needed.
+//Topic rules are added to the user's last block, which is created at the end of the file if missing, or to the general rules
+//before the first user line when no username is given. Patterns apply to every user, so they're always added to the general rules.
+func AddFilesAclRule(path, username, rule string) error {
+	keyword, aclRecord, err := parseEditRule(rule, username)
+	if err != nil {
+		return err
+	}
+
+	lines, mode, err := readFileLines(path, true)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range aclRuleLines(lines, username, keyword) {
+		if sameAclRule(lines[i], keyword, aclRecord) {
+			return errors.Errorf("rule already exists in %s:%d", path, i+1)
+		}
+	}
+
+	line := strings.Join(strings.Fields(rule), " ")
+
+	if keyword == "pattern" || username == "" {
+		//Insert after the last line before the first user line, keeping blank lines that separate it.
+		firstUser := len(lines)
+		for i, l := range lines {
+			if k, _ := nextToken(l); k == "user" && !checkCommentOrEmpty(l) {
+				firstUser = i
+				break
+			}
+		}
+		at := firstUser
+		for at > 0 && strings.TrimSpace(lines[at-1]) == "" {
+			at--
+		}
+		insert := []string{line}
+		if at == firstUser && firstUser < len(lines) {
+			insert = append(insert, "")
+		}
+		lines = insertLines(lines, at, insert...)
+		return writeFileLines(path, lines, mode)
+	}
+
+	start, end := lastUserBlock(lines, username)
+	if start < 0 {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "user "+username, line)
+		return writeFileLines(path, lines, mode)
+	}
+
+	at := end
+	for at > start+1 && strings.TrimSpace(lines[at-1]) == "" {
+		at--
+	}
+	lines = insertLines(lines, at, line)
+
+	return writeFileLines(path, lines, mode)
+}
+
+//RemoveFilesAclRule removes every line equivalent to the given topic or pattern rule from the user's blocks,
+//or from the general rules when no username is given. Patterns are removed wherever they are.
+func RemoveFilesAclRule(path, username, rule string) error {
+	keyword, aclRecord, err := parseEditRule(rule, username)
+	if err != nil {
+		return err
+	}
+
+	lines, mode, err := readFileLines(path, false)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[int]bool)
+	for _, i := range aclRuleLines(lines, username, keyword) {
+		if sameAclRule(lines[i], keyword, aclRecord) {
+			remove[i] = true
+		}
+	}
+
+	if len(remove) == 0 {
+		return errors.Errorf("rule not found in %s", path)
+	}
+
+	return writeFileLines(path, removeLines(lines, remove), mode)
+}
+
+//RemoveFilesAclUser removes the user lines of a user and the topic rules in their blocks from an acl file.
+//Patterns and comments in those blocks are kept.
+func RemoveFilesAclUser(path, username string) error {
+	lines, mode, err := readFileLines(path, false)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[int]bool)
+	currentUser := ""
+	for i, line := range lines {
+		if checkCommentOrEmpty(line) {
+			continue
+		}
+		keyword, rest := nextToken(line)
+		if keyword == "user" {
+			currentUser = rest
+		}
+		if currentUser == username && (keyword == "user" || keyword == "topic") {
+			remove[i] = true
+		}
+	}
+
+	if len(remove) == 0 {
+		return errors.Errorf("user %s not found in %s", username, path)
+	}
+
+	return writeFileLines(path, removeLines(lines, remove), mode)
+}
+
+//parseEditRule validates a rule given to edit an acl file, returning its keyword and record.
+func parseEditRule(rule, username string) (string, AclRecord, error) {
+	keyword, rest := nextToken(rule)
+	if keyword != "topic" && keyword != "pattern" {
+		return "", AclRecord{}, errors.Errorf("unknown keyword %q, expected topic or pattern", keyword)
+	}
+
+	if keyword == "pattern" && username != "" {
+		return "", AclRecord{}, errors.New("patterns apply to every user, so they can't be given a username")
+	}
+
+	if username != "" {
+		if err := checkUsername(username); err != nil {
+			return "", AclRecord{}, err
+		}
+	}
+
+	aclRecord, err := parseAclRule(rest)
+	if err != nil {
+		return "", AclRecord{}, err
+	}
+
+	return keyword, aclRecord, nil
+}
+
+//aclRuleLines returns the indexes of the rule lines that apply to username: topic lines in its blocks, or before any user line
+//when username is empty. For patterns, every pattern line is returned.
+func aclRuleLines(lines []string, username, keyword string) []int {
+	indexes := make([]int, 0)
+	currentUser := ""
+	for i, line := range lines {
+		if checkCommentOrEmpty(line) {
+			continue
+		}
+		k, rest := nextToken(line)
+		switch {
+		case k == "user":
+			currentUser = rest
+		case k == "pattern" && keyword == "pattern":
+			indexes = append(indexes, i)
+		case k == "topic" && keyword == "topic" && currentUser == username:
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+//sameAclRule checks if an acl line holds the same rule as the given keyword and record, regardless of spacing.
+func sameAclRule(line, keyword string, aclRecord AclRecord) bool {
+	k, rest := nextToken(line)
+	if k != keyword {
+		return false
+	}
+	lineRecord, err := parseAclRule(rest)
+	if err != nil {
+		return false
+	}
+	return lineRecord.Topic == aclRecord.Topic && lineRecord.Acc == aclRecord.Acc && lineRecord.Deny == aclRecord.Deny
+}
+
+//lastUserBlock returns the line of the last user line of username and the end of its block, or -1 if there's none.
+func lastUserBlock(lines []string, username string) (int, int) {
+	start, end := -1, -1
+	for i, line := range lines {
+		if checkCommentOrEmpty(line) {
+			continue
+		}
+		k, rest := nextToken(line)
+		if k != "user" {
+			continue
+		}
+		if start >= 0 && end < 0 {
+			end = i
+		}
+		if rest == username {
+			start, end = i, -1
+		}
+	}
+	if start >= 0 && end < 0 {
+		end = len(lines)
+	}
+	return start, end
+}
+
+//findPasswordLines returns the indexes of every definition of username in a password file.
+func findPasswordLines(lines []string, username string) []int {
+	var found []int
+	for i, line := range lines {
+		if checkCommentOrEmpty(line) {
+			continue
+		}
+		lineArr := strings.Split(line, ":")
+		if len(lineArr) == 2 && lineArr[0] == username {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+func checkUsername(username string) error {
+	if username == "" || strings.ContainsAny(username, ": \t") {
+		return errors.Errorf("invalid username %q, it can't be empty nor contain colons or spaces", username)
+	}
+	return nil
+}
+
+func insertLines(lines []string, at int, inserted ...string) []string {
+	result := make([]string, 0, len(lines)+len(inserted))
+	result = append(result, lines[:at]...)
+	result = append(result, inserted...)
+	return append(result, lines[at:]...)
+}
+
+func removeLines(lines []string, remove map[int]bool) []string {
+	kept := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if !remove[i] {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+//readFileLines reads a file as lines, along with its mode. Missing files are read as empty, with 0600 mode, when create is set.
+func readFileLines(path string, create bool) ([]string, os.FileMode, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && create {
+		return []string{}, 0600, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(content) == 0 {
+		return []string{}, info.Mode(), nil
+	}
+
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n"), info.Mode(), nil
+}
+
+//writeFileLines writes lines to a temporary file in the same directory and renames it to path.
+func writeFileLines(path string, lines []string, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,353 @@
+// +build files
+
+package backends
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/pkg/errors"
+)
+
+//FilesIssue is a problem found at a given line of a password, acl or policy file. Column is only known for policies.
+type FilesIssue struct {
+	Source string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (i FilesIssue) String() string {
+	if i.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", i.Source, i.Line, i.Column, i.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", i.Source, i.Line, i.Msg)
+}
+
+//filesParser reads mosquitto formatted password and acl files, collecting any issue found on the way.
+type filesParser struct {
+	users          map[string]string
+	userSources    map[string]string
+	userFiles      map[string]string
+	userAclRecords map[string][]AclRecord
+	aclRecords     []AclRecord
+	aclUsers       map[string]FilesIssue //First user line of every user with acls, used to report users without passwords.
+	issues         []FilesIssue
+	aclCount       int
+	fileCount      int
+}
+
+func newFilesParser() *filesParser {
+	return &filesParser{
+		users:          make(map[string]string),
+		userSources:    make(map[string]string),
+		userFiles:      make(map[string]string),
+		userAclRecords: make(map[string][]AclRecord),
+		aclRecords:     make([]AclRecord, 0),
+		aclUsers:       make(map[string]FilesIssue),
+		issues:         make([]FilesIssue, 0),
+	}
+}
+
+func (p *filesParser) issuef(path string, line int, format string, args ...interface{}) {
+	p.issues = append(p.issues, FilesIssue{Source: path, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+//readPasswords reads every password file in paths. When a username is repeated, the last definition is kept, as a single
+//file always did, and the duplicate is kept as an issue.
+//Errors are only returned when files can't be read; malformed lines are kept as issues.
+func (p *filesParser) readPasswords(paths string) error {
+
+	files, eErr := expandPaths(paths, ".passwd")
+	if eErr != nil {
+		return errors.Errorf("Files backend error: couldn't open passwords file: %s\n", eErr)
+	}
+
+	for _, path := range files {
+		if err := p.readPasswordsFile(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (p *filesParser) readPasswordsFile(path string) error {
+
+	file, fErr := os.Open(path)
+	if fErr != nil {
+		return errors.Errorf("Files backend error: couldn't open passwords file: %s\n", fErr)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	index := 0
+	//Read line by line
+	for scanner.Scan() {
+		index++
+		line := scanner.Text()
+
+		//Check comment or empty line to skip them.
+		if checkCommentOrEmpty(line) {
+			continue
+		}
+
+		lineArr := strings.Split(line, ":")
+		if len(lineArr) != 2 {
+			p.issuef(path, index, "password line must be username:hash")
+			continue
+		}
+
+		if lineArr[0] == "" || lineArr[1] == "" {
+			p.issuef(path, index, "empty username or password hash")
+			continue
+		}
+
+		source := fmt.Sprintf("%s:%d", path, index)
+		if previous, ok := p.userSources[lineArr[0]]; ok {
+			p.issuef(path, index, "duplicate user %s, already defined at %s", lineArr[0], previous)
+		}
+
+		p.users[lineArr[0]] = lineArr[1]
+		p.userSources[lineArr[0]] = source
+		p.userFiles[lineArr[0]] = path
+	}
+
+	if sErr := scanner.Err(); sErr != nil {
+		return errors.Errorf("Files backend error: couldn't read passwords file %s: %s\n", path, sErr)
+	}
+
+	p.fileCount++
+
+	return nil
+
+}
+
+//readAcls reads every acl file in paths. Errors are only returned when files can't be read; malformed lines are kept as issues.
+func (p *filesParser) readAcls(paths string) error {
+
+	files, eErr := expandPaths(paths, ".acl")
+	if eErr != nil {
+		return errors.Errorf("Files backend error: couldn't open acl file: %s\n", eErr)
+	}
+
+	for _, path := range files {
+		if err := p.readAclFile(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+//readAclFile reads an acl file. A user line only applies to the file it's in.
+func (p *filesParser) readAclFile(path string) error {
+
+	//Set currentUser as empty string
+	currentUser := ""
+
+	file, fErr := os.Open(path)
+	if fErr != nil {
+		return errors.Errorf("Files backend error: couldn't open acl file: %s\n", fErr)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	index := 0
+
+	for scanner.Scan() {
+		index++
+		line := scanner.Text()
+
+		//Check comment or empty line to skip them.
+		if checkCommentOrEmpty(line) {
+			continue
+		}
+
+		keyword, rest := nextToken(line)
+
+		switch keyword {
+		case "user":
+			//Usernames can't contain spaces, so anything after the username is a mistake.
+			username, extra := nextToken(rest)
+			if username == "" || extra != "" {
+				p.issuef(path, index, "user line must be: user <username>")
+				continue
+			}
+			currentUser = username
+			if _, ok := p.aclUsers[currentUser]; !ok {
+				p.aclUsers[currentUser] = FilesIssue{Source: path, Line: index}
+			}
+
+		case "topic", "pattern":
+			aclRecord, err := parseAclRule(rest)
+			if err != nil {
+				p.issuef(path, index, "%s", err)
+				continue
+			}
+			aclRecord.Source = path
+			aclRecord.Line = index
+
+			//Topic lines go to the current user, patterns and topics before any user line are general.
+			if keyword == "topic" && currentUser != "" {
+				p.userAclRecords[currentUser] = append(p.userAclRecords[currentUser], aclRecord)
+				Log.Debugf(" acl topic rule '%s' (%d) added to user %s (%s:%d)", aclRecord.Topic, aclRecord.Acc, currentUser, path, index)
+			} else {
+				p.aclRecords = append(p.aclRecords, aclRecord)
+				Log.Debugf(" acl %s rule '%s' (%d) added to no user (%s:%d)", keyword, aclRecord.Topic, aclRecord.Acc, path, index)
+			}
+
+			p.aclCount++
+
+		default:
+			p.issuef(path, index, "unknown keyword %q, expected user, topic or pattern", keyword)
+		}
+	}
+
+	if sErr := scanner.Err(); sErr != nil {
+		return errors.Errorf("Files backend error: couldn't read acl file %s: %s\n", path, sErr)
+	}
+
+	p.fileCount++
+
+	return nil
+
+}
+
+//parseAclRule parses what follows a topic or pattern keyword: an optional access and the topic.
+//When only one token is given it's the topic and readwrite access is assumed. Topics may contain spaces only when an access is given.
+func parseAclRule(rule string) (AclRecord, error) {
+	var aclRecord = AclRecord{
+		Topic: "",
+		Acc:   MOSQ_ACL_NONE,
+	}
+
+	access, topic := nextToken(rule)
+	if access == "" {
+		return aclRecord, errors.New("missing topic")
+	}
+
+	if topic == "" {
+		if !common.ValidTopicFilter(access) {
+			return aclRecord, errors.Errorf("invalid topic filter %s", access)
+		}
+		aclRecord.Topic = access
+		aclRecord.Acc = MOSQ_ACL_READWRITE
+		return aclRecord, nil
+	}
+
+	if !common.ValidTopicFilter(topic) {
+		return aclRecord, errors.Errorf("invalid topic filter %s", topic)
+	}
+
+	aclRecord.Topic = topic
+	switch access {
+	case "read":
+		aclRecord.Acc = MOSQ_ACL_READ
+	case "write":
+		aclRecord.Acc = MOSQ_ACL_WRITE
+	case "readwrite":
+		aclRecord.Acc = MOSQ_ACL_READWRITE
+	case "subscribe":
+		aclRecord.Acc = MOSQ_ACL_SUBSCRIBE
+	case "deny":
+		//As in mosquitto, deny revokes any access to the topic.
+		aclRecord.Acc = MOSQ_ACL_READWRITE | MOSQ_ACL_SUBSCRIBE
+		aclRecord.Deny = true
+	default:
+		return aclRecord, errors.Errorf("unknown access %q, expected read, write, readwrite, subscribe or deny", access)
+	}
+
+	return aclRecord, nil
+}
+
+//nextToken returns the first whitespace separated token of s and the rest of it, both trimmed.
+func nextToken(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+//usersWithoutPassword returns an issue for every user with acls but no password entry, sorted by location.
+func (p *filesParser) usersWithoutPassword() []FilesIssue {
+	issues := make([]FilesIssue, 0)
+	for username, location := range p.aclUsers {
+		if _, ok := p.users[username]; !ok {
+			location.Msg = fmt.Sprintf("user %s has acls but no password entry", username)
+			issues = append(issues, location)
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Source != issues[j].Source {
+			return issues[i].Source < issues[j].Source
+		}
+		return issues[i].Line < issues[j].Line
+	})
+	return issues
+}
+
+func checkCommentOrEmpty(line string) bool {
+	line = strings.TrimSpace(line)
+	return len(line) == 0 || line[0:1] == "#"
+}
+
+//LintFiles reads the files backend configuration from authOpts and returns every issue found in its files,
+//including users that have acls but no password entry. Errors are returned for options or files that can't be used at all.
+func LintFiles(authOpts map[string]string) ([]FilesIssue, error) {
+
+	format := authOpts["files_format"]
+	if format == "" {
+		format = filesFormatMosquitto
+	}
+
+	switch format {
+	case filesFormatMosquitto:
+	case filesFormatYAML, filesFormatJSON:
+		//Policies are strictly validated, so the first error is the only issue.
+		policyPath, ok := authOpts["policy_path"]
+		if !ok {
+			return nil, errors.New("no policy path given")
+		}
+		files := &Files{PolicyPath: policyPath, Format: format}
+		if err := files.readPolicy(); err != nil {
+			if pErr, ok := err.(*PolicyError); ok {
+				return []FilesIssue{{Source: pErr.Path, Line: pErr.Line, Column: pErr.Column, Msg: pErr.Msg}}, nil
+			}
+			return nil, err
+		}
+		return []FilesIssue{}, nil
+	default:
+		return nil, errors.Errorf("unknown files format %s", format)
+	}
+
+	passwordPath, ok := authOpts["password_path"]
+	if !ok {
+		return nil, errors.New("no password path given")
+	}
+
+	p := newFilesParser()
+	if err := p.readPasswords(passwordPath); err != nil {
+		return nil, err
+	}
+
+	if aclPath, ok := authOpts["acl_path"]; ok {
+		if err := p.readAcls(aclPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(p.issues, p.usersWithoutPassword()...), nil
+}
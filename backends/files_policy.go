@@ -0,0 +1,487 @@
+// +build files
+
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+//Structured policy formats accepted by the files backend besides mosquitto's line based one.
+const (
+	filesFormatMosquitto = "mosquitto"
+	filesFormatYAML      = "yaml"
+	filesFormatJSON      = "json"
+)
+
+//PolicyError is a policy document validation error located at a given line and column.
+type PolicyError struct {
+	Path   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Column, e.Msg)
+}
+
+//policyParser walks decoded policy documents and fills users, superusers and acl records.
+type policyParser struct {
+	path           string
+	documents      []policyDocument
+	users          map[string]string
+	userSources    map[string]string
+	superusers     map[string]bool
+	userAclRecords map[string][]AclRecord
+	aclRecords     []AclRecord
+	groups         map[string][]AclRecord
+	groupSources   map[string]string
+}
+
+//policyDocument holds the top level fields of a policy file.
+type policyDocument struct {
+	path   string
+	fields map[string]*yaml.Node
+}
+
+func newPolicyParser() *policyParser {
+	return &policyParser{
+		documents:      make([]policyDocument, 0),
+		users:          make(map[string]string),
+		userSources:    make(map[string]string),
+		superusers:     make(map[string]bool),
+		userAclRecords: make(map[string][]AclRecord),
+		aclRecords:     make([]AclRecord, 0),
+		groups:         make(map[string][]AclRecord),
+		groupSources:   make(map[string]string),
+	}
+}
+
+//readPolicy reads every structured (yaml or json) policy file and populates users, superusers and acls.
+//Groups are shared by all files, and users may only be defined once across them.
+func (o *Files) readPolicy() error {
+
+	exts := []string{".yaml", ".yml"}
+	if o.Format == filesFormatJSON {
+		exts = []string{".json"}
+	}
+
+	paths, err := expandPaths(o.PolicyPath, exts...)
+	if err != nil {
+		return errors.Errorf("Files backend error: couldn't open policy file: %s\n", err)
+	}
+
+	p := newPolicyParser()
+
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Errorf("Files backend error: couldn't open policy file: %s\n", err)
+		}
+
+		if err := p.load(path, o.Format, content); err != nil {
+			return err
+		}
+	}
+
+	if err := p.parse(); err != nil {
+		return err
+	}
+
+	o.Users = p.users
+	o.Superusers = p.superusers
+	o.UserAclRecords = p.userAclRecords
+	o.AclRecords = p.aclRecords
+
+	Log.Infof("Read %d users from %d policy files", len(o.Users), len(paths))
+
+	return nil
+}
+
+//parsePolicy validates and parses a single policy document. Any error is returned as a *PolicyError when its location is known.
+func parsePolicy(path, format string, content []byte) (*policyParser, error) {
+	p := newPolicyParser()
+
+	if err := p.load(path, format, content); err != nil {
+		return nil, err
+	}
+
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+//load decodes a policy document and checks its top level fields. Documents are parsed later on by parse.
+func (p *policyParser) load(path, format string, content []byte) error {
+
+	//Check JSON syntax first so that a json policy can't sneak yaml in and errors point to the right place.
+	if format == filesFormatJSON {
+		var raw interface{}
+		if err := json.Unmarshal(content, &raw); err != nil {
+			if sErr, ok := err.(*json.SyntaxError); ok {
+				line, column := offsetToPosition(content, sErr.Offset)
+				return &PolicyError{Path: path, Line: line, Column: column, Msg: sErr.Error()}
+			}
+			return errors.Errorf("%s: %s", path, err)
+		}
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return errors.Errorf("%s: %s", path, err)
+	}
+
+	//An empty document is a valid, if useless, policy.
+	if root.Kind == 0 || len(root.Content) == 0 {
+		return nil
+	}
+
+	p.path = path
+	fields, err := p.mappingFields(root.Content[0], "policy", "users", "groups", "acls")
+	if err != nil {
+		return err
+	}
+
+	p.documents = append(p.documents, policyDocument{path: path, fields: fields})
+
+	return nil
+}
+
+//parse walks every loaded document. Groups from all of them go first so that users may reference them regardless of their order.
+func (p *policyParser) parse() error {
+
+	for _, document := range p.documents {
+		p.path = document.path
+		if groups, ok := document.fields["groups"]; ok {
+			items, err := p.sequence(groups, "groups")
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				if err := p.parseGroup(item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, document := range p.documents {
+		p.path = document.path
+		if users, ok := document.fields["users"]; ok {
+			items, err := p.sequence(users, "users")
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				if err := p.parseUser(item); err != nil {
+					return err
+				}
+			}
+		}
+
+		if acls, ok := document.fields["acls"]; ok {
+			records, err := p.parseAcls(acls)
+			if err != nil {
+				return err
+			}
+			p.aclRecords = append(p.aclRecords, records...)
+		}
+	}
+
+	return nil
+}
+
+//offsetToPosition converts a byte offset to 1 based line and column numbers.
+func offsetToPosition(content []byte, offset int64) (int, int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+func (p *policyParser) errorf(node *yaml.Node, format string, args ...interface{}) error {
+	return &PolicyError{Path: p.path, Line: node.Line, Column: node.Column, Msg: fmt.Sprintf(format, args...)}
+}
+
+//mappingFields checks that node is a mapping with only the allowed keys and returns its values by key.
+func (p *policyParser) mappingFields(node *yaml.Node, what string, allowed ...string) (map[string]*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, p.errorf(node, "%s must be a mapping", what)
+	}
+
+	fields := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		known := false
+		for _, a := range allowed {
+			if key.Value == a {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, p.errorf(key, "unknown field %q in %s", key.Value, what)
+		}
+		if _, ok := fields[key.Value]; ok {
+			return nil, p.errorf(key, "duplicate field %q in %s", key.Value, what)
+		}
+		fields[key.Value] = value
+	}
+
+	return fields, nil
+}
+
+func (p *policyParser) sequence(node *yaml.Node, what string) ([]*yaml.Node, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, p.errorf(node, "%s must be a list", what)
+	}
+	return node.Content, nil
+}
+
+func (p *policyParser) str(node *yaml.Node, what string) (string, error) {
+	if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!str" {
+		return "", p.errorf(node, "%s must be a string", what)
+	}
+	return node.Value, nil
+}
+
+func (p *policyParser) boolean(node *yaml.Node, what string) (bool, error) {
+	if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!bool" {
+		return false, p.errorf(node, "%s must be true or false", what)
+	}
+	return strconv.ParseBool(node.Value)
+}
+
+func (p *policyParser) parseGroup(node *yaml.Node) error {
+	fields, err := p.mappingFields(node, "group", "name", "acls")
+	if err != nil {
+		return err
+	}
+
+	nameNode, ok := fields["name"]
+	if !ok {
+		return p.errorf(node, "group is missing name")
+	}
+	name, err := p.str(nameNode, "group name")
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return p.errorf(nameNode, "group name can't be empty")
+	}
+	if previous, ok := p.groupSources[name]; ok {
+		return p.errorf(nameNode, "duplicate group %q, already defined at %s", name, previous)
+	}
+
+	records := make([]AclRecord, 0)
+	if acls, ok := fields["acls"]; ok {
+		records, err = p.parseAcls(acls)
+		if err != nil {
+			return err
+		}
+	}
+	p.groups[name] = records
+	p.groupSources[name] = fmt.Sprintf("%s:%d", p.path, nameNode.Line)
+
+	return nil
+}
+
+func (p *policyParser) parseUser(node *yaml.Node) error {
+	fields, err := p.mappingFields(node, "user", "username", "password", "superuser", "groups", "acls")
+	if err != nil {
+		return err
+	}
+
+	usernameNode, ok := fields["username"]
+	if !ok {
+		return p.errorf(node, "user is missing username")
+	}
+	username, err := p.str(usernameNode, "username")
+	if err != nil {
+		return err
+	}
+	if username == "" {
+		return p.errorf(usernameNode, "username can't be empty")
+	}
+	if previous, ok := p.userSources[username]; ok {
+		return p.errorf(usernameNode, "duplicate user %q, already defined at %s", username, previous)
+	}
+
+	passwordNode, ok := fields["password"]
+	if !ok {
+		return p.errorf(node, "user %s is missing password", username)
+	}
+	password, err := p.str(passwordNode, "password")
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return p.errorf(passwordNode, "password of user %s can't be empty", username)
+	}
+	p.users[username] = password
+	p.userSources[username] = fmt.Sprintf("%s:%d", p.path, usernameNode.Line)
+
+	if superuserNode, ok := fields["superuser"]; ok {
+		superuser, err := p.boolean(superuserNode, "superuser")
+		if err != nil {
+			return err
+		}
+		if superuser {
+			p.superusers[username] = true
+		}
+	}
+
+	records := make([]AclRecord, 0)
+
+	if groupsNode, ok := fields["groups"]; ok {
+		groups, err := p.sequence(groupsNode, "groups")
+		if err != nil {
+			return err
+		}
+		for _, groupNode := range groups {
+			group, err := p.str(groupNode, "group")
+			if err != nil {
+				return err
+			}
+			groupRecords, ok := p.groups[group]
+			if !ok {
+				return p.errorf(groupNode, "unknown group %q", group)
+			}
+			records = append(records, groupRecords...)
+		}
+	}
+
+	if acls, ok := fields["acls"]; ok {
+		userRecords, err := p.parseAcls(acls)
+		if err != nil {
+			return err
+		}
+		records = append(records, userRecords...)
+	}
+
+	if len(records) > 0 {
+		p.userAclRecords[username] = records
+	}
+
+	return nil
+}
+
+func (p *policyParser) parseAcls(node *yaml.Node) ([]AclRecord, error) {
+	items, err := p.sequence(node, "acls")
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]AclRecord, 0, len(items))
+	for _, item := range items {
+		record, err := p.parseAcl(item)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (p *policyParser) parseAcl(node *yaml.Node) (AclRecord, error) {
+	var record = AclRecord{
+		Source: p.path,
+		Line:   node.Line,
+	}
+
+	fields, err := p.mappingFields(node, "acl", "topic", "access", "deny", "clientid", "comment")
+	if err != nil {
+		return record, err
+	}
+
+	topicNode, ok := fields["topic"]
+	if !ok {
+		return record, p.errorf(node, "acl is missing topic")
+	}
+	record.Topic, err = p.str(topicNode, "topic")
+	if err != nil {
+		return record, err
+	}
+	if strings.TrimSpace(record.Topic) == "" {
+		return record, p.errorf(topicNode, "topic can't be empty")
+	}
+	if !common.ValidTopicFilter(record.Topic) {
+		return record, p.errorf(topicNode, "invalid topic filter %s", record.Topic)
+	}
+
+	accessNode, ok := fields["access"]
+	if !ok {
+		return record, p.errorf(node, "acl for topic %s is missing access", record.Topic)
+	}
+	accessList, err := p.sequence(accessNode, "access")
+	if err != nil {
+		return record, err
+	}
+	if len(accessList) == 0 {
+		return record, p.errorf(accessNode, "access for topic %s can't be empty", record.Topic)
+	}
+	for _, accNode := range accessList {
+		access, err := p.str(accNode, "access")
+		if err != nil {
+			return record, err
+		}
+		acc, ok := parseAccess(access)
+		if !ok {
+			return record, p.errorf(accNode, "unknown access %q", access)
+		}
+		record.Acc |= acc
+	}
+
+	if denyNode, ok := fields["deny"]; ok {
+		record.Deny, err = p.boolean(denyNode, "deny")
+		if err != nil {
+			return record, err
+		}
+	}
+
+	if clientIDNode, ok := fields["clientid"]; ok {
+		record.ClientID, err = p.str(clientIDNode, "clientid")
+		if err != nil {
+			return record, err
+		}
+	}
+
+	if commentNode, ok := fields["comment"]; ok {
+		record.Comment, err = p.str(commentNode, "comment")
+		if err != nil {
+			return record, err
+		}
+	}
+
+	return record, nil
+}
+
+//parseAccess maps an access name to its mosquitto acc value.
+func parseAccess(access string) (byte, bool) {
+	switch access {
+	case "read":
+		return MOSQ_ACL_READ, true
+	case "write":
+		return MOSQ_ACL_WRITE, true
+	case "readwrite":
+		return MOSQ_ACL_READWRITE, true
+	case "subscribe":
+		return MOSQ_ACL_SUBSCRIBE, true
+	}
+	return MOSQ_ACL_NONE, false
+}
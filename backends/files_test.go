@@ -3,9 +3,12 @@
 package backends
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/iegomez/mosquitto-go-auth/common"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -126,6 +129,21 @@ func TestFiles(t *testing.T) {
 
 		})
 
+		Convey("Subscriptions should only be allowed when an acl covers every topic the filter matches", func() {
+			So(files.CheckAcl(user2, "test/topic/+", clientID, 4), ShouldBeTrue)
+			So(files.CheckAcl(user2, "test/topic/#", clientID, 4), ShouldBeFalse)
+			So(files.CheckAcl(user2, "test/#", clientID, 4), ShouldBeFalse)
+			So(files.CheckAcl(user3, "test/+/1", clientID, 4), ShouldBeTrue)
+			So(files.CheckAcl(user3, "test/#", clientID, 4), ShouldBeTrue)
+			So(files.CheckAcl(user3, "$share/group/test/topic/#", clientID, 4), ShouldBeTrue)
+			So(files.CheckAcl(user3, "#", clientID, 4), ShouldBeFalse)
+		})
+
+		Convey("Write only rules should not allow subscribing", func() {
+			So(files.CheckAcl(user1, testTopic1, clientID, 4), ShouldBeFalse)
+			So(files.CheckAcl(user1, testTopic2, clientID, 4), ShouldBeTrue)
+		})
+
 		//Now check against patterns.
 
 		Convey("Given a topic that mentions username, acl check should pass", func() {
@@ -144,3 +162,457 @@ func TestFiles(t *testing.T) {
 	})
 
 }
+
+func TestFilesMultiplePaths(t *testing.T) {
+
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	pwDir, _ := filepath.Abs("../test-files/passwords.d")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+	aclDir, _ := filepath.Abs("../test-files/acls.d")
+
+	authOpts := map[string]string{
+		"password_path": pwPath + ", " + pwDir,
+		"acl_path":      aclPath + "," + aclDir,
+	}
+
+	Convey("Given lists of files and directories NewFiles should merge all of them", t, func() {
+		files, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Users from every password file should be read, keeping the last definition of duplicates", func() {
+			So(files.GetUser("test4", "test4"), ShouldBeTrue)
+			So(files.GetUser("test1", "other"), ShouldBeTrue)
+			So(files.GetUser("test1", "test1"), ShouldBeFalse)
+		})
+
+		Convey("Acls from every acl file should be read in order", func() {
+			So(files.CheckAcl("test4", "team/a/b", "test_client", 1), ShouldBeTrue)
+			So(files.CheckAcl("test4", "team/a/status", "test_client", 2), ShouldBeTrue)
+			So(files.CheckAcl("test4", "team/a/b", "test_client", 2), ShouldBeFalse)
+			So(files.CheckAcl("test1", "test/topic/1", "test_client", 2), ShouldBeTrue)
+		})
+
+		Convey("Records should keep their source file and line", func() {
+			records := files.(*Files).UserAclRecords["test4"]
+			So(len(records), ShouldEqual, 2)
+			So(records[0].Source, ShouldEqual, filepath.Join(aclDir, "10-team.acl"))
+			So(records[0].Line, ShouldEqual, 2)
+			So(records[1].Source, ShouldEqual, filepath.Join(aclDir, "20-team.acl"))
+		})
+	})
+
+	Convey("Given duplicate users and strict mode NewFiles should fail", t, func() {
+		_, err := NewFiles(map[string]string{"password_path": pwPath + "," + pwDir, "files_strict": "true"}, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, "duplicate user test1")
+	})
+
+	Convey("Given a missing path NewFiles should fail", t, func() {
+		_, err := NewFiles(map[string]string{"password_path": pwPath + ",/does/not/exist"}, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given policies defining the same user in different files parsing should fail", t, func() {
+		p := newPolicyParser()
+		So(p.load("a.yaml", "yaml", []byte("groups:\n  - name: g\n    acls: []\n")), ShouldBeNil)
+		So(p.load("b.yaml", "yaml", []byte("users:\n  - username: u\n    password: hash\n    groups: [g]\n")), ShouldBeNil)
+		So(p.load("c.yaml", "yaml", []byte("users:\n  - username: u\n    password: hash\n")), ShouldBeNil)
+		err := p.parse()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, `c.yaml:2:15: duplicate user "u", already defined at b.yaml:2`)
+	})
+
+}
+
+func TestFilesStrict(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "files-strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	badPwPath := filepath.Join(dir, "bad.passwd")
+	aclPath := filepath.Join(dir, "bad.acl")
+
+	ioutil.WriteFile(badPwPath, []byte("# Only a comment and a broken line.\nbroken\n"), 0600)
+	ioutil.WriteFile(aclPath, []byte(`user test1
+topic raed test/topic/1
+topic read user/1
+  # An indented comment.
+usr test2
+user test4
+topic write test/topic/4
+topic read test/#/4
+pattern write test+/%u
+`), 0600)
+
+	authOpts := map[string]string{
+		"password_path": pwPath,
+		"acl_path":      aclPath,
+	}
+
+	Convey("Given malformed lines and no strict mode NewFiles should skip them", t, func() {
+		files, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("A typo in the access should drop the rule instead of reading it as a topic", func() {
+			So(files.CheckAcl("test1", "test/topic/1", "test_client", 1), ShouldBeFalse)
+			So(files.CheckAcl("test1", "raed test/topic/1", "test_client", 1), ShouldBeFalse)
+		})
+
+		Convey("A topic containing the word user should be read as a topic", func() {
+			So(files.CheckAcl("test1", "user/1", "test_client", 1), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given malformed lines and strict mode NewFiles should fail", t, func() {
+		strictOpts := map[string]string{
+			"password_path": pwPath,
+			"acl_path":      aclPath,
+			"files_strict":  "true",
+		}
+		_, err := NewFiles(strictOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+		So(err.Error(), ShouldContainSubstring, aclPath+":2: unknown access \"raed\"")
+		So(err.Error(), ShouldContainSubstring, aclPath+":5: unknown keyword \"usr\"")
+		So(err.Error(), ShouldContainSubstring, aclPath+":8: invalid topic filter test/#/4")
+	})
+
+	Convey("Given valid files and strict mode NewFiles should succeed", t, func() {
+		validAclPath, _ := filepath.Abs("../test-files/acls")
+		_, err := NewFiles(map[string]string{"password_path": pwPath, "acl_path": validAclPath, "files_strict": "true"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Lint should report every issue, including users without passwords", t, func() {
+		issues, err := LintFiles(map[string]string{"password_path": pwPath + "," + badPwPath, "acl_path": aclPath})
+		So(err, ShouldBeNil)
+
+		lines := make([]string, 0, len(issues))
+		for _, issue := range issues {
+			lines = append(lines, issue.String())
+		}
+
+		So(lines, ShouldResemble, []string{
+			badPwPath + ":2: password line must be username:hash",
+			aclPath + ":2: unknown access \"raed\", expected read, write, readwrite, subscribe or deny",
+			aclPath + ":5: unknown keyword \"usr\", expected user, topic or pattern",
+			aclPath + ":8: invalid topic filter test/#/4",
+			aclPath + ":9: invalid topic filter test+/%u",
+			aclPath + ":6: user test4 has acls but no password entry",
+		})
+	})
+
+	Convey("Lint should report policy errors with their column", t, func() {
+		policyPath := filepath.Join(dir, "bad.yaml")
+		ioutil.WriteFile(policyPath, []byte("users:\n  - username: test1\n    pasword: hash\n"), 0600)
+		issues, err := LintFiles(map[string]string{"files_format": "yaml", "policy_path": policyPath})
+		So(err, ShouldBeNil)
+		So(len(issues), ShouldEqual, 1)
+		So(issues[0].String(), ShouldEqual, policyPath+`:3:5: unknown field "pasword" in user`)
+	})
+
+}
+
+func TestFilesPolicy(t *testing.T) {
+
+	for _, format := range []string{"yaml", "json"} {
+
+		authOpts := map[string]string{
+			"files_format": format,
+		}
+
+		Convey("Given a "+format+" format and no policy path NewFiles should fail", t, func() {
+			_, err := NewFiles(authOpts, log.DebugLevel)
+			So(err, ShouldBeError)
+		})
+
+		policyPath, _ := filepath.Abs("../test-files/policy." + format)
+		authOpts["policy_path"] = policyPath
+
+		Convey("Given a valid "+format+" policy NewFiles should return a new files backend instance", t, func() {
+			files, err := NewFiles(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			user1 := "test1"
+			user2 := "test2"
+			user3 := "test3"
+			clientID := "test_client"
+
+			Convey("Given a username and a correct password, it should correctly authenticate it", func() {
+				So(files.GetUser(user1, user1), ShouldBeTrue)
+				So(files.GetUser(user1, user2), ShouldBeFalse)
+			})
+
+			Convey("Only users flagged as superusers should be superusers", func() {
+				So(files.GetSuperuser(user1), ShouldBeFalse)
+				So(files.GetSuperuser(user3), ShouldBeTrue)
+			})
+
+			Convey("User 1 should be able to publish and not subscribe to test topic 1, and only subscribe but not publish to topic 2", func() {
+				So(files.CheckAcl(user1, "test/topic/1", clientID, 2), ShouldBeTrue)
+				So(files.CheckAcl(user1, "test/topic/1", clientID, 1), ShouldBeFalse)
+				So(files.CheckAcl(user1, "test/topic/2", clientID, 2), ShouldBeFalse)
+				So(files.CheckAcl(user1, "test/topic/2", clientID, 1), ShouldBeTrue)
+			})
+
+			Convey("Rules with a clientid should only apply to that client", func() {
+				So(files.CheckAcl(user1, "clientid/topic", clientID, 2), ShouldBeTrue)
+				So(files.CheckAcl(user1, "clientid/topic", "other_client", 2), ShouldBeFalse)
+			})
+
+			Convey("User 2 should get group rules, except for the denied topic", func() {
+				So(files.CheckAcl(user2, "test/topic/1", clientID, 1), ShouldBeTrue)
+				So(files.CheckAcl(user2, "test/topic/2", clientID, 1), ShouldBeFalse)
+				So(files.CheckAcl(user2, "test/other/1", clientID, 1), ShouldBeFalse)
+			})
+
+			Convey("An access list should grant every listed access", func() {
+				So(files.CheckAcl(user3, "test/other/1", clientID, 1), ShouldBeTrue)
+				So(files.CheckAcl(user3, "test/other/1", clientID, 4), ShouldBeTrue)
+				So(files.CheckAcl(user3, "test/other/1", clientID, 2), ShouldBeFalse)
+			})
+
+			Convey("A subscription deny should apply to every filter that may match its topics", func() {
+				So(files.CheckAcl(user3, "test/secret/1", clientID, 4), ShouldBeFalse)
+				So(files.CheckAcl(user3, "test/#", clientID, 4), ShouldBeFalse)
+				So(files.CheckAcl(user3, "test/+/1", clientID, 4), ShouldBeFalse)
+				So(files.CheckAcl(user3, "test/other/#", clientID, 4), ShouldBeTrue)
+				So(files.CheckAcl(user3, "test/secret/1", clientID, 1), ShouldBeTrue)
+			})
+
+			Convey("Given a topic that mentions username or clientid, acl check should pass", func() {
+				So(files.CheckAcl(user1, "test/test1", clientID, 1), ShouldBeTrue)
+				So(files.CheckAcl(user1, "test/test_client", clientID, 1), ShouldBeTrue)
+				So(files.CheckAcl(user1, "test/test2", clientID, 1), ShouldBeFalse)
+			})
+
+			Convey("User and group acls should replace username and clientid too", func() {
+				So(files.CheckAcl(user1, "clients/test_client", clientID, 2), ShouldBeTrue)
+				So(files.CheckAcl(user1, "clients/other_client", clientID, 2), ShouldBeFalse)
+				So(files.CheckAcl(user1, "clients/%c", clientID, 2), ShouldBeFalse)
+				So(files.CheckAcl(user2, "readers/test2", clientID, 2), ShouldBeTrue)
+				So(files.CheckAcl(user2, "readers/test1", clientID, 2), ShouldBeFalse)
+			})
+
+			files.Halt()
+		})
+	}
+
+	Convey("Given invalid policies, parsing should fail with the error's position", t, func() {
+
+		Convey("An unknown access should be reported", func() {
+			_, err := parsePolicy("policy.yaml", "yaml", []byte("users:\n  - username: test1\n    password: hash\n    acls:\n      - topic: foo/#\n        access: [raed]\n"))
+			So(err, ShouldNotBeNil)
+			pErr, ok := err.(*PolicyError)
+			So(ok, ShouldBeTrue)
+			So(pErr.Line, ShouldEqual, 6)
+			So(pErr.Column, ShouldEqual, 18)
+			So(err.Error(), ShouldEqual, `policy.yaml:6:18: unknown access "raed"`)
+		})
+
+		Convey("An unknown field should be reported", func() {
+			_, err := parsePolicy("policy.yaml", "yaml", []byte("users:\n  - username: test1\n    pasword: hash\n"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `policy.yaml:3:5: unknown field "pasword" in user`)
+		})
+
+		Convey("Duplicate users should be reported", func() {
+			_, err := parsePolicy("policy.yaml", "yaml", []byte("users:\n  - username: test1\n    password: hash\n  - username: test1\n    password: hash\n"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `policy.yaml:4:15: duplicate user "test1", already defined at policy.yaml:2`)
+		})
+
+		Convey("Unknown groups should be reported", func() {
+			_, err := parsePolicy("policy.json", "json", []byte("{\"users\": [{\"username\": \"test1\", \"password\": \"hash\",\n \"groups\": [\"nope\"]}]}"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `policy.json:2:13: unknown group "nope"`)
+		})
+
+		Convey("Wrong types should be reported", func() {
+			_, err := parsePolicy("policy.json", "json", []byte("{\"users\": [{\"username\": \"test1\", \"password\": \"hash\", \"superuser\": \"yes\"}]}"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `policy.json:1:67: superuser must be true or false`)
+		})
+
+		Convey("Invalid topic filters should be reported", func() {
+			_, err := parsePolicy("policy.yaml", "yaml", []byte("acls:\n  - topic: foo/#/bar\n    access: [read]\n"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `policy.yaml:2:12: invalid topic filter foo/#/bar`)
+
+			_, err = parsePolicy("policy.yaml", "yaml", []byte("acls:\n  - topic: foo/bar+\n    access: [read]\n"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("JSON syntax errors should be reported", func() {
+			_, err := parsePolicy("policy.json", "json", []byte("{\n  \"users\": [,]\n}"))
+			So(err, ShouldNotBeNil)
+			pErr, ok := err.(*PolicyError)
+			So(ok, ShouldBeTrue)
+			So(pErr.Line, ShouldEqual, 2)
+		})
+
+	})
+
+}
+
+func TestFilesHashUpgrade(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "files-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content, err := ioutil.ReadFile("../test-files/passwords")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pwPath := filepath.Join(dir, "passwords")
+
+	authOpts := map[string]string{
+		"password_path":            pwPath,
+		"hash_upgrade_algorithm":   "argon2id",
+		"hash_upgrade_iterations":  "1",
+		"hash_upgrade_memory":      "1024",
+		"hash_upgrade_parallelism": "1",
+	}
+
+	Convey("Given an invalid hash upgrade policy NewFiles should fail", t, func() {
+		So(ioutil.WriteFile(pwPath, content, 0600), ShouldBeNil)
+		_, err := NewFiles(map[string]string{"password_path": pwPath, "hash_upgrade_algorithm": "md5"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a hash upgrade policy, weaker hashes should be upgraded on successful logins", t, func() {
+		//Write the file on every run, as each nested Convey runs the whole block again.
+		So(ioutil.WriteFile(pwPath, append([]byte("# users\n"), content...), 0600), ShouldBeNil)
+
+		be, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		files := be.(*Files)
+
+		So(files.GetUser("test1", "wrong"), ShouldBeFalse)
+		So(files.Users["test1"], ShouldStartWith, "PBKDF2$")
+
+		So(files.GetUser("test1", "test1"), ShouldBeTrue)
+		So(files.Users["test1"], ShouldStartWith, "$argon2id$v=19$m=1024,t=1,p=1$")
+
+		Convey("The password file should be rewritten, keeping other lines and its mode", func() {
+			info, err := os.Stat(pwPath)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+
+			rewritten, err := ioutil.ReadFile(pwPath)
+			So(err, ShouldBeNil)
+			So(string(rewritten), ShouldStartWith, "# users\ntest1:$argon2id$")
+			So(string(rewritten), ShouldContainSubstring, "test2:PBKDF2$")
+
+			reloaded, err := NewFiles(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(reloaded.GetUser("test1", "test1"), ShouldBeTrue)
+			So(reloaded.(*Files).Users["test1"], ShouldEqual, files.Users["test1"])
+		})
+
+		Convey("Hashes already meeting the policy should be kept", func() {
+			hash := files.Users["test1"]
+			So(files.GetUser("test1", "test1"), ShouldBeTrue)
+			So(files.Users["test1"], ShouldEqual, hash)
+		})
+	})
+
+}
+
+func TestFilesEdit(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "files-edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pwPath := filepath.Join(dir, "passwords")
+	aclPath := filepath.Join(dir, "acls")
+
+	Convey("Given a password file, users should be added, updated and removed keeping other lines", t, func() {
+		So(ioutil.WriteFile(pwPath, []byte("# users\ntest1:hash1\n\ntest2:hash2\n"), 0640), ShouldBeNil)
+
+		So(AddFilesUser(pwPath, "test3", "hash3"), ShouldBeNil)
+		So(AddFilesUser(pwPath, "test1", "other"), ShouldNotBeNil)
+		So(AddFilesUser(pwPath, "bad:user", "hash"), ShouldNotBeNil)
+		So(SetFilesPassword(pwPath, "test2", "new2"), ShouldBeNil)
+		So(SetFilesPassword(pwPath, "missing", "hash"), ShouldNotBeNil)
+		So(RemoveFilesUser(pwPath, "test1"), ShouldBeNil)
+		So(RemoveFilesUser(pwPath, "test1"), ShouldNotBeNil)
+
+		content, err := ioutil.ReadFile(pwPath)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "# users\n\ntest2:new2\ntest3:hash3\n")
+
+		info, err := os.Stat(pwPath)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0640))
+
+		Convey("Missing files should be created when adding users", func() {
+			newPath := filepath.Join(dir, "new.passwd")
+			So(AddFilesUser(newPath, "test1", "hash1"), ShouldBeNil)
+			content, err := ioutil.ReadFile(newPath)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "test1:hash1\n")
+		})
+	})
+
+	Convey("Given a password file with a repeated user, every definition should be replaced so the new password is the one used", t, func() {
+		two, err := common.Hash("two", 16, 1000, "sha512")
+		So(err, ShouldBeNil)
+		three, err := common.Hash("three", 16, 1000, "sha512")
+		So(err, ShouldBeNil)
+
+		So(ioutil.WriteFile(pwPath, []byte("test1:"+two+"\ntest2:hash2\ntest1:"+two+"\n"), 0600), ShouldBeNil)
+		So(SetFilesPassword(pwPath, "test1", three), ShouldBeNil)
+
+		content, err := ioutil.ReadFile(pwPath)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "test1:"+three+"\ntest2:hash2\ntest1:"+three+"\n")
+
+		files, err := NewFiles(map[string]string{"password_path": pwPath}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(files.GetUser("test1", "three"), ShouldBeTrue)
+		So(files.GetUser("test1", "two"), ShouldBeFalse)
+	})
+
+	Convey("Given an acl file, rules should be added and removed in the right blocks", t, func() {
+		So(ioutil.WriteFile(aclPath, []byte("# general rules\ntopic read public/#\n\nuser test1\n# test1 rules\ntopic write test/topic/1\n\nuser test2\ntopic read test/topic/+\n\npattern read test/%u\n"), 0600), ShouldBeNil)
+
+		So(AddFilesAclRule(aclPath, "test1", "topic  read  test/topic/2"), ShouldBeNil)
+		So(AddFilesAclRule(aclPath, "test1", "topic read test/topic/2"), ShouldNotBeNil)
+		So(AddFilesAclRule(aclPath, "test3", "topic read test/#"), ShouldBeNil)
+		So(AddFilesAclRule(aclPath, "", "topic write public/in"), ShouldBeNil)
+		So(AddFilesAclRule(aclPath, "", "pattern write test/%c"), ShouldBeNil)
+		So(AddFilesAclRule(aclPath, "test1", "pattern write test/%c"), ShouldNotBeNil)
+		So(AddFilesAclRule(aclPath, "test1", "topic raed test/#"), ShouldNotBeNil)
+		So(AddFilesAclRule(aclPath, "test1", "user test2"), ShouldNotBeNil)
+		So(AddFilesAclRule(aclPath, "test1", "topic read test/#/1"), ShouldNotBeNil)
+
+		So(RemoveFilesAclRule(aclPath, "test2", "topic read test/topic/+"), ShouldBeNil)
+		So(RemoveFilesAclRule(aclPath, "test1", "topic read test/topic/+"), ShouldNotBeNil)
+		So(RemoveFilesAclRule(aclPath, "", "pattern read test/%u"), ShouldBeNil)
+
+		content, err := ioutil.ReadFile(aclPath)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "# general rules\ntopic read public/#\ntopic write public/in\npattern write test/%c\n\nuser test1\n# test1 rules\ntopic write test/topic/1\ntopic read test/topic/2\n\nuser test2\n\n\nuser test3\ntopic read test/#\n")
+
+		Convey("Removing a user should remove its user lines and topic rules only", func() {
+			So(RemoveFilesAclUser(aclPath, "test1"), ShouldBeNil)
+			So(RemoveFilesAclUser(aclPath, "test1"), ShouldNotBeNil)
+
+			content, err := ioutil.ReadFile(aclPath)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldEqual, "# general rules\ntopic read public/#\ntopic write public/in\npattern write test/%c\n\n# test1 rules\n\nuser test2\n\n\nuser test3\ntopic read test/#\n")
+		})
+	})
+
+}
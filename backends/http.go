@@ -3,10 +3,7 @@
 package backends
 
 import (
-	"bytes"
-	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	h "net/http"
 	"net/url"
@@ -20,7 +17,6 @@ import (
 
 func init() {
 	RegisteredBackends["http"] = NewHTTP
-	log.Info("http init")
 }
 
 type HTTP struct {
@@ -33,11 +29,23 @@ type HTTP struct {
 	VerifyPeer   bool
 	ParamsMode   string
 	ResponseMode string
+
+	user      *httpEndpoint
+	superuser *httpEndpoint
+	acl       *httpEndpoint
+	headers   h.Header
+	client    *httpClient
+	users     *httpUserCache
 }
 
+//HTTPResponse is the response expected in json mode. The user endpoint may also return the user's superuser status and acls,
+//along with how long they may be cached, to answer later checks without asking the API.
 type HTTPResponse struct {
-	Ok    bool   `json:"ok"`
-	Error string `json:"error"`
+	Ok        bool      `json:"ok"`
+	Error     string    `json:"error"`
+	Superuser *bool     `json:"superuser,omitempty"`
+	Acls      *HTTPAcls `json:"acls,omitempty"`
+	CacheTTL  *int      `json:"cache_ttl,omitempty"`
 }
 
 func NewHTTP(authOpts map[string]string, logLevel log.Level) (Backend, error) {
@@ -50,6 +58,7 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		VerifyPeer:   false,
 		ResponseMode: "status",
 		ParamsMode:   "json",
+		users:        newHTTPUserCache(),
 	}
 
 	//If remote, set remote api fields. Else, set jwt secret.
@@ -113,6 +122,38 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		return http, errors.Errorf("HTTP backend error: missing remote options%s.\n", missingOpts)
 	}
 
+	endpoints := map[string]**httpEndpoint{
+		"getuser":   &http.user,
+		"superuser": &http.superuser,
+		"aclcheck":  &http.acl,
+	}
+	uris := map[string]string{
+		"getuser":   http.UserUri,
+		"superuser": http.SuperuserUri,
+		"aclcheck":  http.AclUri,
+	}
+	for name, endpoint := range endpoints {
+		if uris[name] == "" {
+			continue
+		}
+		var err error
+		if *endpoint, err = newHTTPEndpoint(authOpts, name, uris[name]); err != nil {
+			return http, errors.Errorf("HTTP backend error: %s.\n", err)
+		}
+	}
+
+	headers, err := newHTTPHeaders(authOpts)
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s.\n", err)
+	}
+	http.headers = headers
+
+	client, err := newHTTPClient(authOpts, "http", http.VerifyPeer)
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s.\n", err)
+	}
+	http.client = client
+
 	return http, nil
 }
 
@@ -128,12 +169,25 @@ func (o HTTP) GetUser(username, password string) bool {
 		"password": []string{password},
 	}
 
-	return httpRequest(o.Host, o.UserUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	data := httpTemplateData{Username: username, Password: password}
+
+	response, ttl, ok := o.request(o.user, username, data, dataMap, urlValues)
+	if !ok {
+		return false
+	}
+
+	o.users.set(username, httpCachedUser{superuser: response.Superuser, acls: response.Acls}, ttl)
+	return true
 
 }
 
 func (o HTTP) GetSuperuser(username string) bool {
 
+	if user, ok := o.users.get(username); ok && user.superuser != nil {
+		log.Debugf("http superuser check for %s answered from cache\n", username)
+		return *user.superuser
+	}
+
 	if len(o.SuperuserUri) == 0 {
 		return false
 	}
@@ -146,12 +200,19 @@ func (o HTTP) GetSuperuser(username string) bool {
 		"username": []string{username},
 	}
 
-	return httpRequest(o.Host, o.SuperuserUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	data := httpTemplateData{Username: username}
+
+	return o.httpRequest(o.superuser, username, data, dataMap, urlValues)
 
 }
 
 func (o HTTP) CheckAcl(username, topic, clientid string, acc int32) bool {
 
+	if user, ok := o.users.get(username); ok && user.acls != nil {
+		log.Debugf("http acl check for %s answered from cache\n", username)
+		return user.acls.allows(username, topic, clientid, acc)
+	}
+
 	dataMap := map[string]interface{}{
 		"username": username,
 		"clientid": clientid,
@@ -166,61 +227,35 @@ func (o HTTP) CheckAcl(username, topic, clientid string, acc int32) bool {
 		"acc":      []string{strconv.Itoa(int(acc))},
 	}
 
-	return httpRequest(o.Host, o.AclUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	data := httpTemplateData{Username: username, ClientId: clientid, Topic: topic, Acc: acc}
 
-}
+	return o.httpRequest(o.acl, username, data, dataMap, urlValues)
 
-func httpRequest(host, uri, username string, withTLS, verifyPeer bool, dataMap map[string]interface{}, port, paramsMode, responseMode string, urlValues map[string][]string) bool {
+}
 
-	tlsStr := "http://"
+//httpRequest requests the given endpoint with the backend's client, reusing its connections.
+func (o HTTP) httpRequest(endpoint *httpEndpoint, username string, data httpTemplateData, dataMap map[string]interface{}, urlValues url.Values) bool {
+	_, _, ok := o.request(endpoint, username, data, dataMap, urlValues)
+	return ok
+}
 
-	if withTLS {
-		tlsStr = "https://"
-	}
+//request requests the given endpoint, returning the json response, if any, and how long it may be cached.
+func (o HTTP) request(endpoint *httpEndpoint, username string, data httpTemplateData, dataMap map[string]interface{}, urlValues url.Values) (HTTPResponse, time.Duration, bool) {
 
-	fullUri := fmt.Sprintf("%s%s%s", tlsStr, host, uri)
-	if port != "" {
-		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, host, port, uri)
-	}
+	response := HTTPResponse{Ok: false, Error: ""}
 
-	client := &h.Client{Timeout: 5 * time.Second}
+	req, reqErr := o.newRequest(endpoint, data, dataMap, urlValues)
 
-	if !verifyPeer {
-		tr := &h.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client.Transport = tr
+	if reqErr != nil {
+		log.Errorf("req error: %v\n", reqErr)
+		return response, 0, false
 	}
 
-	var resp *h.Response
-	var err error
-
-	if paramsMode == "form" {
-		resp, err = client.PostForm(fullUri, urlValues)
-	} else {
-		dataJson, mErr := json.Marshal(dataMap)
-
-		if mErr != nil {
-			log.Errorf("marshal error: %v\n", mErr)
-			return false
-		}
-
-		contentReader := bytes.NewReader(dataJson)
-		req, reqErr := h.NewRequest("POST", fullUri, contentReader)
-
-		if reqErr != nil {
-			log.Errorf("req error: %v\n", reqErr)
-			return false
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err = client.Do(req)
-	}
+	resp, err := o.client.Do(req)
 
 	if err != nil {
-		log.Errorf("POST error: %v\n", err)
-		return false
+		log.Errorf("%s error: %v\n", endpoint.Method, err)
+		return response, 0, false
 	}
 
 	body, bErr := ioutil.ReadAll(resp.Body)
@@ -228,42 +263,41 @@ func httpRequest(host, uri, username string, withTLS, verifyPeer bool, dataMap m
 
 	if bErr != nil {
 		log.Errorf("read error: %v\n", bErr)
-		return false
+		return response, 0, false
 	}
 
 	if resp.StatusCode != 200 {
 		log.Infof("Wrong http status: %v\n", resp.StatusCode)
-		return false
+		return response, 0, false
 	}
 
-	if responseMode == "text" {
+	if o.ResponseMode == "text" {
 
 		//For test response, we expect "ok" or an error message.
 		if string(body) != "ok" {
 			log.Warnf("api error: %s\n", string(body))
-			return false
+			return response, 0, false
 		}
 
-	} else if responseMode == "json" {
+	} else if o.ResponseMode == "json" {
 
 		//For json response, we expect Ok and Error fields.
-		response := HTTPResponse{Ok: false, Error: ""}
 		jErr := json.Unmarshal(body, &response)
 
 		if jErr != nil {
 			log.Warnf("unmarshal error: %v\n", jErr)
-			return false
+			return response, 0, false
 		}
 
 		if !response.Ok {
 			log.Warnf("api error: %s\n", response.Error)
-			return false
+			return response, 0, false
 		}
 
 	}
 
 	log.Debugf("http request approved for %s\n", username)
-	return true
+	return response, httpCacheTTL(response, resp.Header), true
 
 }
 
@@ -272,9 +306,20 @@ func (o HTTP) GetName() string {
 	return "HTTP"
 }
 
-//Halt does nothing for http as there's no cleanup needed.
+//Halt closes the client's idle connections.
 func (o HTTP) Halt() {
-	//Do nothing
+	if o.client != nil {
+		o.client.CloseIdleConnections()
+	}
 }
 
-func (o HTTP) Reload() {}
+//Reload builds the client again, reading the CA bundle and client certificate, and forgets cached users.
+func (o HTTP) Reload() {
+	o.users.clear()
+
+	if o.client != nil {
+		if err := o.client.Reload(); err != nil {
+			log.Errorf("http client reload error, keeping previous client: %s", err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// +build http
+
+package backends
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newBenchmarkHTTP(b *testing.B) (HTTP, func()) {
+	mockServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var authOpts = map[string]string{
+		"http_host":          strings.Replace(mockServer.URL, "https://", "", -1),
+		"http_port":          "",
+		"http_getuser_uri":   "/user",
+		"http_superuser_uri": "/superuser",
+		"http_aclcheck_uri":  "/acl",
+		"http_with_tls":      "true",
+	}
+
+	hb, err := NewHTTP(authOpts, log.ErrorLevel)
+	if err != nil {
+		b.Fatalf("HTTP error: %s", err)
+	}
+
+	return hb.(HTTP), mockServer.Close
+}
+
+//BenchmarkHTTPAcl checks acls with the backend's pooled client, reusing its connection and TLS session.
+func BenchmarkHTTPAcl(b *testing.B) {
+	hb, closeServer := newBenchmarkHTTP(b)
+	defer closeServer()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hb.CheckAcl("test", "test/topic/1", "test_client", MOSQ_ACL_READ)
+	}
+}
+
+//BenchmarkHTTPAclNewClient checks acls with a new client per request, as the backend used to, for comparison.
+func BenchmarkHTTPAclNewClient(b *testing.B) {
+	hb, closeServer := newBenchmarkHTTP(b)
+	defer closeServer()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hb.client, _ = newHTTPClient(map[string]string{}, "http", false)
+		hb.CheckAcl("test", "test/topic/1", "test_client", MOSQ_ACL_READ)
+		hb.client.CloseIdleConnections()
+	}
+}
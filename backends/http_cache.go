@@ -0,0 +1,142 @@
+// +build http
+
+package backends
+
+import (
+	h "net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//HTTPAcls holds the topic filters a user is allowed, by access type, as the user endpoint may return them.
+type HTTPAcls struct {
+	Read      []string `json:"read"`
+	Write     []string `json:"write"`
+	Readwrite []string `json:"readwrite"`
+	Subscribe []string `json:"subscribe"`
+}
+
+//allows checks a topic against the filters, replacing %u and %c in them. Read filters allow subscribing too, and read-write
+//checks are allowed by read-write filters or by both read and write ones.
+func (a *HTTPAcls) allows(username, topic, clientid string, acc int32) bool {
+	read := func() bool {
+		return claimsTopicMatches(a.Read, username, topic, clientid, acc) || claimsTopicMatches(a.Readwrite, username, topic, clientid, acc)
+	}
+	write := func() bool {
+		return claimsTopicMatches(a.Write, username, topic, clientid, acc) || claimsTopicMatches(a.Readwrite, username, topic, clientid, acc)
+	}
+
+	switch acc {
+	case MOSQ_ACL_READ:
+		return read()
+	case MOSQ_ACL_WRITE:
+		return write()
+	case MOSQ_ACL_SUBSCRIBE:
+		return claimsTopicMatches(a.Subscribe, username, topic, clientid, acc) || read()
+	case MOSQ_ACL_READWRITE:
+		return claimsTopicMatches(a.Readwrite, username, topic, clientid, acc) ||
+			(claimsTopicMatches(a.Read, username, topic, clientid, MOSQ_ACL_READ) && claimsTopicMatches(a.Write, username, topic, clientid, MOSQ_ACL_WRITE))
+	}
+	return false
+}
+
+//httpCachedUser is what the user endpoint returned for a user, answering superuser and acl checks until it expires.
+type httpCachedUser struct {
+	superuser *bool
+	acls      *HTTPAcls
+	expires   time.Time
+}
+
+//httpUserCache keeps users by username.
+type httpUserCache struct {
+	sync.Mutex
+	users     map[string]httpCachedUser
+	sweepSize int
+}
+
+func newHTTPUserCache() *httpUserCache {
+	return &httpUserCache{
+		users:     make(map[string]httpCachedUser),
+		sweepSize: 1024,
+	}
+}
+
+//set caches a user for ttl, replacing what was cached. Users without a superuser flag or acls are only forgotten,
+//as there's nothing to answer checks with.
+func (c *httpUserCache) set(username string, user httpCachedUser, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+
+	if ttl <= 0 || (user.superuser == nil && user.acls == nil) {
+		delete(c.users, username)
+		return
+	}
+
+	user.expires = now.Add(ttl)
+	c.users[username] = user
+
+	//Expired users are swept whenever the cache doubles, so sweeping takes constant time per user on average.
+	if len(c.users) >= c.sweepSize {
+		for cachedUsername, cached := range c.users {
+			if !now.Before(cached.expires) {
+				delete(c.users, cachedUsername)
+			}
+		}
+		c.sweepSize = 2 * len(c.users)
+		if c.sweepSize < 1024 {
+			c.sweepSize = 1024
+		}
+	}
+}
+
+//get returns the user cached for username, if it hasn't expired.
+func (c *httpUserCache) get(username string) (httpCachedUser, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	user, ok := c.users[username]
+	if !ok {
+		return user, false
+	}
+	if !time.Now().Before(user.expires) {
+		delete(c.users, username)
+		return user, false
+	}
+	return user, true
+}
+
+//clear forgets every user.
+func (c *httpUserCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.users = make(map[string]httpCachedUser)
+	c.sweepSize = 1024
+}
+
+//httpCacheTTL returns how long a response may be cached: its cache_ttl if given, else the max-age of its Cache-Control header,
+//unless the header forbids caching. Responses without either are not cached.
+func httpCacheTTL(response HTTPResponse, header h.Header) time.Duration {
+	if response.CacheTTL != nil {
+		return time.Duration(*response.CacheTTL) * time.Second
+	}
+
+	var ttl time.Duration
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil && seconds > 0 {
+				ttl = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,174 @@
+package backends
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	h "net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//httpClient is the client a backend reuses for every request to its API, so connections and TLS sessions are kept alive
+//between checks. It's rebuilt on reload, so a renewed CA bundle or client certificate is picked up.
+type httpClient struct {
+	sync.RWMutex
+	client *h.Client
+
+	prefix     string
+	authOpts   map[string]string
+	verifyPeer bool
+}
+
+//newHTTPClient reads the client's options, prefixed with the backend's options prefix. Timeouts are read in seconds from
+//<prefix>_timeout, bounding the whole request (5 by default), and from <prefix>_dial_timeout, <prefix>_tls_handshake_timeout
+//and <prefix>_response_header_timeout, which are only bounded by the former when not given. <prefix>_max_idle_conns sets how
+//many idle connections are kept (100 by default, 0 closes them after each request). When verifying peers, <prefix>_ca_file
+//replaces the system roots, and <prefix>_client_cert and <prefix>_client_key are presented to the API.
+func newHTTPClient(authOpts map[string]string, prefix string, verifyPeer bool) (*httpClient, error) {
+	c := &httpClient{
+		prefix:     prefix,
+		authOpts:   authOpts,
+		verifyPeer: verifyPeer,
+	}
+
+	client, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+
+	return c, nil
+}
+
+func (c *httpClient) build() (*h.Client, error) {
+	timeouts := map[string]time.Duration{
+		"timeout":                 5 * time.Second,
+		"dial_timeout":            0,
+		"tls_handshake_timeout":   0,
+		"response_header_timeout": 0,
+	}
+
+	for name := range timeouts {
+		opt := c.prefix + "_" + name
+		s, ok := c.authOpts[opt]
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			return nil, errors.Errorf("invalid %s %s", opt, s)
+		}
+		timeouts[name] = time.Duration(seconds) * time.Second
+	}
+
+	maxIdle := 100
+	if s, ok := c.authOpts[c.prefix+"_max_idle_conns"]; ok {
+		var err error
+		if maxIdle, err = strconv.Atoi(s); err != nil || maxIdle < 0 {
+			return nil, errors.Errorf("invalid %s_max_idle_conns %s", c.prefix, s)
+		}
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &h.Transport{
+		Proxy: h.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts["dial_timeout"],
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   timeouts["tls_handshake_timeout"],
+		ResponseHeaderTimeout: timeouts["response_header_timeout"],
+		//Every request goes to the same host, so it may keep all idle connections.
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if maxIdle == 0 {
+		transport.DisableKeepAlives = true
+	}
+
+	return &h.Client{Timeout: timeouts["timeout"], Transport: transport}, nil
+}
+
+//tlsConfig loads the CA bundle and client certificate, if given. A CA bundle is only used to verify peers, so it's an error
+//to give one without verifying them.
+func (c *httpClient) tlsConfig() (*tls.Config, error) {
+	caFile := c.authOpts[c.prefix+"_ca_file"]
+	certFile := c.authOpts[c.prefix+"_client_cert"]
+	keyFile := c.authOpts[c.prefix+"_client_key"]
+
+	config := &tls.Config{InsecureSkipVerify: !c.verifyPeer}
+
+	if caFile != "" {
+		if !c.verifyPeer {
+			return nil, errors.Errorf("%s_ca_file needs %s_verify_peer", c.prefix, c.prefix)
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read %s_ca_file", c.prefix)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s_ca_file", c.prefix)
+		}
+		config.RootCAs = pool
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.Errorf("%s_client_cert and %s_client_key must be given together", c.prefix, c.prefix)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't load %s_client_cert", c.prefix)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+//Do sends a request with the current client.
+func (c *httpClient) Do(req *h.Request) (*h.Response, error) {
+	c.RLock()
+	client := c.client
+	c.RUnlock()
+
+	return client.Do(req)
+}
+
+//Reload builds the client again, reading the CA bundle and client certificate, and closes the previous client's idle connections.
+//Should that fail, the previous client is kept.
+func (c *httpClient) Reload() error {
+	client, err := c.build()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	previous := c.client
+	c.client = client
+	c.Unlock()
+
+	previous.CloseIdleConnections()
+	return nil
+}
+
+//CloseIdleConnections closes the current client's idle connections.
+func (c *httpClient) CloseIdleConnections() {
+	c.RLock()
+	defer c.RUnlock()
+
+	c.client.CloseIdleConnections()
+}
@@ -0,0 +1,199 @@
+// +build http
+
+package backends
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	h "net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+//httpEndpoint is one of the API's URIs, along with the method and templates used to request it.
+type httpEndpoint struct {
+	Method    string
+	uri       *template.Template
+	body      *template.Template
+	templated bool
+}
+
+//httpTemplateData holds the fields of a check, which URI and body templates may use.
+type httpTemplateData struct {
+	Username string
+	Password string
+	ClientId string
+	Topic    string
+	Acc      int32
+}
+
+var httpMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+
+//httpBodylessMethods are sent without a body, so params go in the query instead.
+var httpBodylessMethods = map[string]bool{"GET": true, "HEAD": true, "DELETE": true}
+
+var httpTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+//newHTTPEndpoint reads http_<name>_method (POST by default) and http_<name>_body, and parses the URI as a template.
+//Requests with a templated URI or body are sent as their templates give them, without adding params.
+func newHTTPEndpoint(authOpts map[string]string, name, uri string) (*httpEndpoint, error) {
+	endpoint := &httpEndpoint{Method: "POST"}
+
+	if method, ok := authOpts["http_"+name+"_method"]; ok {
+		method = strings.ToUpper(method)
+		if !httpMethods[method] {
+			return nil, errors.Errorf("unknown http_%s_method %s", name, method)
+		}
+		endpoint.Method = method
+	}
+
+	var err error
+	endpoint.uri, err = template.New("http_" + name + "_uri").Funcs(httpTemplateFuncs).Parse(uri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid http_%s_uri", name)
+	}
+	endpoint.templated = strings.Contains(uri, "{{")
+
+	if body, ok := authOpts["http_"+name+"_body"]; ok {
+		endpoint.body, err = template.New("http_" + name + "_body").Funcs(httpTemplateFuncs).Parse(body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid http_%s_body", name)
+		}
+		endpoint.templated = true
+	}
+
+	return endpoint, nil
+}
+
+//newHTTPHeaders reads the static headers sent with every request: those given as http_header_<name>, the API key header
+//given by http_api_key and http_api_key_header, and either a bearer token or basic auth credentials.
+func newHTTPHeaders(authOpts map[string]string) (h.Header, error) {
+	headers := make(h.Header)
+
+	for opt, value := range authOpts {
+		if name := strings.TrimPrefix(opt, "http_header_"); name != opt && name != "" {
+			headers.Set(name, value)
+		}
+	}
+
+	if apiKey, ok := authOpts["http_api_key"]; ok {
+		header := "X-Api-Key"
+		if name, ok := authOpts["http_api_key_header"]; ok && name != "" {
+			header = name
+		}
+		headers.Set(header, apiKey)
+	}
+
+	bearer, withBearer := authOpts["http_bearer_token"]
+	basicUser, withBasic := authOpts["http_basic_username"]
+	basicPassword, withBasicPassword := authOpts["http_basic_password"]
+
+	if withBasicPassword && !withBasic {
+		return nil, errors.New("http_basic_password needs http_basic_username")
+	}
+	if withBearer && withBasic {
+		return nil, errors.New("only one of http_bearer_token and http_basic_username may be given")
+	}
+
+	if withBearer {
+		headers.Set("Authorization", "Bearer "+bearer)
+	}
+	if withBasic {
+		credentials := base64.StdEncoding.EncodeToString([]byte(basicUser + ":" + basicPassword))
+		headers.Set("Authorization", "Basic "+credentials)
+	}
+
+	return headers, nil
+}
+
+//newRequest builds the request to an endpoint. Fields are escaped in URIs, so they can't change the URI's structure, but not in
+//bodies, where the json or urlquery functions may be used. Untemplated requests send the params in their body, as given by the
+//params mode, or in the query for methods without a body.
+func (o HTTP) newRequest(endpoint *httpEndpoint, data httpTemplateData, dataMap map[string]interface{}, urlValues url.Values) (*h.Request, error) {
+	escaped := data
+	escaped.Username = escapeURIField(data.Username)
+	escaped.Password = escapeURIField(data.Password)
+	escaped.ClientId = escapeURIField(data.ClientId)
+	escaped.Topic = escapeURIField(data.Topic)
+
+	var uri bytes.Buffer
+	if err := endpoint.uri.Execute(&uri, escaped); err != nil {
+		return nil, errors.Wrap(err, "uri template error")
+	}
+
+	tlsStr := "http://"
+
+	if o.WithTLS {
+		tlsStr = "https://"
+	}
+
+	fullUri := fmt.Sprintf("%s%s%s", tlsStr, o.Host, uri.String())
+	if o.Port != "" {
+		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, o.Host, o.Port, uri.String())
+	}
+
+	contentType := "application/json"
+	if o.ParamsMode == "form" {
+		contentType = "application/x-www-form-urlencoded"
+	}
+
+	var body io.Reader
+
+	switch {
+	case endpoint.body != nil:
+		var buf bytes.Buffer
+		if err := endpoint.body.Execute(&buf, data); err != nil {
+			return nil, errors.Wrap(err, "body template error")
+		}
+		body = &buf
+	case endpoint.templated:
+		contentType = ""
+	case httpBodylessMethods[endpoint.Method]:
+		separator := "?"
+		if strings.Contains(fullUri, "?") {
+			separator = "&"
+		}
+		fullUri += separator + urlValues.Encode()
+		contentType = ""
+	case o.ParamsMode == "form":
+		body = strings.NewReader(urlValues.Encode())
+	default:
+		dataJson, err := json.Marshal(dataMap)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal error")
+		}
+		body = bytes.NewReader(dataJson)
+	}
+
+	req, err := h.NewRequest(endpoint.Method, fullUri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	//Static headers come last, so they may replace the content type.
+	for name, values := range o.headers {
+		req.Header[name] = values
+	}
+
+	return req, nil
+}
+
+//escapeURIField escapes a field so it may be used anywhere in a URI, escaping spaces as %20 as paths need.
+func escapeURIField(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
@@ -5,11 +5,16 @@ package backends
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -811,3 +816,497 @@ func TestHTTPFormTextResponseServer(t *testing.T) {
 	})
 
 }
+
+func TestHTTPClient(t *testing.T) {
+
+	var conns int32
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(2 * time.Second)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	mockServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	mockServer.StartTLS()
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "https://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_with_tls"] = "true"
+
+	Convey("Given invalid timeouts or max idle connections, the backend should fail", t, func() {
+		for _, opt := range []string{"http_timeout", "http_dial_timeout", "http_tls_handshake_timeout", "http_response_header_timeout", "http_max_idle_conns"} {
+			badOpts := make(map[string]string)
+			for k, v := range authOpts {
+				badOpts[k] = v
+			}
+			badOpts[opt] = "-1"
+			_, err := NewHTTP(badOpts, log.DebugLevel)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given correct options, requests should reuse connections", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		atomic.StoreInt32(&conns, 0)
+		for i := 0; i < 10; i++ {
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+			So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeTrue)
+		}
+		So(atomic.LoadInt32(&conns), ShouldEqual, 1)
+
+		hb.Halt()
+	})
+
+	Convey("Given no idle connections, requests should not reuse connections", t, func() {
+		noIdleOpts := make(map[string]string)
+		for k, v := range authOpts {
+			noIdleOpts[k] = v
+		}
+		noIdleOpts["http_max_idle_conns"] = "0"
+
+		hb, err := NewHTTP(noIdleOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		atomic.StoreInt32(&conns, 0)
+		for i := 0; i < 3; i++ {
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		}
+		So(atomic.LoadInt32(&conns), ShouldEqual, 3)
+	})
+
+	Convey("Given a response header timeout, slow responses should fail", t, func() {
+		slowOpts := make(map[string]string)
+		for k, v := range authOpts {
+			slowOpts[k] = v
+		}
+		slowOpts["http_getuser_uri"] = "/slow"
+		slowOpts["http_response_header_timeout"] = "1"
+
+		hb, err := NewHTTP(slowOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+	})
+}
+
+func TestHTTPMutualTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "http_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	_, certFile, keyFile := ca.issue("client")
+
+	otherCA := newTestCA(t, dir, "other_ca")
+	_, otherCertFile, otherKeyFile := otherCA.issue("other_client")
+
+	mockServer := newMutualTLSServer(ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "https://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_with_tls"] = "true"
+	authOpts["http_verify_peer"] = "true"
+	authOpts["http_ca_file"] = ca.file
+	authOpts["http_client_cert"] = certFile
+	authOpts["http_client_key"] = keyFile
+
+	withOpts := func(opts map[string]string) map[string]string {
+		merged := make(map[string]string)
+		for k, v := range authOpts {
+			merged[k] = v
+		}
+		for k, v := range opts {
+			if v == "" {
+				delete(merged, k)
+			} else {
+				merged[k] = v
+			}
+		}
+		return merged
+	}
+
+	Convey("Given a CA bundle without verifying peers, the backend should fail", t, func() {
+		_, err := NewHTTP(withOpts(map[string]string{"http_verify_peer": ""}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a client certificate without its key, the backend should fail", t, func() {
+		_, err := NewHTTP(withOpts(map[string]string{"http_client_key": ""}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a missing CA bundle, the backend should fail", t, func() {
+		_, err := NewHTTP(withOpts(map[string]string{"http_ca_file": filepath.Join(dir, "missing.pem")}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given the system roots, the server should not be trusted", t, func() {
+		hb, err := NewHTTP(withOpts(map[string]string{"http_ca_file": ""}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+	})
+
+	Convey("Given no client certificate, the server should reject the client", t, func() {
+		hb, err := NewHTTP(withOpts(map[string]string{"http_client_cert": "", "http_client_key": ""}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+	})
+
+	Convey("Given the CA bundle and client certificate, requests should succeed", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		So(hb.GetSuperuser("test_user"), ShouldBeTrue)
+		So(hb.CheckAcl("test_user", "test/topic", "test_client", 1), ShouldBeTrue)
+		hb.Halt()
+	})
+
+	Convey("Given a renewed client certificate, reload should pick it up", t, func() {
+		reloadCert := filepath.Join(dir, "reload.pem")
+		reloadKey := filepath.Join(dir, "reload.key")
+		copyFile := func(from, to string) {
+			data, err := ioutil.ReadFile(from)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(to, data, 0600), ShouldBeNil)
+		}
+		copyFile(certFile, reloadCert)
+		copyFile(keyFile, reloadKey)
+
+		hb, err := NewHTTP(withOpts(map[string]string{"http_client_cert": reloadCert, "http_client_key": reloadKey}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+
+		copyFile(otherCertFile, reloadCert)
+		copyFile(otherKeyFile, reloadKey)
+		hb.Reload()
+		So(hb.GetUser("test_user", "test_password"), ShouldBeFalse)
+
+		Convey("And keep the previous client when it can't be loaded", func() {
+			copyFile(certFile, reloadCert)
+			copyFile(keyFile, reloadKey)
+			hb.Reload()
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+
+			So(ioutil.WriteFile(reloadKey, []byte("not a key"), 0600), ShouldBeNil)
+			hb.Reload()
+			So(hb.GetUser("test_user", "test_password"), ShouldBeTrue)
+		})
+	})
+}
+
+func TestHTTPTemplates(t *testing.T) {
+
+	username := "test user/1"
+	password := "test_password"
+	topic := "test/topic"
+	clientId := "test_client"
+	apiKey := "test_api_key"
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get("X-Api-Key") != apiKey && r.Header.Get("Authorization") != "Bearer test_token" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "broker" || pass != "broker_password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		query := r.URL.Query()
+		body, _ := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		ok := false
+
+		switch r.Method + " " + r.URL.EscapedPath() {
+		case "PUT /v1/login":
+			var params map[string]interface{}
+			json.Unmarshal(body, &params)
+			ok = r.Header.Get("Content-Type") == "application/json" && params["login"] == username && params["secret"] == password
+		case "GET /v1/devices/test%20user%2F1/superuser":
+			ok = len(body) == 0 && len(query) == 0 && r.Header.Get("X-Tenant") == "acme"
+		case "GET /v1/devices/test%20user%2F1/acl":
+			ok = len(body) == 0 && query.Get("topic") == topic && query.Get("acc") == "1" && query.Get("username") == ""
+		case "GET /superuser":
+			ok = len(body) == 0 && query.Get("username") == username
+		case "DELETE /acl":
+			ok = len(body) == 0 && query.Get("username") == username && query.Get("topic") == topic && query.Get("clientid") == clientId && query.Get("acc") == "1"
+		}
+
+		if ok {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/v1/login"
+	authOpts["http_getuser_method"] = "put"
+	authOpts["http_getuser_body"] = `{"login": {{json .Username}}, "secret": {{json .Password}}}`
+	authOpts["http_superuser_uri"] = "/v1/devices/{{.Username}}/superuser"
+	authOpts["http_superuser_method"] = "GET"
+	authOpts["http_aclcheck_uri"] = "/v1/devices/{{.Username}}/acl?topic={{.Topic}}&acc={{.Acc}}"
+	authOpts["http_aclcheck_method"] = "GET"
+	authOpts["http_api_key"] = apiKey
+	authOpts["http_header_X-Tenant"] = "acme"
+
+	withOpts := func(opts map[string]string) map[string]string {
+		merged := make(map[string]string)
+		for k, v := range authOpts {
+			merged[k] = v
+		}
+		for k, v := range opts {
+			if v == "" {
+				delete(merged, k)
+			} else {
+				merged[k] = v
+			}
+		}
+		return merged
+	}
+
+	Convey("Given invalid methods, templates or auth options, the backend should fail", t, func() {
+		_, err := NewHTTP(withOpts(map[string]string{"http_aclcheck_method": "CONNECT"}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewHTTP(withOpts(map[string]string{"http_aclcheck_uri": "/acl/{{.Username"}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewHTTP(withOpts(map[string]string{"http_getuser_body": "{{json .Username}"}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewHTTP(withOpts(map[string]string{"http_bearer_token": "test_token", "http_basic_username": "broker"}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewHTTP(withOpts(map[string]string{"http_basic_password": "broker_password"}), log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given templates, requests should be sent as they give them", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser(username, password), ShouldBeTrue)
+		So(hb.GetUser(username, "wrong_password"), ShouldBeFalse)
+		So(hb.GetSuperuser(username), ShouldBeTrue)
+		So(hb.GetSuperuser("test user"), ShouldBeFalse)
+		So(hb.CheckAcl(username, topic, clientId, 1), ShouldBeTrue)
+		So(hb.CheckAcl(username, topic, clientId, 2), ShouldBeFalse)
+
+		Convey("Fields should be escaped in URIs", func() {
+			So(hb.CheckAcl(username, "test/topic&acc=1", clientId, 2), ShouldBeFalse)
+			So(hb.GetSuperuser("test user/1/superuser?x="), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given methods without a body and no templates, params should be sent in the query", t, func() {
+		hb, err := NewHTTP(withOpts(map[string]string{
+			"http_superuser_uri":   "/superuser",
+			"http_aclcheck_uri":    "/acl",
+			"http_aclcheck_method": "DELETE",
+		}), log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetSuperuser(username), ShouldBeTrue)
+		So(hb.CheckAcl(username, topic, clientId, 1), ShouldBeTrue)
+		So(hb.CheckAcl(username, topic, "other_client", 1), ShouldBeFalse)
+	})
+
+	Convey("Given a bearer token or basic auth, requests should be authorized with them", t, func() {
+		hb, err := NewHTTP(withOpts(map[string]string{"http_api_key": "", "http_bearer_token": "test_token"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser(username, password), ShouldBeTrue)
+
+		hb, err = NewHTTP(withOpts(map[string]string{"http_api_key": "", "http_basic_username": "broker", "http_basic_password": "broker_password"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser(username, password), ShouldBeTrue)
+
+		hb, err = NewHTTP(withOpts(map[string]string{"http_api_key": "", "http_basic_username": "broker", "http_basic_password": "wrong"}), log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser(username, password), ShouldBeFalse)
+	})
+}
+
+func TestHTTPRichResponses(t *testing.T) {
+
+	var requests int32
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		var params map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		json.Unmarshal(body, &params)
+
+		username, _ := params["username"].(string)
+		response := map[string]interface{}{"ok": true}
+
+		switch r.URL.Path {
+		case "/user":
+			switch username {
+			case "cached_user":
+				response["superuser"] = false
+				response["acls"] = map[string]interface{}{
+					"read":      []string{"read/#"},
+					"write":     []string{"devices/%u/%c/#"},
+					"readwrite": []string{"shared/+"},
+					"subscribe": []string{"events/#"},
+				}
+				response["cache_ttl"] = 60
+			case "admin":
+				response["superuser"] = true
+				w.Header().Set("Cache-Control", "private, max-age=60")
+			case "no_store_user":
+				response["acls"] = map[string]interface{}{"read": []string{"#"}}
+				w.Header().Set("Cache-Control", "no-store")
+			case "uncached_user":
+				response["acls"] = map[string]interface{}{"read": []string{"#"}}
+			case "short_user":
+				response["acls"] = map[string]interface{}{"read": []string{"#"}}
+				response["cache_ttl"] = 1
+			}
+		case "/superuser":
+			response["ok"] = username == "remote_admin"
+		case "/acl":
+			response["ok"] = params["topic"] == "remote/topic"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given a user response with acls and a cache ttl, checks should be answered locally", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("cached_user", "password"), ShouldBeTrue)
+
+		atomic.StoreInt32(&requests, 0)
+
+		So(hb.GetSuperuser("cached_user"), ShouldBeFalse)
+		So(hb.CheckAcl("cached_user", "read/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(hb.CheckAcl("cached_user", "read/#", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+		So(hb.CheckAcl("cached_user", "read/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(hb.CheckAcl("cached_user", "devices/cached_user/client/data", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(hb.CheckAcl("cached_user", "devices/cached_user/other/data", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(hb.CheckAcl("cached_user", "devices/cached_user/client/data", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(hb.CheckAcl("cached_user", "shared/topic", "client", MOSQ_ACL_READWRITE), ShouldBeTrue)
+		So(hb.CheckAcl("cached_user", "shared/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(hb.CheckAcl("cached_user", "read/topic", "client", MOSQ_ACL_READWRITE), ShouldBeFalse)
+		So(hb.CheckAcl("cached_user", "events/+/created", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+		So(hb.CheckAcl("cached_user", "events/created", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(hb.CheckAcl("cached_user", "remote/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+
+		So(atomic.LoadInt32(&requests), ShouldEqual, 0)
+
+		Convey("Until the backend is reloaded", func() {
+			hb.Reload()
+			So(hb.CheckAcl("cached_user", "remote/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given a superuser flag and a max-age, superuser checks should be answered locally", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("admin", "password"), ShouldBeTrue)
+
+		atomic.StoreInt32(&requests, 0)
+		So(hb.GetSuperuser("admin"), ShouldBeTrue)
+		So(atomic.LoadInt32(&requests), ShouldEqual, 0)
+
+		//There are no cached acls, so the API is asked.
+		So(hb.CheckAcl("admin", "remote/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+	})
+
+	Convey("Given responses without a cache ttl or forbidding caching, checks should be sent to the API", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("no_store_user", "password"), ShouldBeTrue)
+		So(hb.GetUser("uncached_user", "password"), ShouldBeTrue)
+
+		atomic.StoreInt32(&requests, 0)
+		So(hb.CheckAcl("no_store_user", "other/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(hb.CheckAcl("uncached_user", "other/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(hb.GetSuperuser("uncached_user"), ShouldBeFalse)
+		So(atomic.LoadInt32(&requests), ShouldEqual, 3)
+	})
+
+	Convey("Given an expired cache ttl, checks should be sent to the API", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("short_user", "password"), ShouldBeTrue)
+		So(hb.CheckAcl("short_user", "other/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+
+		time.Sleep(1100 * time.Millisecond)
+		So(hb.CheckAcl("short_user", "other/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+	})
+
+	Convey("Cache ttls should be read from the response, else from Cache-Control", t, func() {
+		ttl := 30
+		header := make(http.Header)
+		header.Set("Cache-Control", "public, max-age=120")
+
+		So(httpCacheTTL(HTTPResponse{CacheTTL: &ttl}, header), ShouldEqual, 30*time.Second)
+		So(httpCacheTTL(HTTPResponse{}, header), ShouldEqual, 120*time.Second)
+
+		header.Set("Cache-Control", "max-age=120, no-cache")
+		So(httpCacheTTL(HTTPResponse{}, header), ShouldEqual, 0)
+
+		header.Set("Cache-Control", "max-age=abc")
+		So(httpCacheTTL(HTTPResponse{}, header), ShouldEqual, 0)
+
+		So(httpCacheTTL(HTTPResponse{}, make(http.Header)), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,426 @@
+// +build introspection
+
+package backends
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	h "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisteredBackends["introspection"] = NewIntrospection
+}
+
+//Introspection authenticates opaque OAuth2 access tokens by asking the authorization server about them, as defined in RFC 7662.
+//Active tokens are authenticated, and their scopes or claims give the topics they may publish and subscribe to.
+type Introspection struct {
+	Url            string
+	ClientId       string
+	ClientSecret   string
+	TokenSource    string
+	UserField      string
+	PubScopePrefix string
+	SubScopePrefix string
+	SuperuserScope string
+	PubClaim       string
+	SubClaim       string
+	CacheTTL       time.Duration
+	VerifyPeer     bool
+
+	client  *httpClient
+	cache   *introspectionCache
+	clients *clientStore
+}
+
+//introspectionResult is what the server told about a token, kept until it expires.
+type introspectionResult struct {
+	active  bool
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+//introspectionCache keeps results by the hash of their token, so tokens themselves are not kept around.
+type introspectionCache struct {
+	sync.Mutex
+	results   map[string]introspectionResult
+	sweepSize int
+}
+
+func NewIntrospection(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+
+	log.SetLevel(logLevel)
+
+	//Initialize with defaults
+	var introspection = Introspection{
+		TokenSource:    "username",
+		UserField:      "sub",
+		PubScopePrefix: "mqtt:pub:",
+		SubScopePrefix: "mqtt:sub:",
+		CacheTTL:       5 * time.Minute,
+		VerifyPeer:     true,
+		cache: &introspectionCache{
+			results:   make(map[string]introspectionResult),
+			sweepSize: 1024,
+		},
+	}
+
+	if introspectionUrl, ok := authOpts["introspection_url"]; ok {
+		introspection.Url = introspectionUrl
+	} else {
+		return introspection, errors.New("Introspection backend error: missing introspection_url.\n")
+	}
+
+	introspection.ClientId = authOpts["introspection_client_id"]
+	introspection.ClientSecret = authOpts["introspection_client_secret"]
+	if (introspection.ClientId == "") != (introspection.ClientSecret == "") {
+		return introspection, errors.New("Introspection backend error: introspection_client_id and introspection_client_secret must be given together.\n")
+	}
+
+	if tokenSource, ok := authOpts["introspection_token_source"]; ok {
+		if tokenSource != "username" && tokenSource != "password" {
+			return introspection, errors.Errorf("Introspection backend error: unknown introspection_token_source %s.\n", tokenSource)
+		}
+		introspection.TokenSource = tokenSource
+	}
+
+	if userField, ok := authOpts["introspection_userfield"]; ok && userField != "" {
+		introspection.UserField = userField
+	}
+
+	if prefix, ok := authOpts["introspection_pub_scope_prefix"]; ok {
+		introspection.PubScopePrefix = prefix
+	}
+
+	if prefix, ok := authOpts["introspection_sub_scope_prefix"]; ok {
+		introspection.SubScopePrefix = prefix
+	}
+
+	introspection.SuperuserScope = authOpts["introspection_superuser_scope"]
+	introspection.PubClaim = authOpts["introspection_pub_claim"]
+	introspection.SubClaim = authOpts["introspection_sub_claim"]
+
+	if ttl, ok := authOpts["introspection_cache_ttl"]; ok {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil || seconds < 0 {
+			return introspection, errors.Errorf("Introspection backend error: invalid introspection_cache_ttl %s.\n", ttl)
+		}
+		introspection.CacheTTL = time.Duration(seconds) * time.Second
+	}
+
+	if verifyPeer, ok := authOpts["introspection_verify_peer"]; ok && verifyPeer == "false" {
+		introspection.VerifyPeer = false
+	}
+
+	client, err := newHTTPClient(authOpts, "introspection", introspection.VerifyPeer)
+	if err != nil {
+		return introspection, errors.Errorf("Introspection backend error: %s.\n", err)
+	}
+	introspection.client = client
+
+	if introspection.TokenSource == "password" {
+		idle := 24 * time.Hour
+		if idleStr, ok := authOpts["introspection_client_idle"]; ok {
+			seconds, err := strconv.Atoi(idleStr)
+			if err != nil || seconds < 0 {
+				return introspection, errors.Errorf("Introspection backend error: invalid introspection_client_idle %s.\n", idleStr)
+			}
+			idle = time.Duration(seconds) * time.Second
+		}
+		introspection.clients = newClientStore(idle)
+	}
+
+	return introspection, nil
+}
+
+func (o Introspection) GetUser(username, password string) bool {
+	return o.GetClientUser(username, password, "")
+}
+
+//GetClientUser authenticates a client with the token given as its username or password, as long as it's active.
+//Tokens given as passwords are remembered by client id for later superuser and acl checks.
+func (o Introspection) GetClientUser(username, password, clientid string) bool {
+	token := username
+	if o.TokenSource == "password" {
+		token = password
+	}
+
+	if _, err := o.introspect(token); err != nil {
+		log.Debugf("introspection get user error: %s\n", err)
+		return false
+	}
+
+	if o.RemembersClients() {
+		o.clients.set(clientid, &rememberedClient{username: username, token: token})
+	}
+	return true
+}
+
+func (o Introspection) GetSuperuser(token string) bool {
+	//Tokens given as passwords are only known by client id.
+	if o.RemembersClients() {
+		return false
+	}
+	return o.superuser(token)
+}
+
+//GetClientSuperuser checks if the token a client authenticated with has the superuser scope.
+func (o Introspection) GetClientSuperuser(username, clientid string) bool {
+	if !o.RemembersClients() {
+		return o.GetSuperuser(username)
+	}
+
+	client, ok := o.clients.get(clientid, username)
+	if !ok {
+		log.Debugf("introspection get superuser error: unknown client %s\n", clientid)
+		return false
+	}
+	return o.superuser(client.token)
+}
+
+func (o Introspection) superuser(token string) bool {
+	if o.SuperuserScope == "" {
+		return false
+	}
+
+	claims, err := o.introspect(token)
+	if err != nil {
+		log.Debugf("introspection get superuser error: %s\n", err)
+		return false
+	}
+
+	return containsString(introspectionScopes(claims), o.SuperuserScope)
+}
+
+//CheckAcl checks a topic against the filters given by the token's scopes and claims, replacing %u and %c in them.
+//Publishing is checked against publish filters, while reading and subscribing are checked against subscribe ones.
+func (o Introspection) CheckAcl(username, topic, clientid string, acc int32) bool {
+	token := username
+	if o.RemembersClients() {
+		client, ok := o.clients.get(clientid, username)
+		if !ok {
+			log.Debugf("introspection check acl error: unknown client %s\n", clientid)
+			return false
+		}
+		token = client.token
+	}
+
+	claims, err := o.introspect(token)
+	if err != nil {
+		log.Debugf("introspection check acl error: %s\n", err)
+		return false
+	}
+
+	user, _ := lookupClaim(claims, o.UserField)
+	tokenUser, _ := user.(string)
+
+	switch acc {
+	case MOSQ_ACL_WRITE:
+		return claimsTopicMatches(o.filters(claims, o.PubScopePrefix, o.PubClaim), tokenUser, topic, clientid, acc)
+	case MOSQ_ACL_READ, MOSQ_ACL_SUBSCRIBE:
+		return claimsTopicMatches(o.filters(claims, o.SubScopePrefix, o.SubClaim), tokenUser, topic, clientid, acc)
+	case MOSQ_ACL_READWRITE:
+		return claimsTopicMatches(o.filters(claims, o.PubScopePrefix, o.PubClaim), tokenUser, topic, clientid, MOSQ_ACL_WRITE) &&
+			claimsTopicMatches(o.filters(claims, o.SubScopePrefix, o.SubClaim), tokenUser, topic, clientid, MOSQ_ACL_READ)
+	}
+	return false
+}
+
+//filters returns the topic filters in scopes with the given prefix, stripped of it, and in the given claim.
+func (o Introspection) filters(claims map[string]interface{}, prefix, claim string) []string {
+	var filters []string
+	if prefix != "" {
+		for _, scope := range introspectionScopes(claims) {
+			if strings.HasPrefix(scope, prefix) && len(scope) > len(prefix) {
+				filters = append(filters, strings.TrimPrefix(scope, prefix))
+			}
+		}
+	}
+	if claim != "" {
+		if value, ok := lookupClaim(claims, claim); ok {
+			filters = append(filters, claimToStrings(value)...)
+		}
+	}
+	return filters
+}
+
+//introspectionScopes splits the space separated scope claim.
+func introspectionScopes(claims map[string]interface{}) []string {
+	scope, _ := claims["scope"].(string)
+	return strings.Fields(scope)
+}
+
+//introspect returns the claims of an active token, asking the server unless there's a cached result.
+//Errors are not cached, so the server is asked again on the next check.
+func (o Introspection) introspect(token string) (map[string]interface{}, error) {
+	if token == "" {
+		return nil, errors.New("empty token")
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	result, ok := o.cache.get(key, now)
+	if !ok {
+		var err error
+		result, err = o.request(token, now)
+		if err != nil {
+			return nil, err
+		}
+		o.cache.set(key, result, now)
+	}
+
+	if !result.active {
+		return nil, errors.New("token not active")
+	}
+	return result.claims, nil
+}
+
+//request posts the token to the introspection endpoint. Active results are kept until the token's exp claim, up to the cache ttl,
+//while inactive ones are kept for the ttl.
+func (o Introspection) request(token string, now time.Time) (introspectionResult, error) {
+	form := url.Values{
+		"token":           []string{token},
+		"token_type_hint": []string{"access_token"},
+	}
+
+	req, err := h.NewRequest("POST", o.Url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return introspectionResult{}, errors.Wrap(err, "introspection request error")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.ClientId != "" {
+		//Client credentials are form encoded before being used for basic auth, as RFC 6749 requires.
+		req.SetBasicAuth(url.QueryEscape(o.ClientId), url.QueryEscape(o.ClientSecret))
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return introspectionResult{}, errors.Wrap(err, "introspection request error")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return introspectionResult{}, errors.Wrap(err, "introspection read error")
+	}
+
+	if resp.StatusCode != h.StatusOK {
+		return introspectionResult{}, errors.Errorf("wrong introspection status: %d", resp.StatusCode)
+	}
+
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return introspectionResult{}, errors.Wrap(err, "introspection unmarshal error")
+	}
+
+	active, _ := claims["active"].(bool)
+	result := introspectionResult{
+		active:  active,
+		claims:  claims,
+		expires: now.Add(o.CacheTTL),
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && active {
+		expires := time.Unix(int64(exp), 0)
+		if !expires.After(now) {
+			result.active = false
+		} else if expires.Before(result.expires) {
+			result.expires = expires
+		}
+	}
+
+	return result, nil
+}
+
+func (c *introspectionCache) get(key string, now time.Time) (introspectionResult, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	result, ok := c.results[key]
+	if !ok || !now.Before(result.expires) {
+		return introspectionResult{}, false
+	}
+	return result, true
+}
+
+func (c *introspectionCache) set(key string, result introspectionResult, now time.Time) {
+	if !now.Before(result.expires) {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.results[key] = result
+
+	//Expired results are swept whenever the cache doubles, so sweeping takes constant time per result on average.
+	if len(c.results) >= c.sweepSize {
+		for resultKey, cached := range c.results {
+			if !now.Before(cached.expires) {
+				delete(c.results, resultKey)
+			}
+		}
+		c.sweepSize = 2 * len(c.results)
+		if c.sweepSize < 1024 {
+			c.sweepSize = 1024
+		}
+	}
+}
+
+//RemembersClients tells if tokens are given as passwords, so they're remembered by client id.
+func (o Introspection) RemembersClients() bool {
+	return o.TokenSource == "password"
+}
+
+//BypassesAclCache is always true, as tokens may expire or be revoked before cached acl results do. The backend's own cache
+//keeps results no longer than the token's exp claim.
+func (o Introspection) BypassesAclCache() bool {
+	return true
+}
+
+//KeepClients takes over the clients remembered by a previous instance of the backend.
+func (o Introspection) KeepClients(previous Backend) {
+	if p, ok := previous.(Introspection); ok && o.clients != nil {
+		o.clients.adopt(p.clients)
+	}
+}
+
+//GetName returns the backend's name
+func (o Introspection) GetName() string {
+	return "Introspection"
+}
+
+//Halt closes the client's idle connections.
+func (o Introspection) Halt() {
+	if o.client != nil {
+		o.client.CloseIdleConnections()
+	}
+}
+
+//Reload builds the client again, reading the CA bundle and client certificate, and drops cached results,
+//so every token is introspected again.
+func (o Introspection) Reload() {
+	o.cache.Lock()
+	o.cache.results = make(map[string]introspectionResult)
+	o.cache.sweepSize = 1024
+	o.cache.Unlock()
+
+	if o.client != nil {
+		if err := o.client.Reload(); err != nil {
+			log.Errorf("introspection client reload error, keeping previous client: %s", err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// +build introspection
+
+package backends
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIntrospection(t *testing.T) {
+
+	clientId := "mqtt-broker"
+	clientSecret := "broker secret"
+	var requests int32
+
+	tokens := map[string]map[string]interface{}{
+		"user_token": {
+			"active":    true,
+			"sub":       "test_user",
+			"client_id": "test_client",
+			"scope":     "openid mqtt:pub:test/%u/# mqtt:sub:test/#",
+			"exp":       float64(time.Now().Add(time.Hour).Unix()),
+		},
+		"admin_token": {
+			"active": true,
+			"sub":    "admin",
+			"scope":  "mqtt:admin",
+		},
+		"claims_token": {
+			"active": true,
+			"sub":    "test_user",
+			"mqtt": map[string]interface{}{
+				"pub": []interface{}{"claims/%c"},
+				"sub": "claims/#",
+			},
+		},
+		"expired_token": {
+			"active": true,
+			"sub":    "test_user",
+			"scope":  "mqtt:sub:test/#",
+			"exp":    float64(time.Now().Add(-time.Minute).Unix()),
+		},
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "mqtt-broker" || pass != "broker+secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != "POST" || r.PostFormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			response = map[string]interface{}{"active": false}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["introspection_url"] = mockServer.URL
+	authOpts["introspection_client_id"] = clientId
+	authOpts["introspection_client_secret"] = clientSecret
+	authOpts["introspection_superuser_scope"] = "mqtt:admin"
+
+	Convey("Given missing or partial options, the backend should fail", t, func() {
+		_, err := NewIntrospection(map[string]string{}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewIntrospection(map[string]string{"introspection_url": mockServer.URL, "introspection_client_id": clientId}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewIntrospection(map[string]string{"introspection_url": mockServer.URL, "introspection_token_source": "header"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewIntrospection(map[string]string{"introspection_url": mockServer.URL, "introspection_timeout": "soon"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewIntrospection(map[string]string{"introspection_url": mockServer.URL, "introspection_verify_peer": "false", "introspection_ca_file": "ca.pem"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given correct options an introspection backend instance should be returned", t, func() {
+		backend, err := NewIntrospection(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		introspection := backend.(Introspection)
+
+		Convey("Peers should be verified by default and the acl cache bypassed, as tokens may expire before cached results", func() {
+			So(introspection.VerifyPeer, ShouldBeTrue)
+			So(introspection.BypassesAclCache(), ShouldBeTrue)
+		})
+
+		Convey("Active tokens should authenticate", func() {
+			So(introspection.GetUser("user_token", "password"), ShouldBeTrue)
+			So(introspection.GetUser("admin_token", ""), ShouldBeTrue)
+		})
+
+		Convey("Unknown, empty and expired tokens should not authenticate", func() {
+			So(introspection.GetUser("wrong_token", "password"), ShouldBeFalse)
+			So(introspection.GetUser("", "password"), ShouldBeFalse)
+			So(introspection.GetUser("expired_token", "password"), ShouldBeFalse)
+		})
+
+		Convey("Only tokens with the superuser scope should be superusers", func() {
+			So(introspection.GetSuperuser("admin_token"), ShouldBeTrue)
+			So(introspection.GetSuperuser("user_token"), ShouldBeFalse)
+			So(introspection.GetSuperuser("wrong_token"), ShouldBeFalse)
+		})
+
+		Convey("Scopes should give the topics each token may publish and subscribe to", func() {
+			So(introspection.CheckAcl("user_token", "test/test_user/data", "test_client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(introspection.CheckAcl("user_token", "test/other_user/data", "test_client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(introspection.CheckAcl("user_token", "test/other_user/data", "test_client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(introspection.CheckAcl("user_token", "test/#", "test_client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(introspection.CheckAcl("user_token", "#", "test_client", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+			So(introspection.CheckAcl("user_token", "test/test_user/data", "test_client", MOSQ_ACL_READWRITE), ShouldBeTrue)
+			So(introspection.CheckAcl("user_token", "test/other_user/data", "test_client", MOSQ_ACL_READWRITE), ShouldBeFalse)
+			So(introspection.CheckAcl("user_token", "openid", "test_client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(introspection.CheckAcl("admin_token", "test/topic", "test_client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(introspection.CheckAcl("wrong_token", "test/topic", "test_client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Results should be cached", func() {
+			atomic.StoreInt32(&requests, 0)
+			So(introspection.GetUser("user_token", ""), ShouldBeTrue)
+			So(introspection.CheckAcl("user_token", "test/topic", "test_client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(introspection.GetUser("wrong_token", ""), ShouldBeFalse)
+			So(introspection.GetUser("wrong_token", ""), ShouldBeFalse)
+			So(atomic.LoadInt32(&requests), ShouldBeLessThanOrEqualTo, 2)
+
+			Convey("And dropped on reload", func() {
+				atomic.StoreInt32(&requests, 0)
+				introspection.Reload()
+				So(introspection.GetUser("user_token", ""), ShouldBeTrue)
+				So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+			})
+		})
+
+		Convey("Results should not be kept past the token's expiry", func() {
+			now := time.Now()
+			result, err := introspection.request("user_token", now)
+			So(err, ShouldBeNil)
+			So(result.active, ShouldBeTrue)
+			So(result.expires, ShouldEqual, now.Add(introspection.CacheTTL))
+
+			soon := map[string]interface{}{"active": true, "exp": float64(now.Add(time.Minute).Unix())}
+			tokens["soon_token"] = soon
+			result, err = introspection.request("soon_token", now)
+			So(err, ShouldBeNil)
+			So(result.expires.Unix(), ShouldEqual, now.Add(time.Minute).Unix())
+			delete(tokens, "soon_token")
+		})
+
+		Convey("Failed requests should not be cached", func() {
+			badOpts := map[string]string{
+				"introspection_url":           mockServer.URL,
+				"introspection_client_id":     clientId,
+				"introspection_client_secret": "wrong",
+			}
+			badBackend, err := NewIntrospection(badOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			bad := badBackend.(Introspection)
+			So(bad.GetUser("user_token", ""), ShouldBeFalse)
+			So(bad.cache.results, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given claims options, filters should be read from claims", t, func() {
+		claimsOpts := map[string]string{
+			"introspection_url":           mockServer.URL,
+			"introspection_client_id":     clientId,
+			"introspection_client_secret": clientSecret,
+			"introspection_pub_claim":     "mqtt.pub",
+			"introspection_sub_claim":     "mqtt.sub",
+		}
+		backend, err := NewIntrospection(claimsOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		introspection := backend.(Introspection)
+		So(introspection.CheckAcl("claims_token", "claims/test_client", "test_client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(introspection.CheckAcl("claims_token", "claims/other_client", "test_client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(introspection.CheckAcl("claims_token", "claims/other_client", "test_client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(introspection.CheckAcl("user_token", "test/test_user/data", "test_client", MOSQ_ACL_WRITE), ShouldBeTrue)
+	})
+
+	Convey("Given tokens as passwords, clients should be remembered", t, func() {
+		passwordOpts := map[string]string{
+			"introspection_url":             mockServer.URL,
+			"introspection_client_id":       clientId,
+			"introspection_client_secret":   clientSecret,
+			"introspection_token_source":    "password",
+			"introspection_superuser_scope": "mqtt:admin",
+		}
+		backend, err := NewIntrospection(passwordOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		introspection := backend.(Introspection)
+		So(introspection.RemembersClients(), ShouldBeTrue)
+
+		So(introspection.GetClientUser("test_user", "user_token", "test_client"), ShouldBeTrue)
+		So(introspection.GetClientUser("admin", "admin_token", "admin_client"), ShouldBeTrue)
+		So(introspection.GetClientUser("test_user", "wrong_token", "other_client"), ShouldBeFalse)
+
+		So(introspection.GetClientSuperuser("admin", "admin_client"), ShouldBeTrue)
+		So(introspection.GetClientSuperuser("test_user", "test_client"), ShouldBeFalse)
+		So(introspection.GetSuperuser("admin_token"), ShouldBeFalse)
+
+		So(introspection.CheckAcl("test_user", "test/test_user/data", "test_client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(introspection.CheckAcl("other_user", "test/test_user/data", "test_client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(introspection.CheckAcl("test_user", "test/test_user/data", "other_client", MOSQ_ACL_WRITE), ShouldBeFalse)
+	})
+}
@@ -1,11 +1,9 @@
-// +build jwt AND (mysql OR postgres)
+// +build jwt
 
 package backends
 
 import (
 	"bytes"
-	"crypto/tls"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -24,7 +22,13 @@ import (
 
 func init() {
 	RegisteredBackends["jwt"] = NewJWT
-	log.Info("jwt init")
+}
+
+//jwtQueryPrefixes holds the option prefixes of SQL backends, whose queries are replaced by jwt_userquery, jwt_superquery and jwt_aclquery.
+var jwtQueryPrefixes = map[string]string{
+	"postgres": "pg",
+	"mysql":    "mysql",
+	"sqlite":   "sqlite",
 }
 
 type JWT struct {
@@ -48,7 +52,22 @@ type JWT struct {
 	ParamsMode   string
 	ResponseMode string
 
-	UserField string
+	UserField       string
+	TokenSource     string
+	EnforceExpOnAcl bool
+	Prevalidate     bool
+	ForwardClaims   []string
+
+	PubClaim       string
+	SubClaim       string
+	SuperuserClaim string
+	SuperuserValue string
+
+	keys        *jwtKeys
+	validator   *jwtValidator
+	clients     *clientStore
+	revocations *jwtRevocations
+	client      *httpClient
 }
 
 // Claims defines the struct containing the token claims. StandardClaim's Subject field should contain the username, unless an opt is set to support Username field.
@@ -56,6 +75,12 @@ type Claims struct {
 	jwt.StandardClaims
 	// If set, Username defines the identity of the user.
 	Username string `json:"username"`
+	// Audiences holds the aud claim, which may be a single string or an array.
+	Audiences []string `json:"-"`
+	// Raw holds every claim, including those above.
+	Raw map[string]interface{} `json:"-"`
+
+	validator *jwtValidator
 }
 
 type Response struct {
@@ -76,6 +101,7 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		ParamsMode:   "json",
 		LocalDB:      "postgres",
 		UserField:    "Subject",
+		TokenSource:  "username",
 	}
 
 	if userField, ok := authOpts["jwt_userfield"]; ok && userField == "Username" {
@@ -88,6 +114,29 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		jwt.Remote = true
 	}
 
+	if tokenSource, ok := authOpts["jwt_token_source"]; ok {
+		if tokenSource != "username" && tokenSource != "password" {
+			return jwt, errors.Errorf("JWT backend error: unknown jwt_token_source %s.\n", tokenSource)
+		}
+		jwt.TokenSource = tokenSource
+	}
+
+	if enforceExp, ok := authOpts["jwt_enforce_exp_on_acl"]; ok && enforceExp == "true" {
+		jwt.EnforceExpOnAcl = true
+	}
+
+	if jwt.TokenSource == "password" {
+		idle := 24 * time.Hour
+		if idleStr, ok := authOpts["jwt_client_idle"]; ok {
+			seconds, err := strconv.Atoi(idleStr)
+			if err != nil || seconds < 0 {
+				return jwt, errors.Errorf("JWT backend error: invalid jwt_client_idle %s.\n", idleStr)
+			}
+			idle = time.Duration(seconds) * time.Second
+		}
+		jwt.clients = newClientStore(idle)
+	}
+
 	//If remote, set remote api fields. Else, set jwt secret.
 	if jwt.Remote {
 
@@ -153,125 +202,277 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 			return jwt, errors.Errorf("JWT backend error: missing remote options%s.\n", missingOpts)
 		}
 
+		client, err := newHTTPClient(authOpts, "jwt", jwt.VerifyPeer)
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s.\n", err)
+		}
+		jwt.client = client
+
+		//Tokens may be validated as in local mode before asking the API, which is needed to forward their claims.
+		if prevalidate, ok := authOpts["jwt_prevalidate"]; ok && prevalidate == "true" {
+			jwt.Prevalidate = true
+
+			keys, err := newJWTKeys(authOpts)
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: %s.\n", err)
+			}
+			jwt.keys = keys
+
+			validator, err := newJWTValidator(authOpts)
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: %s.\n", err)
+			}
+			jwt.validator = validator
+		}
+
+		jwt.ForwardClaims = splitOption(authOpts["jwt_forward_claims"])
+		if len(jwt.ForwardClaims) > 0 && !jwt.Prevalidate {
+			return jwt, errors.New("JWT backend error: jwt_forward_claims needs jwt_prevalidate, so only verified claims are forwarded.\n")
+		}
+		for _, claim := range jwt.ForwardClaims {
+			if claim == "clientid" || claim == "topic" || claim == "acc" {
+				return jwt, errors.Errorf("JWT backend error: can't forward claim %s, as it would replace the %s param.\n", claim, claim)
+			}
+		}
+
 	} else {
 
-		missingOpts := ""
-		localOk := true
+		jwt.Secret = authOpts["jwt_secret"]
 
-		if secret, ok := authOpts["jwt_secret"]; ok {
-			jwt.Secret = secret
-		} else {
-			return jwt, errors.New("JWT backend error: missing jwt secret.\n")
+		keys, err := newJWTKeys(authOpts)
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s.\n", err)
 		}
+		jwt.keys = keys
+
+		validator, err := newJWTValidator(authOpts)
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s.\n", err)
+		}
+		jwt.validator = validator
+
+		if localDB, ok := authOpts["jwt_db"]; ok {
+			jwt.LocalDB = localDB
+		}
+
+		jwt.PubClaim = authOpts["jwt_pub_claim"]
+		jwt.SubClaim = authOpts["jwt_sub_claim"]
+		jwt.SuperuserClaim = authOpts["jwt_superuser_claim"]
+		jwt.SuperuserValue = authOpts["jwt_superuser_value"]
+
+		//Without a DB, tokens carry everything: users are authenticated by their token alone, and superusers and acls come from claims.
+		if jwt.LocalDB != "none" {
+			if err := jwt.setLocalBackend(authOpts, logLevel); err != nil {
+				return jwt, err
+			}
+		}
+
+	}
+
+	revocations, err := newJWTRevocations(authOpts, jwt.Backend)
+	if err != nil {
+		return jwt, errors.Errorf("JWT backend error: %s.\n", err)
+	}
+	jwt.revocations = revocations
+
+	return jwt, nil
+}
+
+//setLocalBackend creates the backend users, superusers and acls are checked against in local mode.
+func (o *JWT) setLocalBackend(authOpts map[string]string, logLevel log.Level) error {
+
+	missingOpts := ""
+	localOk := true
+
+	//SQL backends run the jwt queries instead of their own, which need not be correct.
+	backendOpts := authOpts
+
+	if queryPrefix, ok := jwtQueryPrefixes[o.LocalDB]; ok {
 
 		if userQuery, ok := authOpts["jwt_userquery"]; ok {
-			jwt.UserQuery = userQuery
+			o.UserQuery = userQuery
 		} else {
 			localOk = false
 			missingOpts += " jwt_userquery"
 		}
 
 		if superuserQuery, ok := authOpts["jwt_superquery"]; ok {
-			jwt.SuperuserQuery = superuserQuery
+			o.SuperuserQuery = superuserQuery
 		}
 
 		if aclQuery, ok := authOpts["jwt_aclquery"]; ok {
-			jwt.AclQuery = aclQuery
-		}
-
-		if localDB, ok := authOpts["jwt_db"]; ok {
-			jwt.LocalDB = localDB
+			o.AclQuery = aclQuery
 		}
 
 		if !localOk {
-			return jwt, errors.Errorf("JWT backend error: missing local options%s.\n", missingOpts)
+			return errors.Errorf("JWT backend error: missing local options%s.\n", missingOpts)
 		}
 
-		if jwt.LocalDB == "mysql" {
-			//Try to create a mysql backend with these custom queries
-			mysql, err := RegisteredBackends["mysql"](authOpts, logLevel)
-			if err != nil {
-				return jwt, errors.Errorf("JWT backend error: couldn't create mysql connector for local jwt: %s\n", err)
-			}
-			mysql.UserQuery = jwt.UserQuery
-			mysql.SuperuserQuery = jwt.SuperuserQuery
-			mysql.AclQuery = jwt.AclQuery
+		backendOpts = make(map[string]string, len(authOpts))
+		for k, v := range authOpts {
+			backendOpts[k] = v
+		}
+		backendOpts[queryPrefix+"_userquery"] = o.UserQuery
+		backendOpts[queryPrefix+"_superquery"] = o.SuperuserQuery
+		backendOpts[queryPrefix+"_aclquery"] = o.AclQuery
+		//Users are authenticated by their tokens, so there are no password hashes to upgrade.
+		delete(backendOpts, queryPrefix+"_updatequery")
+	}
 
-			jwt.Backend = mysql
-		} else {
-			//Try to create a postgres backend with these custom queries.
-			postgres, err := RegisteredBackends["postgres"](authOpts, logLevel)
-			if err != nil {
-				return jwt, errors.Errorf("JWT backend error: couldn't create postgres connector for local jwt: %s\n", err)
-			}
-			postgres.UserQuery = jwt.UserQuery
-			postgres.SuperuserQuery = jwt.SuperuserQuery
-			postgres.AclQuery = jwt.AclQuery
+	create, ok := RegisteredBackends[o.LocalDB]
+	if !ok || o.LocalDB == "jwt" {
+		return errors.Errorf("JWT backend error: unknown jwt_db %s, it must be none or a backend built into the plugin.\n", o.LocalDB)
+	}
 
-			jwt.Backend = postgres
-		}
+	backend, err := create(backendOpts, logLevel)
+	if err != nil {
+		return errors.Errorf("JWT backend error: couldn't create %s backend for local jwt: %s\n", o.LocalDB, err)
+	}
+	o.Backend = backend
 
+	if _, ok := backend.(UserChecker); !ok {
+		log.Warnf("JWT backend: %s backend can't tell if users exist, so valid tokens alone will authenticate them", o.LocalDB)
 	}
 
-	return jwt, nil
+	return nil
 }
 
 //GetUser authenticates a given user.
-func (o JWT) GetUser(token, password string) bool {
+func (o JWT) GetUser(username, password string) bool {
+	return o.GetClientUser(username, password, "")
+}
+
+//GetClientUser authenticates a client with the token given as its username or password.
+//Tokens given as passwords are remembered by client id, along with their claims, for later superuser and acl checks.
+func (o JWT) GetClientUser(username, password, clientid string) bool {
+
+	token := username
+	if o.TokenSource == "password" {
+		token = password
+	}
 
 	if o.Remote {
+		claims, err := o.remoteClaims(token, nil, false)
+		if err != nil {
+			log.Debugf("jwt get user error: %s\n", err)
+			return false
+		}
 		var dataMap map[string]interface{}
 		var urlValues = url.Values{}
-		return jwtRequest(o.Host, o.UserUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		dataMap = o.forwardClaims(claims, dataMap, urlValues)
+		if !o.jwtRequest(o.UserUri, token, claims, dataMap, urlValues) {
+			return false
+		}
+		o.rememberClient(clientid, &rememberedClient{username: username, token: token, data: claims})
+		return true
 	}
 
-	//If not remote, get the claims and check against postgres for user.
+	//If not remote, get the claims and check against the local backend.
 	claims, err := o.getClaims(token)
 
 	if err != nil {
-		log.Printf("jwt get user error: %s\n", err)
+		log.Debugf("jwt get user error: %s\n", err)
 		return false
 	}
-	//Now check against the DB.
-	if o.UserField == "Username" {
-		return o.getLocalUser(claims.Username)
+
+	//Now check against the local backend.
+	if !o.getLocalUser(o.claimsUsername(claims)) {
+		return false
 	}
-	return o.getLocalUser(claims.Subject)
+
+	o.rememberClient(clientid, &rememberedClient{username: username, token: token, data: claims})
+	return true
 
 }
 
 //GetSuperuser checks if the given user is a superuser.
 func (o JWT) GetSuperuser(token string) bool {
+	//Tokens given as passwords are only known by client id.
+	if o.RemembersClients() {
+		return false
+	}
+
+	return o.superuser(token, nil)
+}
+
+//GetClientSuperuser checks if the user a client authenticated as is a superuser.
+func (o JWT) GetClientSuperuser(username, clientid string) bool {
+	if !o.RemembersClients() {
+		return o.GetSuperuser(username)
+	}
+
+	client, ok := o.clients.get(clientid, username)
+	if !ok {
+		log.Debugf("jwt get superuser error: unknown client %s\n", clientid)
+		return false
+	}
+
+	claims, _ := client.data.(*Claims)
+	return o.superuser(client.token, claims)
+}
+
+//superuser checks if the token's user is a superuser, using its claims when they're already known.
+func (o JWT) superuser(token string, claims *Claims) bool {
 
 	if o.Remote {
+		claims, err := o.remoteClaims(token, claims, true)
+		if err != nil {
+			log.Debugf("jwt get superuser error: %s\n", err)
+			return false
+		}
 		var dataMap map[string]interface{}
 		var urlValues = url.Values{}
-		return jwtRequest(o.Host, o.SuperuserUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		dataMap = o.forwardClaims(claims, dataMap, urlValues)
+		return o.jwtRequest(o.SuperuserUri, token, claims, dataMap, urlValues)
 	}
 
-	//If not remote, get the claims and check against postgres for user.
-	//But check first that there's superuser query.
-	if o.SuperuserQuery == "" {
+	//If not remote, get the claims and check against the local backend.
+	//But check first that there's a superuser claim or query.
+	if o.SuperuserClaim == "" && (o.Backend == nil || (o.sqlBackend() && o.SuperuserQuery == "")) {
 		return false
 	}
-	claims, err := o.getClaims(token)
+
+	claims, err := o.tokenClaims(token, claims)
 
 	if err != nil {
 		log.Debugf("jwt get superuser error: %s\n", err)
 		return false
 	}
-	//Now check against DB
-	if o.UserField == "Username" {
-		return o.Backend.GetSuperuser(claims.Username)
+
+	if o.SuperuserClaim != "" {
+		return o.claimsSuperuser(claims)
 	}
-	return o.Backend.GetSuperuser(claims.Subject)
+
+	//Now check against DB
+	return o.Backend.GetSuperuser(o.claimsUsername(claims))
 
 }
 
 //CheckAcl checks user authorization.
-func (o JWT) CheckAcl(token, topic, clientid string, acc int32) bool {
+func (o JWT) CheckAcl(username, topic, clientid string, acc int32) bool {
+	if !o.RemembersClients() {
+		return o.checkAcl(username, nil, topic, clientid, acc)
+	}
+
+	client, ok := o.clients.get(clientid, username)
+	if !ok {
+		log.Debugf("jwt check acl error: unknown client %s\n", clientid)
+		return false
+	}
+
+	claims, _ := client.data.(*Claims)
+	return o.checkAcl(client.token, claims, topic, clientid, acc)
+}
+
+//checkAcl checks the token's user authorization, using its claims when they're already known.
+func (o JWT) checkAcl(token string, claims *Claims, topic, clientid string, acc int32) bool {
 
 	if o.Remote {
+		claims, err := o.remoteClaims(token, claims, true)
+		if err != nil {
+			log.Debugf("jwt check acl error: %s\n", err)
+			return false
+		}
 		dataMap := map[string]interface{}{
 			"clientid": clientid,
 			"topic":    topic,
@@ -282,56 +483,228 @@ func (o JWT) CheckAcl(token, topic, clientid string, acc int32) bool {
 			"topic":    []string{topic},
 			"acc":      []string{strconv.Itoa(int(acc))},
 		}
-		return jwtRequest(o.Host, o.AclUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		o.forwardClaims(claims, dataMap, urlValues)
+		return o.jwtRequest(o.AclUri, token, claims, dataMap, urlValues)
 	}
 
-	//If not remote, get the claims and check against postgres for user.
-	//But check first that there's acl query.
-	if o.AclQuery == "" {
+	//If not remote, get the claims and check against the local backend.
+	//But check first that there are acl claims or query, as otherwise every topic is allowed to tokens that weren't revoked
+	//and haven't expired.
+	allowAll := !o.hasAclClaims() && (o.Backend == nil || (o.sqlBackend() && o.AclQuery == ""))
+	if allowAll && o.revocations == nil && !o.EnforceExpOnAcl {
 		return true
 	}
-	claims, err := o.getClaims(token)
+
+	claims, err := o.tokenClaims(token, claims)
 
 	if err != nil {
 		log.Debugf("jwt check acl error: %s\n", err)
 		return false
 	}
+
+	if allowAll {
+		return true
+	}
+
+	username := o.claimsUsername(claims)
+
+	if o.hasAclClaims() {
+		return o.claimsAcl(claims, username, topic, clientid, acc)
+	}
+
 	//Now check against the DB.
-	if o.UserField == "Username" {
-		return o.Backend.CheckAcl(claims.Username, topic, clientid, acc)
+	return o.Backend.CheckAcl(username, topic, clientid, acc)
+}
+
+//RemembersClients tells if tokens are given as passwords, so clients must be remembered to know their tokens later.
+func (o JWT) RemembersClients() bool {
+	return o.TokenSource == "password"
+}
+
+//BypassesAclCache tells if tokens may be revoked or expire on acl checks, so cached grants can't be trusted until they expire.
+func (o JWT) BypassesAclCache() bool {
+	return o.revocations != nil || o.EnforceExpOnAcl
+}
+
+//ClientExpired tells if the token a client connected with has expired, when jwt_enforce_exp_on_acl is set.
+func (o JWT) ClientExpired(username, clientid string) bool {
+	if !o.EnforceExpOnAcl {
+		return false
+	}
+
+	if !o.RemembersClients() {
+		return o.aclExpired(username, nil)
+	}
+
+	client, ok := o.clients.get(clientid, username)
+	if !ok {
+		return false
 	}
-	return o.Backend.CheckAcl(claims.Subject, topic, clientid, acc)
+
+	claims, _ := client.data.(*Claims)
+	return o.aclExpired(client.token, claims)
 }
 
-func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[string]interface{}, port, paramsMode, responseMode string, urlValues url.Values) bool {
+//KeepClients takes over the clients remembered by a previous instance of the backend.
+func (o JWT) KeepClients(previous Backend) {
+	if p, ok := previous.(JWT); ok && o.clients != nil {
+		o.clients.adopt(p.clients)
+	}
+}
 
-	tlsStr := "http://"
+//remoteClaims checks a token before it's sent to the API. With jwt_prevalidate, it's validated as in local mode and its claims
+//are returned, so bad tokens are rejected without a request. Else it's only checked against the revocation denylist and,
+//on acl checks, its expiry.
+func (o JWT) remoteClaims(token string, claims *Claims, acl bool) (*Claims, error) {
+	if o.Prevalidate {
+		return o.tokenClaims(token, claims)
+	}
+	if o.isRevoked(token, nil) {
+		return nil, errors.New("jwt token revoked")
+	}
+	if acl && o.aclExpired(token, nil) {
+		return nil, errors.New("jwt token expired")
+	}
+	return nil, nil
+}
 
-	if withTLS {
-		tlsStr = "https://"
+//forwardClaims adds the claims given by jwt_forward_claims to the params sent to the API, allocating dataMap if needed.
+//Form values are strings, so arrays are sent as repeated values and objects JSON encoded.
+func (o JWT) forwardClaims(claims *Claims, dataMap map[string]interface{}, urlValues url.Values) map[string]interface{} {
+	if claims == nil || len(o.ForwardClaims) == 0 {
+		return dataMap
 	}
 
-	fullUri := fmt.Sprintf("%s%s%s", tlsStr, host, uri)
-	if port != "" {
-		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, host, port, uri)
+	if dataMap == nil {
+		dataMap = make(map[string]interface{})
 	}
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	for _, path := range o.ForwardClaims {
+		value, ok := claims.claimValue(path)
+		if !ok {
+			continue
+		}
+		dataMap[path] = value
+		urlValues[path] = formValues(value)
+	}
 
-	var resp *http.Response
-	var err error
+	return dataMap
+}
 
-	if !verifyPeer {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func formValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case nil:
+		return []string{""}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, formValues(item)...)
 		}
-		client.Transport = tr
+		return values
+	}
+	encoded, _ := json.Marshal(value)
+	return []string{string(encoded)}
+}
+
+//tokenClaims returns the claims remembered for a token, checking it wasn't revoked nor, if enforced, expired since,
+//or else parses the token.
+func (o JWT) tokenClaims(token string, claims *Claims) (*Claims, error) {
+	if claims == nil {
+		return o.getClaims(token)
+	}
+	if o.isRevoked(token, claims) {
+		return nil, errors.New("jwt token revoked")
+	}
+	if o.aclExpired(token, claims) {
+		return nil, errors.New("jwt token expired")
+	}
+	return claims, nil
+}
+
+//aclExpired tells if the token's exp has passed, allowing for leeway, when jwt_enforce_exp_on_acl is set.
+//Unknown claims are read without verifying the token, which is fine as they're only used to deny it.
+func (o JWT) aclExpired(token string, claims *Claims) bool {
+	if !o.EnforceExpOnAcl {
+		return false
+	}
+
+	if claims == nil {
+		if claims = unverifiedClaims(token); claims == nil {
+			return false
+		}
+	}
+
+	var leeway time.Duration
+	if o.validator != nil {
+		leeway = o.validator.Leeway
+	}
+
+	if claims.ExpiresAt == 0 || time.Now().Before(time.Unix(claims.ExpiresAt, 0).Add(leeway)) {
+		return false
+	}
+
+	log.Infof("jwt acl denied: token expired\n")
+	return true
+}
+
+//isRevoked tells if the token is in the revocation denylist, identifying it by its claims when they're known.
+//Unknown claims are read without verifying the token, which is fine as they're only used to deny it.
+func (o JWT) isRevoked(token string, claims *Claims) bool {
+	if o.revocations == nil {
+		return false
+	}
+
+	if claims == nil {
+		claims = unverifiedClaims(token)
+	}
+
+	if o.revocations.revoked(jwtTokenId(token, claims)) {
+		log.Infof("jwt token rejected: revoked\n")
+		return true
+	}
+	return false
+}
+
+//unverifiedClaims reads the token's claims without verifying it, returning nil when they can't be read.
+func unverifiedClaims(token string) *Claims {
+	claims := &Claims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return nil
+	}
+	return claims
+}
+
+func (o JWT) rememberClient(clientid string, client *rememberedClient) {
+	if o.clients != nil && clientid != "" {
+		o.clients.set(clientid, client)
+	}
+}
+
+//jwtRequest sends the token and params to the given uri with the backend's client, reusing its connections.
+//Claims are only used to log the token's user, and are nil unless tokens are prevalidated.
+func (o JWT) jwtRequest(uri, token string, claims *Claims, dataMap map[string]interface{}, urlValues url.Values) bool {
+
+	tlsStr := "http://"
+
+	if o.WithTLS {
+		tlsStr = "https://"
+	}
+
+	fullUri := fmt.Sprintf("%s%s%s", tlsStr, o.Host, uri)
+	if o.Port != "" {
+		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, o.Host, o.Port, uri)
 	}
 
 	var req *http.Request
 	var reqErr error
 
-	if paramsMode == "json" {
+	if o.ParamsMode == "json" {
 		dataJson, mErr := json.Marshal(dataMap)
 
 		if mErr != nil {
@@ -360,7 +733,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 
 	req.Header.Set("authorization", token)
 
-	resp, err = client.Do(req)
+	resp, err := o.client.Do(req)
 
 	if err != nil {
 		log.Errorf("error: %v\n", err)
@@ -376,11 +749,11 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 	}
 
 	if resp.Status != "200 OK" {
-		log.Infof("error code: %v\n", err)
+		log.Infof("error code: %s\n", resp.Status)
 		return false
 	}
 
-	if responseMode == "text" {
+	if o.ResponseMode == "text" {
 
 		//For test response, we expect "ok" or an error message.
 		if string(body) != "ok" {
@@ -388,7 +761,7 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 			return false
 		}
 
-	} else if responseMode == "json" {
+	} else if o.ResponseMode == "json" {
 
 		//For json response, we expect Ok and Error fields.
 		response := Response{Ok: false, Error: ""}
@@ -406,7 +779,12 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 
 	}
 
-	log.Debugf("jwt request approved for %s\n", token)
+	//Tokens are credentials, so they're never logged, only their user when it's known.
+	if claims != nil {
+		log.Debugf("jwt request to %s approved for %s\n", uri, o.claimsUsername(claims))
+	} else {
+		log.Debugf("jwt request to %s approved\n", uri)
+	}
 	return true
 
 }
@@ -417,40 +795,31 @@ func (o JWT) GetName() string {
 }
 
 func (o JWT) getLocalUser(username string) bool {
-	//If there's no user query, return false.
-	if o.UserQuery == "" {
-		return false
-	}
-
-	var count sql.NullInt64
-	var err error
-	err = o.Backend.DB.Get(&count, o.UserQuery, username)
-
-	if err != nil {
-		log.Debugf("Local JWT get user error: %s\n", err)
-		return false
-	}
-
-	if !count.Valid {
-		log.Debugf("Local JWT get user error: user %s not found.\n", username)
+	if username == "" {
 		return false
 	}
 
-	if count.Int64 > 0 {
+	//Without a backend, or one that can't tell if users exist, the token is enough.
+	checker, ok := o.Backend.(UserChecker)
+	if !ok {
 		return true
 	}
 
-	return false
+	return checker.UserExists(username)
+}
+
+//sqlBackend tells if the local backend runs the jwt queries.
+func (o JWT) sqlBackend() bool {
+	_, ok := jwtQueryPrefixes[o.LocalDB]
+	return ok
 }
 
 func (o JWT) getClaims(tokenStr string) (*Claims, error) {
 
-	jwtToken, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(o.Secret), nil
-	})
+	jwtToken, err := o.keys.parse(tokenStr, &Claims{validator: o.validator})
 
 	if err != nil {
-		log.Debugf("jwt parse error: %s\n", err)
+		log.Infof("jwt token rejected: %s\n", err)
 		return nil, err
 	}
 
@@ -465,12 +834,47 @@ func (o JWT) getClaims(tokenStr string) (*Claims, error) {
 		return nil, errors.New("got strange claims")
 	}
 
+	if o.isRevoked(tokenStr, claims) {
+		return nil, errors.New("jwt token revoked")
+	}
+
 	return claims, nil
 }
 
-//Halt closes any DB connection.
+//Halt closes any DB connection and idle API connections, and stops refreshing keys.
 func (o JWT) Halt() {
-	o.Backend.Halt()
+	if o.keys != nil {
+		o.keys.Stop()
+	}
+	if o.revocations != nil {
+		o.revocations.Stop()
+	}
+	if o.client != nil {
+		o.client.CloseIdleConnections()
+	}
+	if o.Backend != nil {
+		o.Backend.Halt()
+	}
 }
 
-func (o JWT) Reload() {}
+//Reload reads public keys, JWKS documents, the revocation denylist and the API client's certificates again, and reloads the local backend.
+func (o JWT) Reload() {
+	if o.keys != nil {
+		if err := o.keys.Reload(); err != nil {
+			log.Errorf("jwt keys reload error, keeping previous keys: %s", err)
+		}
+	}
+	if o.revocations != nil {
+		if err := o.revocations.Reload(); err != nil {
+			log.Errorf("jwt revocation reload error, keeping previous ids: %s", err)
+		}
+	}
+	if o.client != nil {
+		if err := o.client.Reload(); err != nil {
+			log.Errorf("jwt client reload error, keeping previous client: %s", err)
+		}
+	}
+	if o.Backend != nil {
+		o.Backend.Reload()
+	}
+}
@@ -0,0 +1,112 @@
+// +build jwt
+
+package backends
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+//UnmarshalJSON decodes the known claims and keeps every claim in Raw, so others may be read by name.
+//The audience may be a single string or an array of them, and is always set in Audiences.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	//claims has no methods, so decoding into it doesn't call UnmarshalJSON again.
+	type claims Claims
+	aux := struct {
+		*claims
+		Audience interface{} `json:"aud"`
+	}{claims: (*claims)(c)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	c.Audiences = nil
+	switch aud := aux.Audience.(type) {
+	case nil:
+	case string:
+		c.Audience = aud
+		c.Audiences = []string{aud}
+	case []interface{}:
+		for _, item := range aud {
+			s, ok := item.(string)
+			if !ok {
+				return errors.New("invalid aud claim")
+			}
+			c.Audiences = append(c.Audiences, s)
+		}
+	default:
+		return errors.New("invalid aud claim")
+	}
+
+	c.Raw = make(map[string]interface{})
+	return json.Unmarshal(data, &c.Raw)
+}
+
+//Valid checks the registered claims with the backend's validator, or as jwt-go does by default when there's none.
+func (c *Claims) Valid() error {
+	if c.validator == nil {
+		return c.StandardClaims.Valid()
+	}
+	return c.validator.validate(c)
+}
+
+//claimValue returns the claim at a dot separated path, e.g. mqtt.pub for {"mqtt": {"pub": [...]}}.
+func (c *Claims) claimValue(path string) (interface{}, bool) {
+	return lookupClaim(c.Raw, path)
+}
+
+//claimStrings returns the strings in the claim at path, which may be a single string or an array of them.
+//Other values are ignored.
+func (c *Claims) claimStrings(path string) []string {
+	value, ok := c.claimValue(path)
+	if !ok {
+		return nil
+	}
+	return claimToStrings(value)
+}
+
+//claimsUsername returns the user's identity, taken from the Subject or Username claim as set by jwt_userfield.
+func (o JWT) claimsUsername(claims *Claims) string {
+	if o.UserField == "Username" {
+		return claims.Username
+	}
+	return claims.Subject
+}
+
+//hasAclClaims tells if acls are read from claims instead of a database.
+func (o JWT) hasAclClaims() bool {
+	return o.PubClaim != "" || o.SubClaim != ""
+}
+
+//claimsSuperuser checks the superuser claim: it must be true, or equal or contain the superuser value when one is set.
+func (o JWT) claimsSuperuser(claims *Claims) bool {
+	if o.SuperuserValue == "" {
+		value, ok := claims.claimValue(o.SuperuserClaim)
+		isTrue, isBool := value.(bool)
+		return ok && isBool && isTrue
+	}
+
+	for _, value := range claims.claimStrings(o.SuperuserClaim) {
+		if value == o.SuperuserValue {
+			return true
+		}
+	}
+	return false
+}
+
+//claimsAcl checks a topic against the filters in the publish and subscribe claims, replacing %u and %c in them.
+//Publishing is checked against publish filters, while reading and subscribing are checked against subscribe ones.
+func (o JWT) claimsAcl(claims *Claims, username, topic, clientid string, acc int32) bool {
+	switch acc {
+	case MOSQ_ACL_WRITE:
+		return claimsTopicMatches(claims.claimStrings(o.PubClaim), username, topic, clientid, acc)
+	case MOSQ_ACL_READ, MOSQ_ACL_SUBSCRIBE:
+		return claimsTopicMatches(claims.claimStrings(o.SubClaim), username, topic, clientid, acc)
+	case MOSQ_ACL_READWRITE:
+		return claimsTopicMatches(claims.claimStrings(o.PubClaim), username, topic, clientid, MOSQ_ACL_WRITE) &&
+			claimsTopicMatches(claims.claimStrings(o.SubClaim), username, topic, clientid, MOSQ_ACL_READ)
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// +build jwt,files
+
+package backends
+
+import (
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocalFilesJWT(t *testing.T) {
+
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "false"
+	authOpts["jwt_db"] = "files"
+	authOpts["jwt_secret"] = jwtSecret
+	authOpts["jwt_userfield"] = "Username"
+	authOpts["password_path"] = pwPath
+	authOpts["acl_path"] = aclPath
+
+	sign := func(username string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp":      expSecondsSinceEpoch,
+			"username": username,
+		}).SignedString([]byte(jwtSecret))
+		So(err, ShouldBeNil)
+		return token
+	}
+
+	Convey("Given a files backend, NewJWT should wrap it without jwt queries", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Users should be checked to exist in the password file", func() {
+			So(jwtBackend.GetUser(sign("test1"), ""), ShouldBeTrue)
+			So(jwtBackend.GetUser(sign("unknown"), ""), ShouldBeFalse)
+		})
+
+		Convey("Acls should be checked by the files backend", func() {
+			token := sign("test1")
+			So(jwtBackend.CheckAcl(token, "test/topic/1", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "test/topic/1", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(jwtBackend.CheckAcl(token, "test/test1", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(sign("test2"), "test/topic/3", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		})
+
+		Convey("Users should not be superusers unless the files backend says so", func() {
+			So(jwtBackend.GetSuperuser(sign("test1")), ShouldBeFalse)
+		})
+
+		Convey("Claims should still take precedence over the files backend", func() {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts["jwt_pub_claim"] = "pub"
+
+			jwtBackend, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"exp":      expSecondsSinceEpoch,
+				"username": "test1",
+				"pub":      "claims/#",
+			}).SignedString([]byte(jwtSecret))
+			So(err, ShouldBeNil)
+
+			So(jwtBackend.CheckAcl(token, "claims/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "test/topic/1", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		jwtBackend.Halt()
+	})
+
+	Convey("Given an unknown jwt_db, NewJWT should fail", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["jwt_db"] = "unknown"
+
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+}
@@ -0,0 +1,512 @@
+// +build jwt
+
+package backends
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+//Defaults for JWKS documents. Unknown key ids trigger a refresh, but not more often than jwksMinRefresh.
+const (
+	jwksDefaultRefresh = time.Hour
+	jwksMinRefresh     = time.Minute
+	jwksFetchTimeout   = 10 * time.Second
+)
+
+//Algorithms allowed by default for each kind of key, when jwt_alg is not given.
+var (
+	jwtHMACAlgorithms       = []string{"HS256", "HS384", "HS512"}
+	jwtAsymmetricAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+//jwk is a verification key read from a JWKS document.
+type jwk struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+//jwtKeys holds the keys tokens may be signed with: an HMAC secret, public keys read from PEM files and keys from a JWKS document.
+type jwtKeys struct {
+	Algorithms []string
+
+	secret   []byte
+	pemPaths []string
+	jwksPath string
+	jwksUri  string
+	refresh  time.Duration
+	client   *http.Client
+
+	mu        sync.RWMutex
+	pemKeys   []interface{}
+	jwks      []jwk
+	fetchedAt time.Time
+	stop      chan struct{}
+}
+
+//newJWTKeys reads jwt_secret, jwt_public_key_file, jwt_jwks_file, jwt_jwks_url, jwt_jwks_refresh and jwt_alg, and loads every key.
+func newJWTKeys(authOpts map[string]string) (*jwtKeys, error) {
+	keys := &jwtKeys{
+		refresh: jwksDefaultRefresh,
+		client:  &http.Client{Timeout: jwksFetchTimeout},
+		stop:    make(chan struct{}),
+	}
+
+	if secret, ok := authOpts["jwt_secret"]; ok && secret != "" {
+		keys.secret = []byte(secret)
+	}
+
+	if paths, ok := authOpts["jwt_public_key_file"]; ok {
+		for _, path := range strings.Split(paths, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				keys.pemPaths = append(keys.pemPaths, path)
+			}
+		}
+	}
+
+	keys.jwksPath = authOpts["jwt_jwks_file"]
+	keys.jwksUri = authOpts["jwt_jwks_url"]
+
+	if keys.jwksPath != "" && keys.jwksUri != "" {
+		return nil, errors.New("only one of jwt_jwks_file and jwt_jwks_url may be given")
+	}
+
+	if refresh, ok := authOpts["jwt_jwks_refresh"]; ok {
+		seconds, err := strconv.Atoi(refresh)
+		if err != nil || seconds < 0 {
+			return nil, errors.Errorf("invalid jwt_jwks_refresh %s", refresh)
+		}
+		keys.refresh = time.Duration(seconds) * time.Second
+	}
+
+	asymmetric := len(keys.pemPaths) > 0 || keys.jwksPath != "" || keys.jwksUri != ""
+
+	if keys.secret == nil && !asymmetric {
+		return nil, errors.New("missing jwt_secret, jwt_public_key_file, jwt_jwks_file or jwt_jwks_url")
+	}
+
+	if algs, ok := authOpts["jwt_alg"]; ok {
+		for _, alg := range strings.Split(algs, ",") {
+			alg = strings.TrimSpace(alg)
+			if alg == "" {
+				continue
+			}
+			if method := jwt.GetSigningMethod(alg); method == nil || alg == "none" {
+				return nil, errors.Errorf("unknown jwt_alg %s", alg)
+			}
+			keys.Algorithms = append(keys.Algorithms, alg)
+		}
+		if len(keys.Algorithms) == 0 {
+			return nil, errors.New("empty jwt_alg")
+		}
+	} else {
+		if keys.secret != nil {
+			keys.Algorithms = append(keys.Algorithms, jwtHMACAlgorithms...)
+		}
+		if asymmetric {
+			keys.Algorithms = append(keys.Algorithms, jwtAsymmetricAlgorithms...)
+		}
+	}
+
+	if err := keys.Reload(); err != nil {
+		return nil, err
+	}
+
+	if (keys.jwksPath != "" || keys.jwksUri != "") && keys.refresh > 0 {
+		go keys.refreshLoop()
+	}
+
+	return keys, nil
+}
+
+//Reload reads the PEM files and the JWKS document again. On errors, previous keys are kept.
+func (k *jwtKeys) Reload() error {
+	pemKeys := make([]interface{}, 0, len(k.pemPaths))
+	for _, path := range k.pemPaths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "couldn't read jwt public key")
+		}
+		fileKeys, err := parsePEMPublicKeys(content)
+		if err != nil {
+			return errors.Wrapf(err, "invalid jwt public key file %s", path)
+		}
+		pemKeys = append(pemKeys, fileKeys...)
+	}
+
+	k.mu.Lock()
+	k.pemKeys = pemKeys
+	k.mu.Unlock()
+
+	return k.loadJWKS()
+}
+
+//Stop ends the periodic JWKS refresh.
+func (k *jwtKeys) Stop() {
+	select {
+	case <-k.stop:
+	default:
+		close(k.stop)
+	}
+}
+
+func (k *jwtKeys) refreshLoop() {
+	ticker := time.NewTicker(k.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+			if err := k.loadJWKS(); err != nil {
+				log.Errorf("jwks refresh error, keeping previous keys: %s", err)
+			}
+		}
+	}
+}
+
+//loadJWKS reads the JWKS document, if any, replacing the current keys when it's valid.
+func (k *jwtKeys) loadJWKS() error {
+	var content []byte
+	var err error
+
+	switch {
+	case k.jwksPath != "":
+		content, err = ioutil.ReadFile(k.jwksPath)
+	case k.jwksUri != "":
+		content, err = k.fetchJWKS()
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "couldn't read jwks")
+	}
+
+	jwks, err := parseJWKS(content)
+	if err != nil {
+		return errors.Wrap(err, "invalid jwks")
+	}
+
+	k.mu.Lock()
+	k.jwks = jwks
+	k.fetchedAt = time.Now()
+	k.mu.Unlock()
+
+	return nil
+}
+
+func (k *jwtKeys) fetchJWKS() ([]byte, error) {
+	resp, err := k.client.Get(k.jwksUri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+//candidates returns the keys that may have signed a token with the given algorithm and key id.
+//Keys of a type that doesn't fit the algorithm are left out, so a public key is never used as an HMAC secret.
+//JWKS keys are selected by kid when the token has one, while the secret and PEM keys, which have no id, are always tried.
+func (k *jwtKeys) candidates(alg, kid string) []interface{} {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]interface{}, 0)
+
+	if k.secret != nil {
+		keys = append(keys, k.secret)
+	}
+	keys = append(keys, k.pemKeys...)
+
+	for _, key := range k.jwks {
+		if kid != "" && key.kid != kid {
+			continue
+		}
+		if key.alg != "" && key.alg != alg {
+			continue
+		}
+		keys = append(keys, key.key)
+	}
+
+	fitting := keys[:0]
+	for _, key := range keys {
+		if keyFitsAlgorithm(key, alg) {
+			fitting = append(fitting, key)
+		}
+	}
+
+	return fitting
+}
+
+//hasKid tells if the JWKS document has a key with the given id.
+func (k *jwtKeys) hasKid(kid string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.jwks {
+		if key.kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+//parse verifies a token's algorithm and signature, and its claims with claims.Valid, decoding them into claims.
+//Tokens signed with an algorithm not in the allowlist are rejected before looking for a key.
+func (k *jwtKeys) parse(tokenStr string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := &jwt.Parser{ValidMethods: k.Algorithms}
+
+	unverified, _, err := parser.ParseUnverified(tokenStr, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	alg := unverified.Method.Alg()
+	if !k.allowed(alg) {
+		return nil, errors.Errorf("signing algorithm %s is not allowed", alg)
+	}
+
+	kid, _ := unverified.Header["kid"].(string)
+
+	//An unknown kid may belong to a key added since the last refresh.
+	if kid != "" && (k.jwksPath != "" || k.jwksUri != "") && !k.hasKid(kid) {
+		k.mu.RLock()
+		stale := time.Since(k.fetchedAt) > jwksMinRefresh
+		k.mu.RUnlock()
+		if stale {
+			if err := k.loadJWKS(); err != nil {
+				log.Errorf("jwks refresh error, keeping previous keys: %s", err)
+			}
+		}
+	}
+
+	candidates := k.candidates(alg, kid)
+	if len(candidates) == 0 {
+		return nil, errors.Errorf("no key found for algorithm %s and kid %q", alg, kid)
+	}
+
+	for _, key := range candidates {
+		token, err := parser.ParseWithClaims(tokenStr, claims, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if err == nil {
+			return token, nil
+		}
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			continue
+		}
+		return nil, err
+	}
+
+	return nil, errors.New("invalid token signature")
+}
+
+func (k *jwtKeys) allowed(alg string) bool {
+	for _, allowed := range k.Algorithms {
+		if allowed == alg {
+			return true
+		}
+	}
+	return false
+}
+
+//keyFitsAlgorithm checks the key's type is the one the algorithm verifies with.
+func keyFitsAlgorithm(key interface{}, alg string) bool {
+	switch jwt.GetSigningMethod(alg).(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok := key.([]byte)
+		return ok
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		return ok && ecKey.Curve.Params().BitSize == jwt.GetSigningMethod(alg).(*jwt.SigningMethodECDSA).CurveBits
+	}
+	return false
+}
+
+//parsePEMPublicKeys reads every RSA or ECDSA public key, given as PKIX or PKCS1 public keys or certificates, from PEM content.
+func parsePEMPublicKeys(content []byte) ([]interface{}, error) {
+	keys := make([]interface{}, 0)
+
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		var err error
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, errors.Errorf("unsupported key type %T", key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys found")
+	}
+
+	return keys, nil
+}
+
+//jwkJSON is a key as given in a JWKS document. Only RSA and EC signing keys are used.
+type jwkJSON struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//parseJWKS reads the RSA and EC signing keys of a JWKS document. Other keys are skipped, but malformed ones are errors.
+func parseJWKS(content []byte) ([]jwk, error) {
+	var doc struct {
+		Keys []jwkJSON `json:"keys"`
+	}
+
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+
+	keys := make([]jwk, 0, len(doc.Keys))
+
+	for i, key := range doc.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		var pub interface{}
+		var err error
+
+		switch key.Kty {
+		case "RSA":
+			pub, err = parseRSAJWK(key)
+		case "EC":
+			pub, err = parseECJWK(key)
+		default:
+			log.Debugf("skipping jwk %q with unsupported key type %s", key.Kid, key.Kty)
+			continue
+		}
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %d (kid %q)", i, key.Kid)
+		}
+
+		keys = append(keys, jwk{kid: key.Kid, alg: key.Alg, key: pub})
+	}
+
+	return keys, nil
+}
+
+func parseRSAJWK(key jwkJSON) (*rsa.PublicKey, error) {
+	n, err := decodeJWKInt(key.N, "n")
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := decodeJWKInt(key.E, "e")
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid e")
+	}
+
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func parseECJWK(key jwkJSON) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch key.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.Errorf("unsupported curve %s", key.Crv)
+	}
+
+	x, err := decodeJWKInt(key.X, "x")
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := decodeJWKInt(key.Y, "y")
+	if err != nil {
+		return nil, err
+	}
+
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on the curve")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+//decodeJWKInt decodes a base64url encoded big endian integer.
+func decodeJWKInt(s, what string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.Errorf("missing %s", what)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", what)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
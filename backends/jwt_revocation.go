@@ -0,0 +1,267 @@
+// +build jwt
+
+package backends
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+//jwtRevocations tells if tokens were revoked, looking up their ids in a denylist file, a SQL query or a Redis set.
+//Tokens are identified by their jti claim, or by the SHA-256 of the whole token, hex encoded, when they have none.
+//Lookups are cached for ttl, and the file is read again when it changes, checking at most once per ttl.
+type jwtRevocations struct {
+	sync.Mutex
+
+	ttl time.Duration
+
+	file        string
+	modTime     time.Time
+	checked     time.Time
+	fileIds     map[string]bool
+	fileFailing bool
+
+	query   string
+	querier QueryRunner
+
+	redisSet string
+	redis    *goredis.Client
+
+	lookups   map[string]jwtRevocation
+	sweepSize int
+}
+
+//jwtRevocation is a cached query or Redis lookup.
+type jwtRevocation struct {
+	revoked bool
+	checked time.Time
+}
+
+//newJWTRevocations reads jwt_revocation_file, jwt_revocation_query, jwt_revocation_redis_set and their options.
+//It returns nil when no denylist is given. Queries run on the local SQL backend, which must be given.
+func newJWTRevocations(authOpts map[string]string, backend Backend) (*jwtRevocations, error) {
+	revocations := &jwtRevocations{
+		ttl:       10 * time.Second,
+		file:      authOpts["jwt_revocation_file"],
+		query:     authOpts["jwt_revocation_query"],
+		redisSet:  authOpts["jwt_revocation_redis_set"],
+		lookups:   make(map[string]jwtRevocation),
+		sweepSize: 1024,
+	}
+
+	if revocations.file == "" && revocations.query == "" && revocations.redisSet == "" {
+		return nil, nil
+	}
+
+	if ttl, ok := authOpts["jwt_revocation_cache"]; ok {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil || seconds < 0 {
+			return nil, errors.Errorf("invalid jwt_revocation_cache %s", ttl)
+		}
+		revocations.ttl = time.Duration(seconds) * time.Second
+	}
+
+	if revocations.query != "" {
+		querier, ok := backend.(QueryRunner)
+		if !ok {
+			return nil, errors.New("jwt_revocation_query needs a SQL jwt_db")
+		}
+		revocations.querier = querier
+	}
+
+	if revocations.redisSet != "" {
+		host := "localhost"
+		if h, ok := authOpts["jwt_revocation_redis_host"]; ok {
+			host = h
+		}
+		port := "6379"
+		if p, ok := authOpts["jwt_revocation_redis_port"]; ok {
+			port = p
+		}
+		db := 0
+		if d, ok := authOpts["jwt_revocation_redis_db"]; ok {
+			var err error
+			if db, err = strconv.Atoi(d); err != nil {
+				return nil, errors.Errorf("invalid jwt_revocation_redis_db %s", d)
+			}
+		}
+
+		//The client connects when needed, so lookups work once Redis is available.
+		revocations.redis = goredis.NewClient(&goredis.Options{
+			Addr:     fmt.Sprintf("%s:%s", host, port),
+			Password: authOpts["jwt_revocation_redis_password"],
+			DB:       db,
+		})
+	}
+
+	if revocations.file != "" {
+		if err := revocations.loadFile(); err != nil {
+			revocations.Stop()
+			return nil, err
+		}
+	}
+
+	return revocations, nil
+}
+
+//jwtTokenId returns the id tokens are revoked by: their jti claim or the hash of the whole token.
+func jwtTokenId(token string, claims *Claims) string {
+	if claims != nil && claims.Id != "" {
+		return claims.Id
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//revoked tells if the token with the given id was revoked. When a lookup fails, its cached result is used if there's any,
+//else the token is taken as revoked.
+func (r *jwtRevocations) revoked(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+
+	if r.file != "" {
+		r.refreshFile(now)
+		if r.fileIds[id] {
+			return true
+		}
+	}
+
+	if r.querier == nil && r.redis == nil {
+		return false
+	}
+
+	cached, ok := r.lookups[id]
+	if ok && now.Sub(cached.checked) < r.ttl {
+		return cached.revoked
+	}
+
+	revoked, err := r.lookup(id)
+	if err != nil {
+		log.Errorf("jwt revocation lookup error: %s", err)
+		return !ok || cached.revoked
+	}
+
+	r.lookups[id] = jwtRevocation{revoked: revoked, checked: now}
+
+	//Old lookups are swept whenever the cache doubles, so sweeping takes constant time per lookup on average.
+	if len(r.lookups) >= r.sweepSize {
+		for lookupId, lookup := range r.lookups {
+			if now.Sub(lookup.checked) >= r.ttl {
+				delete(r.lookups, lookupId)
+			}
+		}
+		r.sweepSize = 2 * len(r.lookups)
+		if r.sweepSize < 1024 {
+			r.sweepSize = 1024
+		}
+	}
+
+	return revoked
+}
+
+//lookup checks the id against the query and the Redis set.
+func (r *jwtRevocations) lookup(id string) (bool, error) {
+	if r.querier != nil {
+		revoked, err := r.querier.QueryExists(r.query, id)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+
+	if r.redis != nil {
+		return r.redis.SIsMember(r.redisSet, id).Result()
+	}
+
+	return false, nil
+}
+
+//refreshFile reads the file again if it changed since it was last read, checking at most once per ttl.
+//Should the file become unreadable, the last ids read are kept.
+func (r *jwtRevocations) refreshFile(now time.Time) {
+	if now.Sub(r.checked) < r.ttl {
+		return
+	}
+	r.checked = now
+
+	info, err := os.Stat(r.file)
+	if err != nil {
+		if !r.fileFailing {
+			log.Errorf("jwt revocation file error, keeping previous ids: %s", err)
+			r.fileFailing = true
+		}
+		return
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return
+	}
+
+	if err := r.loadFile(); err != nil {
+		log.Errorf("jwt revocation file error, keeping previous ids: %s", err)
+		return
+	}
+	r.fileFailing = false
+}
+
+//loadFile reads revoked ids from the file, one per line. Empty lines and lines starting with # are skipped.
+func (r *jwtRevocations) loadFile() error {
+	f, err := os.Open(r.file)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open jwt_revocation_file")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "couldn't read jwt_revocation_file")
+	}
+
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "couldn't read jwt_revocation_file")
+	}
+
+	r.fileIds = ids
+	r.modTime = info.ModTime()
+	return nil
+}
+
+//Reload reads the file again and drops cached lookups, so every revocation takes effect right away.
+func (r *jwtRevocations) Reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.lookups = make(map[string]jwtRevocation)
+	if r.file == "" {
+		return nil
+	}
+	r.checked = time.Now()
+	return r.loadFile()
+}
+
+//Stop closes the Redis client, if any.
+func (r *jwtRevocations) Stop() {
+	if r.redis != nil {
+		r.redis.Close()
+	}
+}
@@ -1,4 +1,4 @@
-// +build jwt
+// +build jwt,postgres,mysql,http
 
 package backends
 
@@ -10,44 +10,12 @@ import (
 	"strconv"
 	"strings"
 	"testing"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
-var username = "test"
-
-//Hash generated by the pw utility
-var userPassHash = "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
-
-var jwtSecret = "some_jwt_secret"
-
-// Generate the token.
-var now = time.Now()
-var nowSecondsSinceEpoch = now.Unix()
-var expSecondsSinceEpoch int64 = nowSecondsSinceEpoch + int64(time.Hour*24/time.Second)
-
-var jwtToken = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-	"iss":      "jwt-test",
-	"aud":      "jwt-test",
-	"nbf":      nowSecondsSinceEpoch,
-	"exp":      expSecondsSinceEpoch,
-	"sub":      "user",
-	"username": username,
-})
-
-var wrongJwtToken = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-	"iss":      "jwt-test",
-	"aud":      "jwt-test",
-	"nbf":      nowSecondsSinceEpoch,
-	"exp":      expSecondsSinceEpoch,
-	"sub":      "user",
-	"username": "wrong_user",
-})
-
 func TestLocalPostgresJWT(t *testing.T) {
 
 	Convey("Creating a token should return a nil error", t, func() {
@@ -79,8 +47,8 @@ func TestLocalPostgresJWT(t *testing.T) {
 			So(err, ShouldBeNil)
 
 			//Empty DB
-			jwt.Postgres.DB.MustExec("delete from test_user where 1 = 1")
-			jwt.Postgres.DB.MustExec("delete from test_acl where 1 = 1")
+			jwt.(JWT).Backend.(Postgres).DB.MustExec("delete from test_user where 1 = 1")
+			jwt.(JWT).Backend.(Postgres).DB.MustExec("delete from test_acl where 1 = 1")
 
 			//Now test everything.
 
@@ -88,7 +56,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 			userID := 0
 
-			iqErr := jwt.Postgres.DB.Get(&userID, insertQuery, username, userPassHash, true)
+			iqErr := jwt.(JWT).Backend.(Postgres).DB.Get(&userID, insertQuery, username, userPassHash, true)
 
 			So(iqErr, ShouldBeNil)
 			So(userID, ShouldBeGreaterThan, 0)
@@ -125,7 +93,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 			aclID := 0
 			aclQuery := "INSERT INTO test_acl(test_user_id, topic, rw) values($1, $2, $3) returning id"
-			aqErr := jwt.Postgres.DB.Get(&aclID, aclQuery, userID, strictAcl, 1)
+			aqErr := jwt.(JWT).Backend.(Postgres).DB.Get(&aclID, aclQuery, userID, strictAcl, 1)
 			So(aqErr, ShouldBeNil)
 
 			Convey("Given only strict acl in DB, an exact match should work and and inexact one not", func() {
@@ -161,7 +129,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 			//Now insert single level topic to check against.
 
-			aqErr = jwt.Postgres.DB.Get(&aclID, aclQuery, userID, singleLevelAcl, 1)
+			aqErr = jwt.(JWT).Backend.(Postgres).DB.Get(&aclID, aclQuery, userID, singleLevelAcl, 1)
 			So(aqErr, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a db single level wildcard, acl check should pass", func() {
@@ -171,7 +139,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 			//Now insert hierarchy wildcard to check against.
 
-			aqErr = jwt.Postgres.DB.Get(&aclID, aclQuery, userID, hierarchyAcl, 1)
+			aqErr = jwt.(JWT).Backend.(Postgres).DB.Get(&aclID, aclQuery, userID, hierarchyAcl, 1)
 			So(aqErr, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a hierarchy wildcard, acl check should pass", func() {
@@ -180,8 +148,8 @@ func TestLocalPostgresJWT(t *testing.T) {
 			})
 
 			//Empty db
-			jwt.Postgres.DB.MustExec("delete from test_user where 1 = 1")
-			jwt.Postgres.DB.MustExec("delete from test_acl where 1 = 1")
+			jwt.(JWT).Backend.(Postgres).DB.MustExec("delete from test_user where 1 = 1")
+			jwt.(JWT).Backend.(Postgres).DB.MustExec("delete from test_acl where 1 = 1")
 
 			jwt.Halt()
 
@@ -223,8 +191,8 @@ func TestLocalMysqlJWT(t *testing.T) {
 			So(err, ShouldBeNil)
 
 			//Empty DB
-			jwt.Mysql.DB.MustExec("delete from test_user where 1 = 1")
-			jwt.Mysql.DB.MustExec("delete from test_acl where 1 = 1")
+			jwt.(JWT).Backend.(Mysql).DB.MustExec("delete from test_user where 1 = 1")
+			jwt.(JWT).Backend.(Mysql).DB.MustExec("delete from test_acl where 1 = 1")
 
 			//Now test everything.
 
@@ -232,7 +200,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 
 			userID := int64(0)
 
-			res, iqErr := jwt.Mysql.DB.Exec(insertQuery, username, userPassHash, true)
+			res, iqErr := jwt.(JWT).Backend.(Mysql).DB.Exec(insertQuery, username, userPassHash, true)
 			So(iqErr, ShouldBeNil)
 
 			userID, idErr := res.LastInsertId()
@@ -272,7 +240,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 
 			aclID := int64(0)
 			aclQuery := "INSERT INTO test_acl(test_user_id, topic, rw) values(?, ?, ?)"
-			res, aqErr := jwt.Mysql.DB.Exec(aclQuery, userID, strictAcl, 1)
+			res, aqErr := jwt.(JWT).Backend.(Mysql).DB.Exec(aclQuery, userID, strictAcl, 1)
 			So(aqErr, ShouldBeNil)
 			aclID, aclIdErr := res.LastInsertId()
 			So(aclIdErr, ShouldBeNil)
@@ -311,7 +279,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 
 			//Now insert single level topic to check against.
 
-			_, aqErr = jwt.Mysql.DB.Exec(aclQuery, userID, singleLevelAcl, 1)
+			_, aqErr = jwt.(JWT).Backend.(Mysql).DB.Exec(aclQuery, userID, singleLevelAcl, 1)
 			So(aqErr, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a db single level wildcard, acl check should pass", func() {
@@ -321,7 +289,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 
 			//Now insert hierarchy wildcard to check against.
 
-			_, aqErr = jwt.Mysql.DB.Exec(aclQuery, userID, hierarchyAcl, 1)
+			_, aqErr = jwt.(JWT).Backend.(Mysql).DB.Exec(aclQuery, userID, hierarchyAcl, 1)
 			So(aqErr, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a hierarchy wildcard, acl check should pass", func() {
@@ -330,11 +298,12 @@ func TestLocalMysqlJWT(t *testing.T) {
 			})
 
 			//Empty db
-			jwt.Mysql.DB.MustExec("delete from test_user where 1 = 1")
-			jwt.Mysql.DB.MustExec("delete from test_acl where 1 = 1")
+			jwt.(JWT).Backend.(Mysql).DB.MustExec("delete from test_user where 1 = 1")
+			jwt.(JWT).Backend.(Mysql).DB.MustExec("delete from test_acl where 1 = 1")
 
 			Convey("Deleting superuser and acl queries should work fine", func() {
 
+				jwt := jwt.(JWT)
 				jwt.SuperuserQuery = ""
 				jwt.AclQuery = ""
 
@@ -0,0 +1,1177 @@
+// +build jwt
+
+package backends
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var username = "test"
+
+//Hash generated by the pw utility
+var userPassHash = "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+
+var jwtSecret = "some_jwt_secret"
+
+// Generate the token.
+var now = time.Now()
+var nowSecondsSinceEpoch = now.Unix()
+var expSecondsSinceEpoch int64 = nowSecondsSinceEpoch + int64(time.Hour*24/time.Second)
+
+var jwtToken = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	"iss":      "jwt-test",
+	"aud":      "jwt-test",
+	"nbf":      nowSecondsSinceEpoch,
+	"exp":      expSecondsSinceEpoch,
+	"sub":      "user",
+	"username": username,
+})
+
+var wrongJwtToken = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	"iss":      "jwt-test",
+	"aud":      "jwt-test",
+	"nbf":      nowSecondsSinceEpoch,
+	"exp":      expSecondsSinceEpoch,
+	"sub":      "user",
+	"username": "wrong_user",
+})
+
+func TestJWTKeys(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jwt-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKeyA, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKeyB, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaDer, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaDer})
+	rsaPath := filepath.Join(dir, "rsa.pem")
+	if err := ioutil.WriteFile(rsaPath, rsaPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ecJWK := func(kid string, key *ecdsa.PrivateKey) map[string]string {
+		return map[string]string{
+			"kty": "EC",
+			"kid": kid,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}
+	}
+
+	jwksPath := filepath.Join(dir, "jwks.json")
+	writeJWKS := func(keys ...map[string]string) {
+		content, err := json.Marshal(map[string]interface{}{"keys": keys})
+		So(err, ShouldBeNil)
+		So(ioutil.WriteFile(jwksPath, content, 0600), ShouldBeNil)
+	}
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"exp":      expSecondsSinceEpoch,
+			"sub":      "user",
+			"username": username,
+		})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		So(err, ShouldBeNil)
+		return signed
+	}
+
+	Convey("Given only a secret, just HMAC tokens should be accepted", t, func() {
+		keys, err := newJWTKeys(map[string]string{"jwt_secret": jwtSecret})
+		So(err, ShouldBeNil)
+		defer keys.Stop()
+
+		So(keys.Algorithms, ShouldResemble, jwtHMACAlgorithms)
+
+		claims := &Claims{}
+		_, err = keys.parse(sign(jwt.SigningMethodHS256, "", []byte(jwtSecret)), claims)
+		So(err, ShouldBeNil)
+		So(claims.Username, ShouldEqual, username)
+
+		_, err = keys.parse(sign(jwt.SigningMethodHS256, "", []byte("wrong_secret")), &Claims{})
+		So(err, ShouldNotBeNil)
+
+		_, err = keys.parse(sign(jwt.SigningMethodRS256, "", rsaKey), &Claims{})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a PEM public key, tokens signed with its private key should be accepted", t, func() {
+		keys, err := newJWTKeys(map[string]string{"jwt_public_key_file": rsaPath})
+		So(err, ShouldBeNil)
+		defer keys.Stop()
+
+		_, err = keys.parse(sign(jwt.SigningMethodRS256, "", rsaKey), &Claims{})
+		So(err, ShouldBeNil)
+
+		_, err = keys.parse(sign(jwt.SigningMethodPS384, "", rsaKey), &Claims{})
+		So(err, ShouldBeNil)
+
+		Convey("The public key should never be used as an HMAC secret", func() {
+			keys, err := newJWTKeys(map[string]string{"jwt_public_key_file": rsaPath, "jwt_alg": "RS256,HS256"})
+			So(err, ShouldBeNil)
+			defer keys.Stop()
+
+			_, err = keys.parse(sign(jwt.SigningMethodHS256, "", rsaPem), &Claims{})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Algorithms not in jwt_alg should be rejected", func() {
+			keys, err := newJWTKeys(map[string]string{"jwt_public_key_file": rsaPath, "jwt_alg": "RS512"})
+			So(err, ShouldBeNil)
+			defer keys.Stop()
+
+			_, err = keys.parse(sign(jwt.SigningMethodRS256, "", rsaKey), &Claims{})
+			So(err, ShouldNotBeNil)
+
+			_, err = keys.parse(sign(jwt.SigningMethodRS512, "", rsaKey), &Claims{})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Expired tokens should fail even with the right key", func() {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"exp": nowSecondsSinceEpoch - 60, "sub": "user"})
+			signed, err := token.SignedString(rsaKey)
+			So(err, ShouldBeNil)
+
+			_, err = keys.parse(signed, &Claims{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a JWKS file, keys should be selected by kid", t, func() {
+		writeJWKS(ecJWK("a", ecKeyA), ecJWK("b", ecKeyB))
+
+		keys, err := newJWTKeys(map[string]string{"jwt_jwks_file": jwksPath})
+		So(err, ShouldBeNil)
+		defer keys.Stop()
+
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "a", ecKeyA), &Claims{})
+		So(err, ShouldBeNil)
+
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "b", ecKeyB), &Claims{})
+		So(err, ShouldBeNil)
+
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "", ecKeyB), &Claims{})
+		So(err, ShouldBeNil)
+
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "b", ecKeyA), &Claims{})
+		So(err, ShouldNotBeNil)
+
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "c", ecKeyA), &Claims{})
+		So(err, ShouldNotBeNil)
+
+		Convey("Reloading should pick up new keys", func() {
+			writeJWKS(ecJWK("b", ecKeyB))
+			So(keys.Reload(), ShouldBeNil)
+
+			_, err = keys.parse(sign(jwt.SigningMethodES256, "a", ecKeyA), &Claims{})
+			So(err, ShouldNotBeNil)
+
+			_, err = keys.parse(sign(jwt.SigningMethodES256, "b", ecKeyB), &Claims{})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("An invalid document should keep the previous keys", func() {
+			So(ioutil.WriteFile(jwksPath, []byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AA", "y": "AA"}]}`), 0600), ShouldBeNil)
+			So(keys.Reload(), ShouldNotBeNil)
+
+			_, err = keys.parse(sign(jwt.SigningMethodES256, "a", ecKeyA), &Claims{})
+			So(err, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a JWKS url, unknown kids should trigger a refresh", t, func() {
+		served := []map[string]string{ecJWK("a", ecKeyA)}
+		fetches := 0
+
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches++
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": served})
+		}))
+		defer mockServer.Close()
+
+		keys, err := newJWTKeys(map[string]string{"jwt_jwks_url": mockServer.URL, "jwt_jwks_refresh": "0"})
+		So(err, ShouldBeNil)
+		defer keys.Stop()
+		So(fetches, ShouldEqual, 1)
+
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "a", ecKeyA), &Claims{})
+		So(err, ShouldBeNil)
+
+		served = append(served, ecJWK("b", ecKeyB))
+
+		//Refreshes are rate limited.
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "b", ecKeyB), &Claims{})
+		So(err, ShouldNotBeNil)
+		So(fetches, ShouldEqual, 1)
+
+		keys.fetchedAt = time.Now().Add(-2 * jwksMinRefresh)
+
+		_, err = keys.parse(sign(jwt.SigningMethodES256, "b", ecKeyB), &Claims{})
+		So(err, ShouldBeNil)
+		So(fetches, ShouldEqual, 2)
+	})
+
+	Convey("Given invalid options, creating keys should fail", t, func() {
+		_, err := newJWTKeys(map[string]string{})
+		So(err, ShouldNotBeNil)
+
+		_, err = newJWTKeys(map[string]string{"jwt_secret": jwtSecret, "jwt_alg": "none"})
+		So(err, ShouldNotBeNil)
+
+		_, err = newJWTKeys(map[string]string{"jwt_secret": jwtSecret, "jwt_alg": "HS999"})
+		So(err, ShouldNotBeNil)
+
+		_, err = newJWTKeys(map[string]string{"jwt_jwks_file": jwksPath, "jwt_jwks_url": "http://localhost/jwks"})
+		So(err, ShouldNotBeNil)
+
+		_, err = newJWTKeys(map[string]string{"jwt_public_key_file": filepath.Join(dir, "missing.pem")})
+		So(err, ShouldNotBeNil)
+
+		_, err = newJWTKeys(map[string]string{"jwt_secret": jwtSecret, "jwt_jwks_refresh": "soon"})
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestJWTClaims(t *testing.T) {
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "false"
+	authOpts["jwt_db"] = "none"
+	authOpts["jwt_secret"] = jwtSecret
+	authOpts["jwt_userfield"] = "Username"
+	authOpts["jwt_pub_claim"] = "mqtt.pub"
+	authOpts["jwt_sub_claim"] = "mqtt.sub"
+	authOpts["jwt_superuser_claim"] = "roles"
+	authOpts["jwt_superuser_value"] = "admin"
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["exp"] = expSecondsSinceEpoch
+		claims["username"] = username
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		So(err, ShouldBeNil)
+		return token
+	}
+
+	Convey("Given a jwt backend without a DB, users, superusers and acls should come from claims", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		token := sign(jwt.MapClaims{
+			"mqtt": map[string]interface{}{
+				"pub": []string{"devices/%u/#", "clients/%c/status"},
+				"sub": []string{"commands/%u/+", "broadcast/#"},
+			},
+			"roles": []string{"device"},
+		})
+
+		Convey("Valid tokens should authenticate and invalid ones shouldn't", func() {
+			So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+			So(jwtBackend.GetUser(token+"x", ""), ShouldBeFalse)
+
+			wrongToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": username}).SignedString([]byte("wrong_secret"))
+			So(err, ShouldBeNil)
+			So(jwtBackend.GetUser(wrongToken, ""), ShouldBeFalse)
+		})
+
+		Convey("Publishing should be checked against pub filters", func() {
+			So(jwtBackend.CheckAcl(token, "devices/test/temp", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "clients/client/status", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "devices/other/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(jwtBackend.CheckAcl(token, "commands/test/reboot", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Reading and subscribing should be checked against sub filters", func() {
+			So(jwtBackend.CheckAcl(token, "commands/test/reboot", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "commands/test/+", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "broadcast/#", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "commands/#", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+			So(jwtBackend.CheckAcl(token, "devices/test/temp", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Readwrite should need both pub and sub filters", func() {
+			both := sign(jwt.MapClaims{"mqtt": map[string]interface{}{"pub": "shared/#", "sub": "shared/#"}})
+			So(jwtBackend.CheckAcl(both, "shared/topic", "client", MOSQ_ACL_READWRITE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(token, "devices/test/temp", "client", MOSQ_ACL_READWRITE), ShouldBeFalse)
+		})
+
+		Convey("Tokens without acl claims should be denied", func() {
+			bare := sign(jwt.MapClaims{})
+			So(jwtBackend.GetUser(bare, ""), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(bare, "devices/test/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(jwtBackend.CheckAcl(bare, "commands/test/reboot", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Convey("Superusers should have the superuser value in their role claim", func() {
+			So(jwtBackend.GetSuperuser(token), ShouldBeFalse)
+			So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"roles": []string{"device", "admin"}})), ShouldBeTrue)
+			So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"roles": "admin"})), ShouldBeTrue)
+			So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"roles": map[string]interface{}{"admin": true}})), ShouldBeFalse)
+		})
+
+		Convey("Without a superuser value, a true claim should make a superuser", func() {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts["jwt_superuser_claim"] = "mqtt.superuser"
+			delete(opts, "jwt_superuser_value")
+
+			jwtBackend, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"mqtt": map[string]interface{}{"superuser": true}})), ShouldBeTrue)
+			So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"mqtt": map[string]interface{}{"superuser": "true"}})), ShouldBeFalse)
+			So(jwtBackend.GetSuperuser(token), ShouldBeFalse)
+		})
+
+		jwtBackend.Halt()
+	})
+
+}
+
+func TestJWTValidation(t *testing.T) {
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "false"
+	authOpts["jwt_db"] = "none"
+	authOpts["jwt_secret"] = jwtSecret
+	authOpts["jwt_issuer"] = "https://idp.example.com, https://other.example.com"
+	authOpts["jwt_audience"] = "mqtt"
+	authOpts["jwt_require_exp"] = "true"
+	authOpts["jwt_max_lifetime"] = "3600"
+	authOpts["jwt_leeway"] = "30"
+
+	//Time is read here rather than when the package loads, as these checks are within the leeway of it.
+	nowSeconds := time.Now().Unix()
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		So(err, ShouldBeNil)
+		return token
+	}
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "user",
+			"iss": "https://idp.example.com",
+			"aud": []string{"api", "mqtt"},
+			"iat": nowSeconds,
+			"exp": nowSeconds + 900,
+		}
+	}
+
+	Convey("Given registered claim options, tokens should be fully validated", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(jwtBackend.GetUser(sign(valid()), ""), ShouldBeTrue)
+
+		Convey("A single audience string and any accepted issuer should be accepted", func() {
+			claims := valid()
+			claims["aud"] = "mqtt"
+			claims["iss"] = "https://other.example.com"
+			So(jwtBackend.GetUser(sign(claims), ""), ShouldBeTrue)
+		})
+
+		Convey("Times within the leeway should be accepted", func() {
+			claims := valid()
+			claims["exp"] = nowSeconds - 10
+			claims["iat"] = nowSeconds - 600
+			claims["nbf"] = nowSeconds + 10
+			So(jwtBackend.GetUser(sign(claims), ""), ShouldBeTrue)
+		})
+
+		Convey("Invalid claims should be rejected", func() {
+			invalid := []jwt.MapClaims{valid(), valid(), valid(), valid(), valid(), valid(), valid(), valid(), valid()}
+			delete(invalid[0], "exp")
+			invalid[1]["exp"] = nowSeconds - 60
+			invalid[2]["nbf"] = nowSeconds + 60
+			invalid[3]["iat"] = nowSeconds + 60
+			invalid[4]["exp"] = nowSeconds + 7200
+			invalid[5]["iss"] = "https://evil.example.com"
+			delete(invalid[6], "iss")
+			invalid[7]["aud"] = []string{"api"}
+			delete(invalid[8], "aud")
+
+			for _, claims := range invalid {
+				So(jwtBackend.GetUser(sign(claims), ""), ShouldBeFalse)
+			}
+		})
+
+		Convey("Malformed audiences should be rejected", func() {
+			claims := valid()
+			claims["aud"] = []interface{}{"mqtt", 1}
+			So(jwtBackend.GetUser(sign(claims), ""), ShouldBeFalse)
+		})
+
+		jwtBackend.Halt()
+	})
+
+	Convey("Given validator options, failures should tell the reason", t, func() {
+		validator, err := newJWTValidator(map[string]string{"jwt_require_nbf": "true", "jwt_max_lifetime": "60"})
+		So(err, ShouldBeNil)
+
+		claims := &Claims{}
+		claims.ExpiresAt = nowSeconds + 30
+		So(validator.validate(claims).Error(), ShouldEqual, "missing nbf claim")
+
+		claims.NotBefore = nowSeconds
+		So(validator.validate(claims), ShouldBeNil)
+
+		claims.IssuedAt = nowSeconds - 60
+		So(validator.validate(claims).Error(), ShouldStartWith, "token lifetime 1m30s exceeds maximum 1m0s")
+
+		_, err = newJWTValidator(map[string]string{"jwt_leeway": "-1"})
+		So(err, ShouldNotBeNil)
+		_, err = newJWTValidator(map[string]string{"jwt_max_lifetime": "1h"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Without a validator, claims should be checked as jwt-go does", t, func() {
+		claims := &Claims{}
+		So(claims.Valid(), ShouldBeNil)
+		claims.ExpiresAt = nowSeconds - 1
+		So(claims.Valid(), ShouldNotBeNil)
+	})
+
+}
+
+func TestJWTTokenSource(t *testing.T) {
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "false"
+	authOpts["jwt_db"] = "none"
+	authOpts["jwt_secret"] = jwtSecret
+	authOpts["jwt_userfield"] = "Username"
+	authOpts["jwt_token_source"] = "password"
+	authOpts["jwt_pub_claim"] = "pub"
+	authOpts["jwt_superuser_claim"] = "admin"
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["exp"] = expSecondsSinceEpoch
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		So(err, ShouldBeNil)
+		return token
+	}
+
+	Convey("Given an unknown token source, NewJWT should fail", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["jwt_token_source"] = "header"
+
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given tokens as passwords, clients should be remembered with their claims", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		clients, ok := jwtBackend.(ClientAuthenticator)
+		So(ok, ShouldBeTrue)
+		So(clients.RemembersClients(), ShouldBeTrue)
+
+		token := sign(jwt.MapClaims{"username": "device", "pub": "devices/%u/#"})
+		adminToken := sign(jwt.MapClaims{"username": "admin", "admin": true})
+
+		So(clients.GetClientUser("any", token, "device-client"), ShouldBeTrue)
+		So(clients.GetClientUser("any", adminToken, "admin-client"), ShouldBeTrue)
+		So(clients.GetClientUser("any", token+"x", "other-client"), ShouldBeFalse)
+
+		Convey("Acls should be checked with the claims of each client's token", func() {
+			So(jwtBackend.CheckAcl("any", "devices/device/temp", "device-client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl("any", "devices/admin/temp", "device-client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(jwtBackend.CheckAcl("any", "devices/device/temp", "admin-client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Superusers should be told apart by client", func() {
+			So(clients.GetClientSuperuser("any", "admin-client"), ShouldBeTrue)
+			So(clients.GetClientSuperuser("any", "device-client"), ShouldBeFalse)
+			So(jwtBackend.GetSuperuser("any"), ShouldBeFalse)
+		})
+
+		Convey("Unknown clients, or known ones with another username, should be denied", func() {
+			So(jwtBackend.CheckAcl("any", "devices/device/temp", "other-client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(jwtBackend.CheckAcl("other", "devices/device/temp", "device-client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(clients.GetClientSuperuser("other", "admin-client"), ShouldBeFalse)
+		})
+
+		Convey("A client connecting again should replace what was remembered", func() {
+			So(clients.GetClientUser("any", adminToken, "device-client"), ShouldBeTrue)
+			So(clients.GetClientSuperuser("any", "device-client"), ShouldBeTrue)
+			So(jwtBackend.CheckAcl("any", "devices/device/temp", "device-client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("GetUser should check the password without remembering anything", func() {
+			So(jwtBackend.GetUser("any", token), ShouldBeTrue)
+			So(jwtBackend.GetUser(token, ""), ShouldBeFalse)
+		})
+
+		jwtBackend.Halt()
+	})
+
+	Convey("Given tokens as usernames, clients should not be remembered", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		delete(opts, "jwt_token_source")
+
+		jwtBackend, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		clients := jwtBackend.(ClientAuthenticator)
+		So(clients.RemembersClients(), ShouldBeFalse)
+
+		token := sign(jwt.MapClaims{"username": "device", "pub": "devices/%u/#"})
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+		So(jwtBackend.GetUser("any", token), ShouldBeFalse)
+		So(jwtBackend.CheckAcl(token, "devices/device/temp", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+	})
+
+	Convey("Given tokens as passwords in remote mode, the remembered token should be sent on acl checks", t, func() {
+		token := sign(jwt.MapClaims{"username": "device"})
+
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("authorization") != token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer mockServer.Close()
+
+		opts := map[string]string{
+			"jwt_remote":        "true",
+			"jwt_token_source":  "password",
+			"jwt_host":          strings.Replace(mockServer.URL, "http://", "", -1),
+			"jwt_port":          "",
+			"jwt_getuser_uri":   "/user",
+			"jwt_superuser_uri": "/superuser",
+			"jwt_aclcheck_uri":  "/acl",
+		}
+
+		jwtBackend, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		clients := jwtBackend.(ClientAuthenticator)
+		So(clients.GetClientUser("any", "wrong", "client"), ShouldBeFalse)
+		So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+
+		So(clients.GetClientUser("any", token, "client"), ShouldBeTrue)
+		So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(clients.GetClientSuperuser("any", "client"), ShouldBeTrue)
+	})
+
+	Convey("Given a backend restarted with a rotated secret, clients of the previous one should be kept", t, func() {
+		previous, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		token := sign(jwt.MapClaims{"username": "device", "pub": "devices/%u/#"})
+		So(previous.(ClientAuthenticator).GetClientUser("any", token, "device-client"), ShouldBeTrue)
+
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["jwt_secret"] = "rotated_secret"
+
+		restarted, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(restarted.CheckAcl("any", "devices/device/temp", "device-client", MOSQ_ACL_WRITE), ShouldBeFalse)
+
+		restarted.(ClientKeeper).KeepClients(previous)
+		previous.Halt()
+
+		So(restarted.CheckAcl("any", "devices/device/temp", "device-client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(restarted.(ClientAuthenticator).GetClientUser("any", token, "other-client"), ShouldBeFalse)
+
+		restarted.Halt()
+	})
+
+}
+
+func TestJWTClients(t *testing.T) {
+
+	Convey("Idle clients should be forgotten", t, func() {
+		clients := newClientStore(time.Minute)
+		clients.set("client", &rememberedClient{username: "user"})
+
+		_, ok := clients.get("client", "user")
+		So(ok, ShouldBeTrue)
+
+		clients.clients["client"].seen = time.Now().Add(-2 * time.Minute)
+		_, ok = clients.get("client", "user")
+		So(ok, ShouldBeFalse)
+		So(clients.clients, ShouldBeEmpty)
+	})
+
+	Convey("Idle clients should be swept as more connect", t, func() {
+		clients := newClientStore(time.Minute)
+		clients.set("idle", &rememberedClient{username: "user"})
+		clients.clients["idle"].seen = time.Now().Add(-2 * time.Minute)
+
+		for i := 0; i < 1024; i++ {
+			clients.set(strconv.Itoa(i), &rememberedClient{username: "user"})
+		}
+
+		_, ok := clients.clients["idle"]
+		So(ok, ShouldBeFalse)
+		So(len(clients.clients), ShouldEqual, 1024)
+		So(clients.sweepSize, ShouldBeGreaterThan, 1024)
+	})
+
+	Convey("Adopted clients should be added to those already remembered", t, func() {
+		previous := newClientStore(time.Minute)
+		previous.set("client", &rememberedClient{username: "old"})
+		previous.set("other", &rememberedClient{username: "user"})
+
+		clients := newClientStore(time.Minute)
+		clients.set("client", &rememberedClient{username: "new"})
+		clients.adopt(previous)
+
+		client, ok := clients.get("client", "new")
+		So(ok, ShouldBeTrue)
+		So(client.username, ShouldEqual, "new")
+		_, ok = clients.get("other", "user")
+		So(ok, ShouldBeTrue)
+	})
+
+}
+
+type revocationQuerier struct {
+	revoked map[string]bool
+	err     error
+	calls   int
+}
+
+func (q *revocationQuerier) QueryExists(query string, args ...interface{}) (bool, error) {
+	q.calls++
+	if q.err != nil {
+		return false, q.err
+	}
+	return q.revoked[args[0].(string)], nil
+}
+
+func TestJWTRevocation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jwt_revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	denylist := filepath.Join(dir, "revoked")
+
+	//Modification times are bumped on every write, as they may not change within the same second otherwise.
+	modTime := time.Now()
+	writeDenylist := func(ids ...string) {
+		So(ioutil.WriteFile(denylist, []byte("# revoked tokens\n"+strings.Join(ids, "\n")+"\n"), 0600), ShouldBeNil)
+		modTime = modTime.Add(time.Second)
+		So(os.Chtimes(denylist, modTime, modTime), ShouldBeNil)
+	}
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "false"
+	authOpts["jwt_db"] = "none"
+	authOpts["jwt_secret"] = jwtSecret
+	authOpts["jwt_userfield"] = "Username"
+	authOpts["jwt_pub_claim"] = "pub"
+	authOpts["jwt_revocation_file"] = denylist
+	authOpts["jwt_revocation_cache"] = "0"
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["exp"] = expSecondsSinceEpoch
+		claims["username"] = username
+		claims["pub"] = "test/#"
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		So(err, ShouldBeNil)
+		return token
+	}
+
+	Convey("Given a revocation file, revoked tokens should be denied", t, func() {
+		writeDenylist("revoked-id")
+
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		revoked := sign(jwt.MapClaims{"jti": "revoked-id"})
+		valid := sign(jwt.MapClaims{"jti": "valid-id"})
+		noJti := sign(jwt.MapClaims{})
+
+		So(jwtBackend.GetUser(revoked, ""), ShouldBeFalse)
+		So(jwtBackend.CheckAcl(revoked, "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(jwtBackend.GetUser(valid, ""), ShouldBeTrue)
+		So(jwtBackend.CheckAcl(valid, "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(jwtBackend.GetUser(noJti, ""), ShouldBeTrue)
+
+		Convey("Acl checks should bypass the acl cache, so revocations aren't hidden by cached grants", func() {
+			So(jwtBackend.(AclCacheBypasser).BypassesAclCache(), ShouldBeTrue)
+
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			delete(opts, "jwt_revocation_file")
+			unrevocable, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(unrevocable.(AclCacheBypasser).BypassesAclCache(), ShouldBeFalse)
+		})
+
+		Convey("Revocations should take effect on the next acl check", func() {
+			writeDenylist("revoked-id", "valid-id", jwtTokenId(noJti, nil))
+
+			So(jwtBackend.CheckAcl(valid, "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(jwtBackend.CheckAcl(noJti, "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Tokens remembered by client should be denied once revoked", func() {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts["jwt_token_source"] = "password"
+			opts["jwt_superuser_claim"] = "jti"
+			opts["jwt_superuser_value"] = "valid-id"
+
+			jwtBackend, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			clients := jwtBackend.(ClientAuthenticator)
+			So(clients.GetClientUser("any", revoked, "revoked-client"), ShouldBeFalse)
+			So(clients.GetClientUser("any", valid, "client"), ShouldBeTrue)
+			So(clients.GetClientSuperuser("any", "client"), ShouldBeTrue)
+			So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+
+			writeDenylist("valid-id")
+
+			So(clients.GetClientSuperuser("any", "client"), ShouldBeFalse)
+			So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("Tokens should be checked even when every topic is allowed", func() {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			delete(opts, "jwt_pub_claim")
+
+			jwtBackend, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			So(jwtBackend.CheckAcl(valid, "any/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(jwtBackend.CheckAcl(revoked, "any/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		jwtBackend.Halt()
+	})
+
+	Convey("Given a revocation query without a SQL backend, NewJWT should fail", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["jwt_revocation_query"] = "select count(*) from revoked_tokens where jti = $1"
+
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given a missing revocation file, NewJWT should fail", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["jwt_revocation_file"] = filepath.Join(dir, "missing")
+
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Query lookups should be cached", t, func() {
+		querier := &revocationQuerier{revoked: map[string]bool{"revoked-id": true}}
+		revocations := &jwtRevocations{
+			ttl:       time.Minute,
+			query:     "select count(*) from revoked_tokens where jti = $1",
+			querier:   querier,
+			lookups:   make(map[string]jwtRevocation),
+			sweepSize: 1024,
+		}
+
+		So(revocations.revoked("revoked-id"), ShouldBeTrue)
+		So(revocations.revoked("valid-id"), ShouldBeFalse)
+		So(revocations.revoked("valid-id"), ShouldBeFalse)
+		So(querier.calls, ShouldEqual, 2)
+
+		Convey("Expired lookups should be done again", func() {
+			querier.revoked["valid-id"] = true
+			revocations.lookups["valid-id"] = jwtRevocation{checked: time.Now().Add(-2 * time.Minute)}
+
+			So(revocations.revoked("valid-id"), ShouldBeTrue)
+			So(querier.calls, ShouldEqual, 3)
+		})
+
+		Convey("Failed lookups should use expired results, or deny tokens without any", func() {
+			querier.err = errors.New("connection refused")
+			revocations.lookups["valid-id"] = jwtRevocation{checked: time.Now().Add(-2 * time.Minute)}
+
+			So(revocations.revoked("valid-id"), ShouldBeFalse)
+			So(revocations.revoked("unknown-id"), ShouldBeTrue)
+		})
+
+		Convey("Reloading should drop cached lookups", func() {
+			So(revocations.Reload(), ShouldBeNil)
+			So(revocations.lookups, ShouldBeEmpty)
+		})
+	})
+
+}
+
+func TestJWTEnforceExpOnAcl(t *testing.T) {
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "false"
+	authOpts["jwt_db"] = "none"
+	authOpts["jwt_secret"] = jwtSecret
+	authOpts["jwt_userfield"] = "Username"
+	authOpts["jwt_token_source"] = "password"
+	authOpts["jwt_pub_claim"] = "pub"
+	authOpts["jwt_superuser_claim"] = "admin"
+	authOpts["jwt_enforce_exp_on_acl"] = "true"
+
+	sign := func(exp int64) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"exp":      exp,
+			"username": username,
+			"pub":      "test/#",
+			"admin":    true,
+		}).SignedString([]byte(jwtSecret))
+		So(err, ShouldBeNil)
+		return token
+	}
+
+	Convey("Given tokens remembered by client, acls should be denied once they expire", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		clients := jwtBackend.(ClientAuthenticator)
+		So(clients.GetClientUser("any", sign(expSecondsSinceEpoch), "client"), ShouldBeTrue)
+		So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(clients.GetClientSuperuser("any", "client"), ShouldBeTrue)
+
+		//Grants must not be answered by the acl cache, as they're withdrawn when tokens expire.
+		So(jwtBackend.(AclCacheBypasser).BypassesAclCache(), ShouldBeTrue)
+		expirer := jwtBackend.(ClientExpirer)
+		So(expirer.ClientExpired("any", "client"), ShouldBeFalse)
+
+		remembered, ok := jwtBackend.(JWT).clients.get("client", "any")
+		So(ok, ShouldBeTrue)
+		remembered.data.(*Claims).ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+		So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+		So(clients.GetClientSuperuser("any", "client"), ShouldBeFalse)
+
+		Convey("Expired clients should be reported so they may be disconnected", func() {
+			So(expirer.ClientExpired("any", "client"), ShouldBeTrue)
+			So(expirer.ClientExpired("any", "unknown-client"), ShouldBeFalse)
+			So(expirer.ClientExpired("other", "client"), ShouldBeFalse)
+		})
+
+		Convey("Leeway should be allowed for", func() {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts["jwt_leeway"] = "120"
+
+			jwtBackend, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			So(jwtBackend.(ClientAuthenticator).GetClientUser("any", sign(time.Now().Add(-time.Minute).Unix()), "client"), ShouldBeTrue)
+			So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		})
+
+		Convey("Without jwt_enforce_exp_on_acl, remembered tokens should keep their acls", func() {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			delete(opts, "jwt_enforce_exp_on_acl")
+
+			jwtBackend, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			So(jwtBackend.(ClientAuthenticator).GetClientUser("any", sign(expSecondsSinceEpoch), "client"), ShouldBeTrue)
+			remembered, _ := jwtBackend.(JWT).clients.get("client", "any")
+			remembered.data.(*Claims).ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+			So(jwtBackend.CheckAcl("any", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(jwtBackend.(AclCacheBypasser).BypassesAclCache(), ShouldBeFalse)
+			So(jwtBackend.(ClientExpirer).ClientExpired("any", "client"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given remote mode, acls should be denied once tokens expire without asking the API", t, func() {
+		requests := 0
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer mockServer.Close()
+
+		opts := map[string]string{
+			"jwt_remote":             "true",
+			"jwt_enforce_exp_on_acl": "true",
+			"jwt_host":               strings.Replace(mockServer.URL, "http://", "", -1),
+			"jwt_port":               "",
+			"jwt_getuser_uri":        "/user",
+			"jwt_superuser_uri":      "/superuser",
+			"jwt_aclcheck_uri":       "/acl",
+		}
+
+		jwtBackend, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		valid := sign(expSecondsSinceEpoch)
+		expired := sign(time.Now().Add(-time.Minute).Unix())
+
+		So(jwtBackend.CheckAcl(valid, "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(requests, ShouldEqual, 1)
+
+		So(jwtBackend.CheckAcl(expired, "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(jwtBackend.GetSuperuser(expired), ShouldBeFalse)
+		So(requests, ShouldEqual, 1)
+
+		So(jwtBackend.(ClientExpirer).ClientExpired(valid, "client"), ShouldBeFalse)
+		So(jwtBackend.(ClientExpirer).ClientExpired(expired, "client"), ShouldBeTrue)
+	})
+
+}
+
+func TestJWTRemotePrevalidation(t *testing.T) {
+
+	sign := func(claims jwt.MapClaims, secret string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		So(err, ShouldBeNil)
+		return token
+	}
+
+	var requests int
+	var lastParams map[string]interface{}
+	var lastForm url.Values
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		lastParams = nil
+		lastForm = nil
+		if r.Header.Get("Content-Type") == "application/json" {
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &lastParams)
+		} else {
+			r.ParseForm()
+			lastForm = r.PostForm
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	authOpts := map[string]string{
+		"jwt_remote":         "true",
+		"jwt_host":           strings.Replace(mockServer.URL, "http://", "", -1),
+		"jwt_port":           "",
+		"jwt_getuser_uri":    "/user",
+		"jwt_superuser_uri":  "/superuser",
+		"jwt_aclcheck_uri":   "/acl",
+		"jwt_prevalidate":    "true",
+		"jwt_secret":         jwtSecret,
+		"jwt_forward_claims": "sub, tenant, roles, org.id",
+	}
+
+	claims := jwt.MapClaims{
+		"exp":    expSecondsSinceEpoch,
+		"sub":    "device",
+		"tenant": "acme",
+		"roles":  []string{"device", "sensor"},
+		"org":    map[string]interface{}{"id": 42},
+	}
+
+	Convey("Given prevalidation, bad tokens should be rejected without asking the API", t, func() {
+		requests = 0
+
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(jwtBackend.GetUser("garbage", ""), ShouldBeFalse)
+		So(jwtBackend.GetUser(sign(claims, "wrong_secret"), ""), ShouldBeFalse)
+		So(jwtBackend.GetUser(sign(jwt.MapClaims{"sub": "device", "exp": time.Now().Add(-time.Minute).Unix()}, jwtSecret), ""), ShouldBeFalse)
+		So(jwtBackend.CheckAcl("garbage", "test/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(jwtBackend.GetSuperuser("garbage"), ShouldBeFalse)
+		So(requests, ShouldEqual, 0)
+
+		Convey("Valid tokens should be sent with their claims in json", func() {
+			token := sign(claims, jwtSecret)
+
+			So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+			So(requests, ShouldEqual, 1)
+			So(lastParams["sub"], ShouldEqual, "device")
+			So(lastParams["tenant"], ShouldEqual, "acme")
+			So(lastParams["roles"], ShouldResemble, []interface{}{"device", "sensor"})
+			So(lastParams["org.id"], ShouldEqual, 42)
+
+			So(jwtBackend.CheckAcl(token, "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(lastParams["topic"], ShouldEqual, "test/topic")
+			So(lastParams["tenant"], ShouldEqual, "acme")
+		})
+
+		Convey("Valid tokens should be sent with their claims as form values", func() {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts["jwt_params_mode"] = "form"
+
+			jwtBackend, err := NewJWT(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			So(jwtBackend.CheckAcl(sign(claims, jwtSecret), "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(lastForm.Get("topic"), ShouldEqual, "test/topic")
+			So(lastForm.Get("sub"), ShouldEqual, "device")
+			So(lastForm["roles"], ShouldResemble, []string{"device", "sensor"})
+			So(lastForm.Get("org.id"), ShouldEqual, "42")
+		})
+	})
+
+	Convey("Given claims to forward, NewJWT should fail without prevalidation or when they'd replace a param", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		delete(opts, "jwt_prevalidate")
+
+		_, err := NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+
+		opts["jwt_prevalidate"] = "true"
+		opts["jwt_forward_claims"] = "sub,topic"
+
+		_, err = NewJWT(opts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+}
+
+func TestJWTRemoteMutualTLS(t *testing.T) {
+
+	token, _ := jwtToken.SignedString([]byte(jwtSecret))
+
+	dir, err := ioutil.TempDir("", "jwt_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	_, certFile, keyFile := ca.issue("client")
+
+	mockServer := newMutualTLSServer(ca, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "true"
+	authOpts["jwt_params_mode"] = "json"
+	authOpts["jwt_response_mode"] = "status"
+	authOpts["jwt_host"] = strings.Replace(mockServer.URL, "https://", "", -1)
+	authOpts["jwt_port"] = ""
+	authOpts["jwt_getuser_uri"] = "/user"
+	authOpts["jwt_superuser_uri"] = "/superuser"
+	authOpts["jwt_aclcheck_uri"] = "/acl"
+	authOpts["jwt_with_tls"] = "true"
+	authOpts["jwt_verify_peer"] = "true"
+	authOpts["jwt_ca_file"] = ca.file
+
+	Convey("Given no client certificate, the server should reject the client", t, func() {
+		hb, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser(token, ""), ShouldBeFalse)
+	})
+
+	Convey("Given the CA bundle and client certificate, requests should succeed", t, func() {
+		authOpts["jwt_client_cert"] = certFile
+		authOpts["jwt_client_key"] = keyFile
+
+		hb, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser(token, ""), ShouldBeTrue)
+		So(hb.GetSuperuser(token), ShouldBeTrue)
+		So(hb.CheckAcl(token, "test/topic", "test_client", MOSQ_ACL_READ), ShouldBeTrue)
+
+		hb.Reload()
+		So(hb.GetUser(token, ""), ShouldBeTrue)
+		hb.Halt()
+	})
+
+	Convey("Given a CA bundle without verifying peers, the backend should fail", t, func() {
+		delete(authOpts, "jwt_verify_peer")
+		_, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+}
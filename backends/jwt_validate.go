@@ -0,0 +1,125 @@
+// +build jwt
+
+package backends
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//jwtValidator checks the registered claims of tokens: expiration, not before and issued at times, allowing for leeway,
+//accepted issuers and audiences, and a maximum lifetime.
+type jwtValidator struct {
+	Issuers     []string
+	Audiences   []string
+	RequireExp  bool
+	RequireNbf  bool
+	MaxLifetime time.Duration
+	Leeway      time.Duration
+}
+
+//newJWTValidator reads jwt_issuer, jwt_audience, jwt_require_exp, jwt_require_nbf, jwt_max_lifetime and jwt_leeway.
+func newJWTValidator(authOpts map[string]string) (*jwtValidator, error) {
+	validator := &jwtValidator{
+		Issuers:   splitOption(authOpts["jwt_issuer"]),
+		Audiences: splitOption(authOpts["jwt_audience"]),
+	}
+
+	if requireExp, ok := authOpts["jwt_require_exp"]; ok && requireExp == "true" {
+		validator.RequireExp = true
+	}
+
+	if requireNbf, ok := authOpts["jwt_require_nbf"]; ok && requireNbf == "true" {
+		validator.RequireNbf = true
+	}
+
+	durations := map[string]*time.Duration{
+		"jwt_max_lifetime": &validator.MaxLifetime,
+		"jwt_leeway":       &validator.Leeway,
+	}
+
+	for opt, value := range durations {
+		s, ok := authOpts[opt]
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			return nil, errors.Errorf("invalid %s %s", opt, s)
+		}
+		*value = time.Duration(seconds) * time.Second
+	}
+
+	return validator, nil
+}
+
+//validate returns an error telling why the claims are not valid, or nil if they are.
+func (v *jwtValidator) validate(claims *Claims) error {
+	now := time.Now()
+	leeway := int64(v.Leeway / time.Second)
+
+	if claims.ExpiresAt == 0 {
+		if v.RequireExp || v.MaxLifetime > 0 {
+			return errors.New("missing exp claim")
+		}
+	} else if now.Unix() > claims.ExpiresAt+leeway {
+		return errors.Errorf("token expired %s ago", now.Sub(time.Unix(claims.ExpiresAt, 0)).Round(time.Second))
+	}
+
+	if claims.NotBefore == 0 {
+		if v.RequireNbf {
+			return errors.New("missing nbf claim")
+		}
+	} else if now.Unix()+leeway < claims.NotBefore {
+		return errors.Errorf("token not valid for another %s", time.Unix(claims.NotBefore, 0).Sub(now).Round(time.Second))
+	}
+
+	if claims.IssuedAt != 0 && now.Unix()+leeway < claims.IssuedAt {
+		return errors.Errorf("token issued %s in the future", time.Unix(claims.IssuedAt, 0).Sub(now).Round(time.Second))
+	}
+
+	if v.MaxLifetime > 0 {
+		//Tokens without iat are measured from now, as that's the longest they may still be used for.
+		start := now.Unix()
+		if claims.IssuedAt != 0 {
+			start = claims.IssuedAt
+		}
+		lifetime := time.Duration(claims.ExpiresAt-start) * time.Second
+		if lifetime > v.MaxLifetime {
+			return errors.Errorf("token lifetime %s exceeds maximum %s", lifetime, v.MaxLifetime)
+		}
+	}
+
+	if len(v.Issuers) > 0 && !containsString(v.Issuers, claims.Issuer) {
+		return errors.Errorf("issuer %q not accepted", claims.Issuer)
+	}
+
+	if len(v.Audiences) > 0 {
+		accepted := false
+		for _, aud := range claims.Audiences {
+			if containsString(v.Audiences, aud) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return errors.Errorf("audience %q not accepted", claims.Audiences)
+		}
+	}
+
+	return nil
+}
+
+//splitOption splits a comma separated option, trimming spaces and skipping empty values.
+func splitOption(option string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(option, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
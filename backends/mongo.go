@@ -21,7 +21,6 @@ import (
 
 func init() {
 	RegisteredBackends["mongo"] = NewMongo
-	log.Info("mongo init")
 }
 
 type Mongo struct {
@@ -33,6 +32,7 @@ type Mongo struct {
 	UsersCollection string
 	AclsCollection  string
 	Conn            *mongo.Client
+	HashPolicy      *common.HashPolicy
 }
 
 type MongoAcl struct {
@@ -89,6 +89,12 @@ func NewMongo(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		m.AclsCollection = aclsCollection
 	}
 
+	hashPolicy, hErr := common.NewHashPolicy(authOpts)
+	if hErr != nil {
+		return m, errors.Errorf("couldn't start mongo backend. error: %s\n", hErr)
+	}
+	m.HashPolicy = hashPolicy
+
 	addr := fmt.Sprintf("mongodb://%s:%s", m.Host, m.Port)
 
 	to := 60 * time.Second
@@ -132,6 +138,10 @@ func (o Mongo) GetUser(username, password string) bool {
 	}
 
 	if common.HashCompare(password, user.PasswordHash) {
+		o.HashPolicy.Upgrade(username, password, user.PasswordHash, func(newHash string) error {
+			_, err := uc.UpdateOne(context.TODO(), bson.M{"username": username}, bson.M{"$set": bson.M{"password": newHash}})
+			return err
+		})
 		return true
 	}
 
@@ -139,6 +149,20 @@ func (o Mongo) GetUser(username, password string) bool {
 
 }
 
+//UserExists tells if there's a user document with the username.
+func (o Mongo) UserExists(username string) bool {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	count, err := uc.CountDocuments(context.TODO(), bson.M{"username": username})
+	if err != nil {
+		log.Debugf("Mongo user exists error: %s", err)
+		return false
+	}
+
+	return count > 0
+}
+
 //GetSuperuser checks that the key username:su exists and has value "true".
 func (o Mongo) GetSuperuser(username string) bool {
 
@@ -170,8 +194,10 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 		return false
 	}
 
+	accs := mongoGrantingAccs(acc)
+
 	for _, acl := range user.Acls {
-		if (acl.Acc == acc || acl.Acc == 3) && common.TopicsMatch(acl.Topic, topic) {
+		if mongoAccGrants(accs, acl.Acc) && aclTopicMatches(acl.Topic, topic, acc) {
 			return true
 		}
 	}
@@ -179,7 +205,7 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 	//Now check common acls.
 
 	ac := o.Conn.Database(o.DBName).Collection(o.AclsCollection)
-	cur, aErr := ac.Find(context.TODO(), bson.M{"acc": bson.M{"$in": []int32{acc, 3}}})
+	cur, aErr := ac.Find(context.TODO(), bson.M{"acc": bson.M{"$in": accs}})
 
 	if aErr != nil {
 		log.Debugf("Mongo check acl error: %s", err)
@@ -194,7 +220,7 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 		if err == nil {
 			aclTopic := strings.Replace(acl.Topic, "%c", clientid, -1)
 			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if common.TopicsMatch(aclTopic, topic) {
+			if aclTopicMatches(aclTopic, topic, acc) {
 				return true
 			}
 		} else {
@@ -206,6 +232,24 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//mongoGrantingAccs returns the stored accesses that grant acc. Readwrite grants anything but subscribing, which read grants too,
+//as in the files and redis backends.
+func mongoGrantingAccs(acc int32) []int32 {
+	if acc == MOSQ_ACL_SUBSCRIBE {
+		return []int32{MOSQ_ACL_SUBSCRIBE, MOSQ_ACL_READ, MOSQ_ACL_READWRITE}
+	}
+	return []int32{acc, MOSQ_ACL_READWRITE}
+}
+
+func mongoAccGrants(accs []int32, acc int32) bool {
+	for _, granting := range accs {
+		if acc == granting {
+			return true
+		}
+	}
+	return false
+}
+
 //GetName returns the backend's name
 func (o Mongo) GetName() string {
 	return "Mongo"
@@ -164,6 +164,13 @@ func TestMongo(t *testing.T) {
 			So(tt2, ShouldBeTrue)
 		})
 
+		Convey("Given a subscription attempt on read acls, acl check should pass, but not on a write only acl", func() {
+			So(mongo.CheckAcl(username, strictAcl, clientID, 4), ShouldBeTrue)
+			So(mongo.CheckAcl(username, readWriteAcl, clientID, 4), ShouldBeTrue)
+			So(mongo.CheckAcl(username, "pattern/test", clientID, 4), ShouldBeTrue)
+			So(mongo.CheckAcl(username, writeAcl, clientID, 4), ShouldBeFalse)
+		})
+
 		//Empty db
 		mongoDb.Drop(context.TODO())
 
@@ -3,6 +3,7 @@
 package backends
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
@@ -22,7 +23,6 @@ import (
 
 func init() {
 	RegisteredBackends["mysql"] = NewMysql
-	log.Info("mysql init")
 }
 
 //Mysql holds all fields of the Mysql db connection.
@@ -36,6 +36,9 @@ type Mysql struct {
 	UserQuery            string
 	SuperuserQuery       string
 	AclQuery             string
+	UpdateQuery          string
+	HashPolicy           *common.HashPolicy
+	connectCancel        context.CancelFunc
 	SSLMode              string
 	SSLCert              string
 	SSLKey               string
@@ -115,6 +118,16 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		mysql.AclQuery = aclQuery
 	}
 
+	if updateQuery, ok := authOpts["mysql_updatequery"]; ok {
+		mysql.UpdateQuery = updateQuery
+	}
+
+	hashPolicy, hErr := common.NewHashPolicy(authOpts)
+	if hErr != nil {
+		return mysql, errors.Errorf("MySql backend error: %s.\n", hErr)
+	}
+	mysql.HashPolicy = hashPolicy
+
 	if allowNativePasswords, ok := authOpts["mysql_allow_native_passwords"]; ok && allowNativePasswords == "true" {
 		mysql.AllowNativePasswords = true
 	}
@@ -195,8 +208,18 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		})
 	}
 
+	poolOpts, pErr := common.NewPoolOptions(authOpts, "mysql")
+	if pErr != nil {
+		return mysql, errors.Errorf("MySql backend error: %s.\n", pErr)
+	}
+
+	connectOpts, cErr := common.NewConnectOptions(authOpts, "mysql")
+	if cErr != nil {
+		return mysql, errors.Errorf("MySql backend error: %s.\n", cErr)
+	}
+
 	var dbErr error
-	mysql.DB, dbErr = common.OpenDatabase(msConfig.FormatDSN(), "mysql")
+	mysql.DB, mysql.connectCancel, dbErr = common.OpenDatabase(msConfig.FormatDSN(), "mysql", poolOpts, connectOpts)
 
 	if dbErr != nil {
 		return mysql, errors.Errorf("MySql backend error: couldn't open DB: %s\n", dbErr)
@@ -223,6 +246,13 @@ func (o Mysql) GetUser(username, password string) bool {
 	}
 
 	if common.HashCompare(password, pwHash.String) {
+		//Store a stronger hash if the policy requires it and there's a query to do so.
+		if o.UpdateQuery != "" {
+			o.HashPolicy.Upgrade(username, password, pwHash.String, func(newHash string) error {
+				_, err := o.DB.Exec(o.UpdateQuery, newHash, username)
+				return err
+			})
+		}
 		return true
 	}
 
@@ -230,6 +260,25 @@ func (o Mysql) GetUser(username, password string) bool {
 
 }
 
+//UserExists tells if the user query finds the user. The query may return the password hash or, as jwt_userquery does, a count,
+//in which case zero means there's no such user.
+func (o Mysql) UserExists(username string) bool {
+
+	exists, err := o.QueryExists(o.UserQuery, username)
+
+	if err != nil {
+		log.Debugf("MySql user exists error: %s\n", err)
+		return false
+	}
+
+	return exists
+}
+
+//QueryExists runs a query on the backend's database, so others may look up rows in it.
+func (o Mysql) QueryExists(query string, args ...interface{}) (bool, error) {
+	return queryExists(o.DB, query, args...)
+}
+
 //GetSuperuser checks that the username meets the superuser query.
 func (o Mysql) GetSuperuser(username string) bool {
 
@@ -278,7 +327,7 @@ func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) bool {
 	for _, acl := range acls {
 		aclTopic := strings.Replace(acl, "%c", clientid, -1)
 		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		if aclTopicMatches(aclTopic, topic, acc) {
 			return true
 		}
 	}
@@ -294,6 +343,9 @@ func (o Mysql) GetName() string {
 
 //Halt closes the mysql connection.
 func (o Mysql) Halt() {
+	if o.connectCancel != nil {
+		o.connectCancel()
+	}
 	if o.DB != nil {
 		err := o.DB.Close()
 		if err != nil {
@@ -3,6 +3,7 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -18,7 +19,6 @@ import (
 
 func init() {
 	RegisteredBackends["postgres"] = NewPostgres
-	log.Info("postgres init")
 }
 
 //Postgres holds all fields of the postgres db connection.
@@ -32,6 +32,9 @@ type Postgres struct {
 	UserQuery      string
 	SuperuserQuery string
 	AclQuery       string
+	UpdateQuery    string
+	HashPolicy     *common.HashPolicy
+	connectCancel  context.CancelFunc
 	SSLMode        string
 	SSLCert        string
 	SSLKey         string
@@ -99,6 +102,16 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Backend, error
 		postgres.AclQuery = aclQuery
 	}
 
+	if updateQuery, ok := authOpts["pg_updatequery"]; ok {
+		postgres.UpdateQuery = updateQuery
+	}
+
+	hashPolicy, hErr := common.NewHashPolicy(authOpts)
+	if hErr != nil {
+		return postgres, errors.Errorf("PG backend error: %s.\n", hErr)
+	}
+	postgres.HashPolicy = hashPolicy
+
 	checkSSL := true
 
 	if sslmode, ok := authOpts["pg_sslmode"]; ok {
@@ -141,8 +154,18 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Backend, error
 		connStr = fmt.Sprintf("%s sslmode=disable", connStr)
 	}
 
+	poolOpts, pErr := common.NewPoolOptions(authOpts, "pg")
+	if pErr != nil {
+		return postgres, errors.Errorf("PG backend error: %s.\n", pErr)
+	}
+
+	connectOpts, cErr := common.NewConnectOptions(authOpts, "pg")
+	if cErr != nil {
+		return postgres, errors.Errorf("PG backend error: %s.\n", cErr)
+	}
+
 	var dbErr error
-	postgres.DB, dbErr = common.OpenDatabase(connStr, "postgres")
+	postgres.DB, postgres.connectCancel, dbErr = common.OpenDatabase(connStr, "postgres", poolOpts, connectOpts)
 
 	if dbErr != nil {
 		return postgres, errors.Errorf("PG backend error: couldn't open DB: %s\n", dbErr)
@@ -169,6 +192,13 @@ func (o Postgres) GetUser(username, password string) bool {
 	}
 
 	if common.HashCompare(password, pwHash.String) {
+		//Store a stronger hash if the policy requires it and there's a query to do so.
+		if o.UpdateQuery != "" {
+			o.HashPolicy.Upgrade(username, password, pwHash.String, func(newHash string) error {
+				_, err := o.DB.Exec(o.UpdateQuery, newHash, username)
+				return err
+			})
+		}
 		return true
 	}
 
@@ -176,6 +206,25 @@ func (o Postgres) GetUser(username, password string) bool {
 
 }
 
+//UserExists tells if the user query finds the user. The query may return the password hash or, as jwt_userquery does, a count,
+//in which case zero means there's no such user.
+func (o Postgres) UserExists(username string) bool {
+
+	exists, err := o.QueryExists(o.UserQuery, username)
+
+	if err != nil {
+		log.Debugf("PG user exists error: %s\n", err)
+		return false
+	}
+
+	return exists
+}
+
+//QueryExists runs a query on the backend's database, so others may look up rows in it.
+func (o Postgres) QueryExists(query string, args ...interface{}) (bool, error) {
+	return queryExists(o.DB, query, args...)
+}
+
 //GetSuperuser checks that the username meets the superuser query.
 func (o Postgres) GetSuperuser(username string) bool {
 
@@ -225,7 +274,7 @@ func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) bool {
 	for _, acl := range acls {
 		aclTopic := strings.Replace(acl, "%c", clientid, -1)
 		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		if aclTopicMatches(aclTopic, topic, acc) {
 			return true
 		}
 	}
@@ -241,6 +290,9 @@ func (o Postgres) GetName() string {
 
 //Halt closes the mysql connection.
 func (o Postgres) Halt() {
+	if o.connectCancel != nil {
+		o.connectCancel()
+	}
 	if o.DB != nil {
 		err := o.DB.Close()
 		if err != nil {
@@ -3,13 +3,15 @@
 package backends
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/pkg/errors"
+
 	"github.com/iegomez/mosquitto-go-auth/common"
 
 	goredis "github.com/go-redis/redis"
@@ -17,15 +19,16 @@ import (
 
 func init() {
 	RegisteredBackends["redis"] = NewRedis
-	log.Info("redis init")
 }
 
 type Redis struct {
-	Host     string
-	Port     string
-	Password string
-	DB       int32
-	Conn     *goredis.Client
+	Host          string
+	Port          string
+	Password      string
+	DB            int32
+	Conn          *goredis.Client
+	HashPolicy    *common.HashPolicy
+	connectCancel context.CancelFunc
 }
 
 func NewRedis(authOpts map[string]string, logLevel log.Level) (Backend, error) {
@@ -57,6 +60,17 @@ func NewRedis(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		}
 	}
 
+	hashPolicy, hErr := common.NewHashPolicy(authOpts)
+	if hErr != nil {
+		return redis, errors.Errorf("Redis backend error: %s.\n", hErr)
+	}
+	redis.HashPolicy = hashPolicy
+
+	connectOpts, oErr := common.NewConnectOptions(authOpts, "redis")
+	if oErr != nil {
+		return redis, errors.Errorf("Redis backend error: %s.\n", oErr)
+	}
+
 	addr := fmt.Sprintf("%s:%s", redis.Host, redis.Port)
 
 	//Try to start redis.
@@ -66,13 +80,13 @@ func NewRedis(authOpts map[string]string, logLevel log.Level) (Backend, error) {
 		DB:       int(redis.DB),
 	})
 
-	for {
-		if _, err := goredisClient.Ping().Result(); err != nil {
-			log.Errorf("ping redis error, will retry in 2s: %s", err)
-			time.Sleep(2 * time.Second)
-		} else {
-			break
-		}
+	var cErr error
+	redis.connectCancel, cErr = common.StartConnection(connectOpts, "redis", func(ctx context.Context) error {
+		return goredisClient.WithContext(ctx).Ping().Err()
+	})
+	if cErr != nil {
+		goredisClient.Close()
+		return redis, errors.Errorf("Redis backend error: %s.\n", cErr)
 	}
 
 	redis.Conn = goredisClient
@@ -92,6 +106,9 @@ func (o Redis) GetUser(username, password string) bool {
 	}
 
 	if common.HashCompare(password, pwHash) {
+		o.HashPolicy.Upgrade(username, password, pwHash, func(newHash string) error {
+			return o.Conn.Set(username, newHash, 0).Err()
+		})
 		return true
 	}
 
@@ -99,6 +116,19 @@ func (o Redis) GetUser(username, password string) bool {
 
 }
 
+//UserExists tells if the username key exists.
+func (o Redis) UserExists(username string) bool {
+
+	count, err := o.Conn.Exists(username).Result()
+
+	if err != nil {
+		log.Debugf("Redis user exists error: %s\n", err)
+		return false
+	}
+
+	return count > 0
+}
+
 //GetSuperuser checks that the key username:su exists and has value "true".
 func (o Redis) GetSuperuser(username string) bool {
 
@@ -122,8 +152,8 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 	//We need to check if client is subscribing or publishing to get correct acls.
 
-	if acc == 1 {
-		//Subscribe
+	if acc == MOSQ_ACL_READ || acc == MOSQ_ACL_SUBSCRIBE {
+		//Read or subscribe
 
 		//Get all user read and readwrite acls.
 		urAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:racls", username)).Result()
@@ -149,16 +179,16 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 			return false
 		}
 
-		acls := make([]string, len(urAcls)+len(urwAcls), len(urAcls)+len(urwAcls))
+		acls := make([]string, 0, len(urAcls)+len(urwAcls))
 		acls = append(acls, urAcls...)
 		acls = append(acls, urwAcls...)
 
-		commonAcls := make([]string, len(rAcls)+len(rwAcls), len(rAcls)+len(rwAcls))
+		commonAcls := make([]string, 0, len(rAcls)+len(rwAcls))
 		commonAcls = append(commonAcls, rAcls...)
 		commonAcls = append(commonAcls, rwAcls...)
 
 		for _, acl := range acls {
-			if common.TopicsMatch(acl, topic) {
+			if aclTopicMatches(acl, topic, acc) {
 				return true
 			}
 		}
@@ -166,12 +196,12 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		for _, acl := range commonAcls {
 			aclTopic := strings.Replace(acl, "%c", clientid, -1)
 			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if common.TopicsMatch(aclTopic, topic) {
+			if aclTopicMatches(aclTopic, topic, acc) {
 				return true
 			}
 		}
 
-	} else if acc == 2 {
+	} else if acc == MOSQ_ACL_WRITE {
 		//Publish
 
 		//Get all user write and readwrite acls.
@@ -198,16 +228,16 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 			return false
 		}
 
-		acls := make([]string, len(uwAcls)+len(urwAcls), len(uwAcls)+len(urwAcls))
+		acls := make([]string, 0, len(uwAcls)+len(urwAcls))
 		acls = append(acls, uwAcls...)
 		acls = append(acls, urwAcls...)
 
-		commonAcls := make([]string, len(wAcls)+len(rwAcls), len(wAcls)+len(rwAcls))
+		commonAcls := make([]string, 0, len(wAcls)+len(rwAcls))
 		commonAcls = append(commonAcls, wAcls...)
 		commonAcls = append(commonAcls, rwAcls...)
 
 		for _, acl := range acls {
-			if common.TopicsMatch(acl, topic) {
+			if aclTopicMatches(acl, topic, acc) {
 				return true
 			}
 		}
@@ -215,7 +245,7 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		for _, acl := range commonAcls {
 			aclTopic := strings.Replace(acl, "%c", clientid, -1)
 			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if common.TopicsMatch(aclTopic, topic) {
+			if aclTopicMatches(aclTopic, topic, acc) {
 				return true
 			}
 		}
@@ -233,6 +263,9 @@ func (o Redis) GetName() string {
 
 //Halt terminates the connection.
 func (o Redis) Halt() {
+	if o.connectCancel != nil {
+		o.connectCancel()
+	}
 	if o.Conn != nil {
 		err := o.Conn.Close()
 		if err != nil {
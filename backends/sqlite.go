@@ -3,6 +3,7 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"strings"
 
@@ -16,8 +17,7 @@ import (
 )
 
 func init() {
-	registeredbackends["sqlite"] = NewSqlite
-	log.info("sqlite init")
+	RegisteredBackends["sqlite"] = NewSqlite
 }
 
 //Sqlite holds all fields of the sqlite db connection.
@@ -27,6 +27,9 @@ type Sqlite struct {
 	UserQuery      string
 	SuperuserQuery string
 	AclQuery       string
+	UpdateQuery    string
+	HashPolicy     *common.HashPolicy
+	connectCancel  context.CancelFunc
 }
 
 func NewSqlite(authOpts map[string]string, logLevel log.Level) (Backend, error) {
@@ -65,6 +68,16 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Backend, error)
 		sqlite.AclQuery = aclQuery
 	}
 
+	if updateQuery, ok := authOpts["sqlite_updatequery"]; ok {
+		sqlite.UpdateQuery = updateQuery
+	}
+
+	hashPolicy, hErr := common.NewHashPolicy(authOpts)
+	if hErr != nil {
+		return sqlite, errors.Errorf("Sqlite backend error: %s.\n", hErr)
+	}
+	sqlite.HashPolicy = hashPolicy
+
 	//Exit if any mandatory option is missing.
 	if !sqliteOk {
 		return sqlite, errors.Errorf("Sqlite backend error: missing options%s.\n", missingOptions)
@@ -76,8 +89,18 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Backend, error)
 		connStr = sqlite.Source
 	}
 
+	poolOpts, pErr := common.NewPoolOptions(authOpts, "sqlite")
+	if pErr != nil {
+		return sqlite, errors.Errorf("Sqlite backend error: %s.\n", pErr)
+	}
+
+	connectOpts, cErr := common.NewConnectOptions(authOpts, "sqlite")
+	if cErr != nil {
+		return sqlite, errors.Errorf("Sqlite backend error: %s.\n", cErr)
+	}
+
 	var dbErr error
-	sqlite.DB, dbErr = common.OpenDatabase(connStr, "sqlite3")
+	sqlite.DB, sqlite.connectCancel, dbErr = common.OpenDatabase(connStr, "sqlite3", poolOpts, connectOpts)
 
 	if dbErr != nil {
 		return sqlite, errors.Errorf("Sqlite backend error: couldn't open DB %s: %s\n", connStr, dbErr)
@@ -104,6 +127,13 @@ func (o Sqlite) GetUser(username, password string) bool {
 	}
 
 	if common.HashCompare(password, pwHash.String) {
+		//Store a stronger hash if the policy requires it and there's a query to do so.
+		if o.UpdateQuery != "" {
+			o.HashPolicy.Upgrade(username, password, pwHash.String, func(newHash string) error {
+				_, err := o.DB.Exec(o.UpdateQuery, newHash, username)
+				return err
+			})
+		}
 		return true
 	}
 
@@ -111,6 +141,25 @@ func (o Sqlite) GetUser(username, password string) bool {
 
 }
 
+//UserExists tells if the user query finds the user. The query may return the password hash or, as jwt_userquery does, a count,
+//in which case zero means there's no such user.
+func (o Sqlite) UserExists(username string) bool {
+
+	exists, err := o.QueryExists(o.UserQuery, username)
+
+	if err != nil {
+		log.Debugf("SQlite user exists error: %s\n", err)
+		return false
+	}
+
+	return exists
+}
+
+//QueryExists runs a query on the backend's database, so others may look up rows in it.
+func (o Sqlite) QueryExists(query string, args ...interface{}) (bool, error) {
+	return queryExists(o.DB, query, args...)
+}
+
 //GetSuperuser checks that the username meets the superuser query.
 func (o Sqlite) GetSuperuser(username string) bool {
 
@@ -159,7 +208,7 @@ func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) bool {
 	for _, acl := range acls {
 		aclTopic := strings.Replace(acl, "%c", clientid, -1)
 		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		if aclTopicMatches(aclTopic, topic, acc) {
 			return true
 		}
 	}
@@ -175,6 +224,9 @@ func (o Sqlite) GetName() string {
 
 //Halt closes the mysql connection.
 func (o Sqlite) Halt() {
+	if o.connectCancel != nil {
+		o.connectCancel()
+	}
 	if o.DB != nil {
 		err := o.DB.Close()
 		if err != nil {
@@ -1,4 +1,4 @@
-// +builf sqlite
+// +build sqlite
 
 package backends
 
@@ -62,12 +62,12 @@ func TestFileSqlite(t *testing.T) {
 		So(err, ShouldBeNil)
 
 		//Create schemas
-		sqlite.DB.MustExec(userSchema)
-		sqlite.DB.MustExec(aclSchema)
+		sqlite.(Sqlite).DB.MustExec(userSchema)
+		sqlite.(Sqlite).DB.MustExec(aclSchema)
 
 		//Empty db
-		sqlite.DB.MustExec("delete from test_user where 1 = 1")
-		sqlite.DB.MustExec("delete from test_acl where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_user where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_acl where 1 = 1")
 
 		//Insert a user to test auth
 		username := "test"
@@ -79,7 +79,7 @@ func TestFileSqlite(t *testing.T) {
 
 		userID := int64(0)
 
-		res, iqErr := sqlite.DB.Exec(insertQuery, username, userPassHash, 1)
+		res, iqErr := sqlite.(Sqlite).DB.Exec(insertQuery, username, userPassHash, 1)
 		So(iqErr, ShouldBeNil)
 
 		userID, idErr := res.LastInsertId()
@@ -119,7 +119,7 @@ func TestFileSqlite(t *testing.T) {
 
 		aclID := int64(0)
 		aclQuery := "INSERT INTO test_acl(test_user_id, topic, rw) values(?, ?, ?)"
-		res, aqErr := sqlite.DB.Exec(aclQuery, userID, strictAcl, 1)
+		res, aqErr := sqlite.(Sqlite).DB.Exec(aclQuery, userID, strictAcl, 1)
 		aclID, aclIdErr := res.LastInsertId()
 
 		So(aqErr, ShouldBeNil)
@@ -159,7 +159,7 @@ func TestFileSqlite(t *testing.T) {
 
 		//Now check against patterns.
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, userPattern, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, userPattern, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic that mentions username, acl check should pass", func() {
@@ -167,7 +167,7 @@ func TestFileSqlite(t *testing.T) {
 			So(tt1, ShouldBeTrue)
 		})
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, clientPattern, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, clientPattern, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic that mentions clientid, acl check should pass", func() {
@@ -177,7 +177,7 @@ func TestFileSqlite(t *testing.T) {
 
 		//Now insert single level topic to check against.
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, singleLevelAcl, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, singleLevelAcl, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic not strictly present that matches a db single level wildcard, acl check should pass", func() {
@@ -187,7 +187,7 @@ func TestFileSqlite(t *testing.T) {
 
 		//Now insert hierarchy wildcard to check against.
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, hierarchyAcl, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, hierarchyAcl, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic not strictly present that matches a hierarchy wildcard, acl check should pass", func() {
@@ -196,10 +196,10 @@ func TestFileSqlite(t *testing.T) {
 		})
 
 		//Empty db
-		sqlite.DB.MustExec("delete from test_user where 1 = 1")
-		sqlite.DB.MustExec("delete from test_acl where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_user where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_acl where 1 = 1")
 
-		sqlite.DB.Close()
+		sqlite.(Sqlite).DB.Close()
 
 		//Delete the DB
 		os.Remove("../test-files/sqlite_test.db")
@@ -231,12 +231,12 @@ func TestMemorySqlite(t *testing.T) {
 		So(err, ShouldBeNil)
 
 		//Create schemas
-		sqlite.DB.MustExec(userSchema)
-		sqlite.DB.MustExec(aclSchema)
+		sqlite.(Sqlite).DB.MustExec(userSchema)
+		sqlite.(Sqlite).DB.MustExec(aclSchema)
 
 		//Empty db
-		sqlite.DB.MustExec("delete from test_user where 1 = 1")
-		sqlite.DB.MustExec("delete from test_acl where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_user where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_acl where 1 = 1")
 
 		//Insert a user to test auth
 		username := "test"
@@ -248,7 +248,7 @@ func TestMemorySqlite(t *testing.T) {
 
 		userID := int64(0)
 
-		res, iqErr := sqlite.DB.Exec(insertQuery, username, userPassHash, 1)
+		res, iqErr := sqlite.(Sqlite).DB.Exec(insertQuery, username, userPassHash, 1)
 		So(iqErr, ShouldBeNil)
 
 		userID, idErr := res.LastInsertId()
@@ -288,7 +288,7 @@ func TestMemorySqlite(t *testing.T) {
 
 		aclID := int64(0)
 		aclQuery := "INSERT INTO test_acl(test_user_id, topic, rw) values(?, ?, ?)"
-		res, aqErr := sqlite.DB.Exec(aclQuery, userID, strictAcl, 1)
+		res, aqErr := sqlite.(Sqlite).DB.Exec(aclQuery, userID, strictAcl, 1)
 		aclID, aclIdErr := res.LastInsertId()
 
 		So(aqErr, ShouldBeNil)
@@ -328,7 +328,7 @@ func TestMemorySqlite(t *testing.T) {
 
 		//Now check against patterns.
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, userPattern, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, userPattern, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic that mentions username, acl check should pass", func() {
@@ -336,7 +336,7 @@ func TestMemorySqlite(t *testing.T) {
 			So(tt1, ShouldBeTrue)
 		})
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, clientPattern, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, clientPattern, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic that mentions clientid, acl check should pass", func() {
@@ -346,7 +346,7 @@ func TestMemorySqlite(t *testing.T) {
 
 		//Now insert single level topic to check against.
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, singleLevelAcl, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, singleLevelAcl, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic not strictly present that matches a db single level wildcard, acl check should pass", func() {
@@ -356,7 +356,7 @@ func TestMemorySqlite(t *testing.T) {
 
 		//Now insert hierarchy wildcard to check against.
 
-		_, aqErr = sqlite.DB.Exec(aclQuery, userID, hierarchyAcl, 1)
+		_, aqErr = sqlite.(Sqlite).DB.Exec(aclQuery, userID, hierarchyAcl, 1)
 		So(aqErr, ShouldBeNil)
 
 		Convey("Given a topic not strictly present that matches a hierarchy wildcard, acl check should pass", func() {
@@ -365,8 +365,8 @@ func TestMemorySqlite(t *testing.T) {
 		})
 
 		//Empty db
-		sqlite.DB.MustExec("delete from test_user where 1 = 1")
-		sqlite.DB.MustExec("delete from test_acl where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_user where 1 = 1")
+		sqlite.(Sqlite).DB.MustExec("delete from test_acl where 1 = 1")
 
 		sqlite.Halt()
 
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//Defaults for connecting to databases at startup. The timeout is finite, so an unreachable database can't keep the broker from starting.
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultMinBackoff     = 500 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+)
+
+//ConnectOptions control how backends wait for their database to be available.
+type ConnectOptions struct {
+	Timeout    time.Duration //Maximum time to wait for a connection. Zero waits forever.
+	MinBackoff time.Duration //Wait after the first failed attempt, doubled after each one.
+	MaxBackoff time.Duration //Maximum wait between attempts.
+	Lazy       bool          //Start in degraded mode, connecting in the background, instead of waiting.
+}
+
+//PoolOptions tune the connection pool of SQL backends. Zero values keep database/sql defaults.
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+//NewConnectOptions reads <prefix>_connect_timeout, <prefix>_connect_max_backoff (both in seconds) and <prefix>_connect_lazy.
+func NewConnectOptions(authOpts map[string]string, prefix string) (ConnectOptions, error) {
+	opts := ConnectOptions{
+		Timeout:    defaultConnectTimeout,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+	}
+
+	if err := secondsOption(authOpts, prefix+"_connect_timeout", &opts.Timeout); err != nil {
+		return opts, err
+	}
+
+	if err := secondsOption(authOpts, prefix+"_connect_max_backoff", &opts.MaxBackoff); err != nil {
+		return opts, err
+	}
+
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+
+	if lazy, ok := authOpts[prefix+"_connect_lazy"]; ok && lazy == "true" {
+		opts.Lazy = true
+	}
+
+	return opts, nil
+}
+
+//NewPoolOptions reads <prefix>_max_open_conns, <prefix>_max_idle_conns and <prefix>_conn_max_lifetime (in seconds).
+func NewPoolOptions(authOpts map[string]string, prefix string) (PoolOptions, error) {
+	var opts PoolOptions
+
+	if err := intOption(authOpts, prefix+"_max_open_conns", &opts.MaxOpenConns); err != nil {
+		return opts, err
+	}
+
+	if err := intOption(authOpts, prefix+"_max_idle_conns", &opts.MaxIdleConns); err != nil {
+		return opts, err
+	}
+
+	if err := secondsOption(authOpts, prefix+"_conn_max_lifetime", &opts.ConnMaxLifetime); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+//Connect calls ping until it succeeds, waiting between attempts with exponential backoff.
+//It gives up when ctx is done or, if set, when the timeout has passed, returning the last error.
+func Connect(ctx context.Context, opts ConnectOptions, name string, ping func(ctx context.Context) error) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	backoff := opts.MinBackoff
+
+	for {
+		err := ping(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return errors.Wrapf(err, "couldn't connect to %s", name)
+		}
+
+		log.Errorf("%s connection error, will retry in %s: %s", name, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(err, "couldn't connect to %s", name)
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
+
+//StartConnection connects as Connect does. In lazy mode it returns right away and keeps trying in the background
+//with no timeout, so the backend starts degraded, failing checks until the database is available.
+//The returned func cancels any pending attempt and should be called when the backend is halted.
+func StartConnection(opts ConnectOptions, name string, ping func(ctx context.Context) error) (context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !opts.Lazy {
+		err := Connect(ctx, opts, name, ping)
+		return cancel, err
+	}
+
+	log.Warnf("%s backend starting in degraded mode, connecting in the background", name)
+
+	opts.Timeout = 0
+
+	go func() {
+		if err := Connect(ctx, opts, name, ping); err != nil {
+			log.Warnf("stopped connecting to %s: %s", name, err)
+			return
+		}
+		log.Infof("connected to %s", name)
+	}()
+
+	return cancel, nil
+}
+
+func intOption(authOpts map[string]string, key string, value *int) error {
+	s, ok := authOpts[key]
+	if !ok {
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return errors.Errorf("invalid %s %s", key, s)
+	}
+
+	*value = n
+
+	return nil
+}
+
+func secondsOption(authOpts map[string]string, key string, value *time.Duration) error {
+	var seconds int
+
+	if _, ok := authOpts[key]; !ok {
+		return nil
+	}
+
+	if err := intOption(authOpts, key, &seconds); err != nil {
+		return err
+	}
+
+	*value = time.Duration(seconds) * time.Second
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConnect(t *testing.T) {
+
+	opts := ConnectOptions{
+		Timeout:    200 * time.Millisecond,
+		MinBackoff: 5 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	}
+
+	//failingPing fails the given number of times and then succeeds, counting attempts.
+	failingPing := func(failures int32, attempts *int32) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			if atomic.AddInt32(attempts, 1) <= failures {
+				return errors.New("connection refused")
+			}
+			return nil
+		}
+	}
+
+	Convey("Given a database that becomes available, Connect should retry until it succeeds", t, func() {
+		var attempts int32
+		err := Connect(context.Background(), opts, "test", failingPing(3, &attempts))
+		So(err, ShouldBeNil)
+		So(atomic.LoadInt32(&attempts), ShouldEqual, 4)
+	})
+
+	Convey("Given a database that never becomes available, Connect should give up after the timeout", t, func() {
+		var attempts int32
+		start := time.Now()
+		err := Connect(context.Background(), opts, "test", failingPing(1000, &attempts))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "connection refused")
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+		So(atomic.LoadInt32(&attempts), ShouldBeGreaterThan, 1)
+	})
+
+	Convey("Given a cancelled context, Connect should stop right away", t, func() {
+		var attempts int32
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := Connect(ctx, ConnectOptions{MinBackoff: time.Second, MaxBackoff: time.Second}, "test", failingPing(1000, &attempts))
+		So(err, ShouldNotBeNil)
+		So(atomic.LoadInt32(&attempts), ShouldEqual, 1)
+	})
+
+	Convey("Given lazy mode, StartConnection should return right away and connect in the background", t, func() {
+		var attempts int32
+		lazyOpts := opts
+		lazyOpts.Lazy = true
+		lazyOpts.Timeout = time.Millisecond
+
+		cancel, err := StartConnection(lazyOpts, "test", failingPing(5, &attempts))
+		So(err, ShouldBeNil)
+		defer cancel()
+
+		//The timeout doesn't apply in lazy mode, so it should keep trying until it connects.
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&attempts) < 6 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		So(atomic.LoadInt32(&attempts), ShouldEqual, 6)
+	})
+
+	Convey("Given lazy mode, cancelling should stop background attempts", t, func() {
+		var attempts int32
+		lazyOpts := opts
+		lazyOpts.Lazy = true
+
+		cancel, err := StartConnection(lazyOpts, "test", failingPing(1000, &attempts))
+		So(err, ShouldBeNil)
+		cancel()
+
+		time.Sleep(50 * time.Millisecond)
+		stopped := atomic.LoadInt32(&attempts)
+		time.Sleep(50 * time.Millisecond)
+		So(atomic.LoadInt32(&attempts), ShouldEqual, stopped)
+	})
+
+	Convey("Given connection and pool options, they should be parsed with their prefix", t, func() {
+		authOpts := map[string]string{
+			"pg_connect_timeout":     "5",
+			"pg_connect_max_backoff": "2",
+			"pg_connect_lazy":        "true",
+			"pg_max_open_conns":      "10",
+			"pg_max_idle_conns":      "2",
+			"pg_conn_max_lifetime":   "300",
+		}
+
+		connectOpts, err := NewConnectOptions(authOpts, "pg")
+		So(err, ShouldBeNil)
+		So(connectOpts.Timeout, ShouldEqual, 5*time.Second)
+		So(connectOpts.MaxBackoff, ShouldEqual, 2*time.Second)
+		So(connectOpts.Lazy, ShouldBeTrue)
+
+		poolOpts, err := NewPoolOptions(authOpts, "pg")
+		So(err, ShouldBeNil)
+		So(poolOpts.MaxOpenConns, ShouldEqual, 10)
+		So(poolOpts.MaxIdleConns, ShouldEqual, 2)
+		So(poolOpts.ConnMaxLifetime, ShouldEqual, 300*time.Second)
+
+		connectOpts, err = NewConnectOptions(map[string]string{}, "mysql")
+		So(err, ShouldBeNil)
+		So(connectOpts.Timeout, ShouldEqual, 30*time.Second)
+		So(connectOpts.Lazy, ShouldBeFalse)
+
+		_, err = NewConnectOptions(map[string]string{"pg_connect_timeout": "soon"}, "pg")
+		So(err, ShouldNotBeNil)
+		_, err = NewPoolOptions(map[string]string{"pg_max_open_conns": "-1"}, "pg")
+		So(err, ShouldNotBeNil)
+	})
+
+}
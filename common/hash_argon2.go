@@ -0,0 +1,124 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+//Defaults for argon2id hashes, stored in PHC format: $argon2id$v=19$m=<KiB>,t=<time>,p=<threads>$<salt>$<key>,
+//with salt and key encoded as unpadded base64.
+const (
+	argon2DefaultTime     = 3
+	argon2DefaultMemory   = 64 * 1024
+	argon2DefaultThreads  = 2
+	argon2DefaultSaltSize = 16
+	argon2DefaultKeyLen   = 32
+
+	//Upper bounds for parsed and generated hashes, so a malformed hash can't make a check allocate absurd amounts of memory
+	//or run for ages. Memory is in KiB, 1 GiB at most.
+	argon2MaxMemory = 1024 * 1024
+	argon2MaxTime   = 100
+	argon2MaxKeyLen = 1024
+)
+
+func init() {
+	RegisteredHashers[HashArgon2id] = Hasher{
+		Match:    func(passwordHash string) bool { return strings.HasPrefix(passwordHash, "$argon2id$") },
+		Parse:    parseArgon2id,
+		Verify:   verifyArgon2id,
+		Generate: generateArgon2id,
+	}
+}
+
+func parseArgon2id(passwordHash string) (*HashParams, error) {
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 6 {
+		return nil, errors.Errorf("expected 6 fields, got %d", len(hashSplit))
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(hashSplit[2], "v=%d", &version); err != nil {
+		return nil, errors.Errorf("invalid version %s", hashSplit[2])
+	}
+	if version != argon2.Version {
+		return nil, errors.Errorf("unsupported version %d", version)
+	}
+
+	var memory, time, threads int
+	if _, err := fmt.Sscanf(hashSplit[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return nil, errors.Errorf("invalid parameters %s", hashSplit[3])
+	}
+	if memory <= 0 || memory > argon2MaxMemory || time <= 0 || time > argon2MaxTime || threads <= 0 || threads > 255 {
+		return nil, errors.Errorf("invalid parameters %s", hashSplit[3])
+	}
+
+	salt, err := decodeBase64(base64.RawStdEncoding, hashSplit[4], "salt")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := decodeBase64(base64.RawStdEncoding, hashSplit[5], "key")
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > argon2MaxKeyLen {
+		return nil, errors.Errorf("key can't exceed %d bytes, got %d", argon2MaxKeyLen, len(key))
+	}
+
+	return &HashParams{
+		Iterations:  time,
+		Memory:      memory,
+		Parallelism: threads,
+		Salt:        salt,
+		Key:         key,
+	}, nil
+}
+
+func verifyArgon2id(password string, params *HashParams) (bool, error) {
+	key := argon2.IDKey([]byte(password), params.Salt, uint32(params.Iterations), uint32(params.Memory), uint8(params.Parallelism), uint32(len(params.Key)))
+	return keysEqual(key, params.Key), nil
+}
+
+func generateArgon2id(password string, opts HashOptions) (string, error) {
+	if opts.Iterations == 0 {
+		opts.Iterations = argon2DefaultTime
+	}
+	if opts.Memory == 0 {
+		opts.Memory = argon2DefaultMemory
+	}
+	if opts.Parallelism == 0 {
+		opts.Parallelism = argon2DefaultThreads
+	}
+	if opts.SaltSize == 0 {
+		opts.SaltSize = argon2DefaultSaltSize
+	}
+	if opts.KeyLen == 0 {
+		opts.KeyLen = argon2DefaultKeyLen
+	}
+	if opts.Parallelism > 255 {
+		return "", errors.Errorf("argon2id parallelism can't exceed 255, got %d", opts.Parallelism)
+	}
+	if opts.Memory > argon2MaxMemory {
+		return "", errors.Errorf("argon2id memory can't exceed %d KiB, got %d", argon2MaxMemory, opts.Memory)
+	}
+	if opts.Iterations > argon2MaxTime {
+		return "", errors.Errorf("argon2id time can't exceed %d, got %d", argon2MaxTime, opts.Iterations)
+	}
+	if opts.KeyLen > argon2MaxKeyLen {
+		return "", errors.Errorf("argon2id key length can't exceed %d bytes, got %d", argon2MaxKeyLen, opts.KeyLen)
+	}
+
+	salt, err := randomSalt(opts.SaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, uint32(opts.Iterations), uint32(opts.Memory), uint8(opts.Parallelism), uint32(opts.KeyLen))
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, opts.Memory, opts.Iterations, opts.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
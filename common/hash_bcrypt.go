@@ -0,0 +1,58 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	RegisteredHashers[HashBcrypt] = Hasher{
+		Match: func(passwordHash string) bool {
+			return strings.HasPrefix(passwordHash, "$2a$") || strings.HasPrefix(passwordHash, "$2b$") || strings.HasPrefix(passwordHash, "$2y$")
+		},
+		Parse:    parseBcrypt,
+		Verify:   verifyBcrypt,
+		Generate: generateBcrypt,
+	}
+}
+
+//parseBcrypt only extracts the cost, as bcrypt verifies against the whole stored hash.
+func parseBcrypt(passwordHash string) (*HashParams, error) {
+	//Salt and key take exactly 53 characters after the version and cost, e.g. $2a$10$.
+	if len(passwordHash) != 60 {
+		return nil, errors.Errorf("expected 60 characters, got %d", len(passwordHash))
+	}
+
+	cost, err := bcrypt.Cost([]byte(passwordHash))
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashParams{
+		Iterations: cost,
+	}, nil
+}
+
+func verifyBcrypt(password string, params *HashParams) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(params.Hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func generateBcrypt(password string, opts HashOptions) (string, error) {
+	if opts.Iterations == 0 {
+		opts.Iterations = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), opts.Iterations)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//Calibration rounds. Each one measures hashing with the current parameters and scales the cost towards the target.
+//Costs are capped to what parsing accepts, so a long target can't make hashing use more than 1 GiB or produce unusable hashes.
+const (
+	calibrateRounds    = 8
+	calibrateSamples   = 3
+	calibrateMargin    = 0.05
+	calibrateMaxMemory = argon2MaxMemory //KiB
+	calibrateMaxN      = 1 << 20         //1 GiB with the default r
+)
+
+//costKnob is the parameter calibration scales for an algorithm. Time grows linearly with linear knobs, such as iterations,
+//and doubles with each step of logarithmic ones, such as bcrypt cost. Scrypt N is linear, but must be a power of two.
+type costKnob struct {
+	value      *int
+	min        int
+	max        int
+	round      int
+	linear     bool
+	powerOfTwo bool
+}
+
+//CalibrateHash scales the cost of opts so hashing takes about target on this machine, returning the resulting options,
+//with every default resolved, and how long hashing took with them. PBKDF2 and mosquitto7 iterations, bcrypt cost and scrypt N
+//are scaled. For argon2id, memory is scaled, or time when memory is given in opts. Mosquitto6 hashes have no cost to scale.
+func CalibrateHash(opts HashOptions, target time.Duration) (HashOptions, time.Duration, error) {
+	if target <= 0 {
+		return opts, 0, errors.Errorf("invalid target %s", target)
+	}
+
+	scaleTime := opts.Algorithm == HashArgon2id && opts.Memory != 0
+
+	//Generating a sample hash validates the options and resolves the algorithm defaults.
+	sample, err := GenerateHash("", opts)
+	if err != nil {
+		return opts, 0, err
+	}
+
+	params, err := ParseHash(sample)
+	if err != nil {
+		return opts, 0, err
+	}
+
+	opts.Function = params.Function
+	opts.Iterations = params.Iterations
+	opts.Memory = params.Memory
+	opts.Parallelism = params.Parallelism
+	opts.BlockSize = params.BlockSize
+
+	var knob costKnob
+
+	switch {
+	case opts.Algorithm == HashPBKDF2 || opts.Algorithm == HashMosquitto7:
+		knob = costKnob{value: &opts.Iterations, min: 1, max: pbkdf2MaxIterations, round: 1000, linear: true}
+	case opts.Algorithm == HashArgon2id && scaleTime:
+		knob = costKnob{value: &opts.Iterations, min: 1, max: argon2MaxTime, round: 1, linear: true}
+	case opts.Algorithm == HashArgon2id:
+		knob = costKnob{value: &opts.Memory, min: 8 * opts.Parallelism, max: calibrateMaxMemory, round: 1024, linear: true}
+	case opts.Algorithm == HashBcrypt:
+		knob = costKnob{value: &opts.Iterations, min: 4, max: 31}
+	case opts.Algorithm == HashScrypt:
+		//Bigger blocks leave room for a smaller N within the memory cap.
+		maxN := calibrateMaxN
+		for maxN > 2 && checkScryptMemory(maxN, opts.BlockSize) != nil {
+			maxN >>= 1
+		}
+		knob = costKnob{value: &opts.Iterations, min: 2, max: maxN, powerOfTwo: true}
+	default:
+		return opts, 0, errors.Errorf("%s hashes have no cost parameter to calibrate", opts.Algorithm)
+	}
+
+	for i := 0; ; i++ {
+		elapsed, err := timeHash(opts)
+		if err != nil {
+			return opts, 0, err
+		}
+
+		ratio := float64(target) / float64(elapsed)
+		if i == calibrateRounds || math.Abs(ratio-1) <= calibrateMargin {
+			return opts, elapsed, nil
+		}
+
+		next := knob.scale(ratio)
+		if next == *knob.value {
+			return opts, elapsed, nil
+		}
+		*knob.value = next
+	}
+}
+
+//scale returns the knob's value multiplied by ratio, rounded and clamped to its limits.
+func (k costKnob) scale(ratio float64) int {
+	current := float64(*k.value)
+
+	var next float64
+	switch {
+	case k.linear:
+		next = current * ratio
+		//Small values are only rounded to integers, as rounding them to k.round could take them to zero.
+		if next >= float64(10*k.round) {
+			next = math.Round(next/float64(k.round)) * float64(k.round)
+		}
+		next = math.Round(next)
+	case k.powerOfTwo:
+		next = current * math.Pow(2, math.Round(math.Log2(ratio)))
+	default:
+		next = current + math.Round(math.Log2(ratio))
+	}
+
+	if next < float64(k.min) {
+		return k.min
+	}
+	if next > float64(k.max) {
+		return k.max
+	}
+	return int(next)
+}
+
+//timeHash returns the shortest of a few hashing runs with opts, as the others are slowed down by unrelated work.
+func timeHash(opts HashOptions) (time.Duration, error) {
+	best := time.Duration(math.MaxInt64)
+	for i := 0; i < calibrateSamples; i++ {
+		start := time.Now()
+		if _, err := GenerateHash("calibrate", opts); err != nil {
+			return 0, err
+		}
+		if elapsed := time.Since(start); elapsed < best {
+			best = elapsed
+		}
+	}
+	if best <= 0 {
+		best = time.Nanosecond
+	}
+	return best, nil
+}
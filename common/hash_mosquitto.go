@@ -0,0 +1,132 @@
+package common
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//Hashes generated by mosquitto_passwd: $6$<salt>$<key> is a single sha512 of password and salt,
+//and $7$<iterations>$<salt>$<key>, used since mosquitto 2.0, is PBKDF2 with sha512. Both use padded base64.
+const (
+	mosquittoSaltSize           = 12
+	mosquitto7DefaultIterations = 101
+)
+
+func init() {
+	RegisteredHashers[HashMosquitto6] = Hasher{
+		Match:    func(passwordHash string) bool { return strings.HasPrefix(passwordHash, "$6$") },
+		Parse:    parseMosquitto6,
+		Verify:   verifyMosquitto6,
+		Generate: generateMosquitto6,
+	}
+	RegisteredHashers[HashMosquitto7] = Hasher{
+		Match:    func(passwordHash string) bool { return strings.HasPrefix(passwordHash, "$7$") },
+		Parse:    parseMosquitto7,
+		Verify:   verifyMosquitto7,
+		Generate: generateMosquitto7,
+	}
+}
+
+func parseMosquitto6(passwordHash string) (*HashParams, error) {
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 4 {
+		return nil, errors.Errorf("expected 4 fields, got %d", len(hashSplit))
+	}
+
+	salt, err := decodeBase64(base64.StdEncoding, hashSplit[2], "salt")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := decodeBase64(base64.StdEncoding, hashSplit[3], "key")
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashParams{
+		Function:   "sha512",
+		Iterations: 1,
+		Salt:       salt,
+		Key:        key,
+	}, nil
+}
+
+func verifyMosquitto6(password string, params *HashParams) (bool, error) {
+	sum := sha512.Sum512(append([]byte(password), params.Salt...))
+	return keysEqual(sum[:], params.Key), nil
+}
+
+func generateMosquitto6(password string, opts HashOptions) (string, error) {
+	if opts.SaltSize == 0 {
+		opts.SaltSize = mosquittoSaltSize
+	}
+
+	salt, err := randomSalt(opts.SaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha512.Sum512(append([]byte(password), salt...))
+
+	return fmt.Sprintf("$6$%s$%s", base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(sum[:])), nil
+}
+
+func parseMosquitto7(passwordHash string) (*HashParams, error) {
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 5 {
+		return nil, errors.Errorf("expected 5 fields, got %d", len(hashSplit))
+	}
+
+	iterations, err := parsePBKDF2Iterations(hashSplit[2])
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := decodeBase64(base64.StdEncoding, hashSplit[3], "salt")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := decodePBKDF2Key(hashSplit[4])
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashParams{
+		Function:   "sha512",
+		Iterations: iterations,
+		Salt:       salt,
+		Key:        key,
+	}, nil
+}
+
+func verifyMosquitto7(password string, params *HashParams) (bool, error) {
+	key := pbkdf2.Key([]byte(password), params.Salt, params.Iterations, len(params.Key), sha512.New)
+	return keysEqual(key, params.Key), nil
+}
+
+func generateMosquitto7(password string, opts HashOptions) (string, error) {
+	if opts.Iterations == 0 {
+		opts.Iterations = mosquitto7DefaultIterations
+	}
+	if opts.SaltSize == 0 {
+		opts.SaltSize = mosquittoSaltSize
+	}
+	if opts.Iterations > pbkdf2MaxIterations {
+		return "", errors.Errorf("mosquitto7 iterations can't exceed %d, got %d", pbkdf2MaxIterations, opts.Iterations)
+	}
+
+	salt, err := randomSalt(opts.SaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, opts.Iterations, sha512.Size, sha512.New)
+
+	return fmt.Sprintf("$7$%d$%s$%s", opts.Iterations, base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(key)), nil
+}
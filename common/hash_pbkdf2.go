@@ -0,0 +1,159 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+* PBKDF2 passwords usage taken from github.com/brocaar/lora-app-server, comments included.
+ */
+
+//Defaults for PBKDF2 hashes, stored as PBKDF2$<sha256|sha512>$<iterations>$<base64 salt>$<base64 key>.
+const (
+	pbkdf2DefaultFunction   = "sha512"
+	pbkdf2DefaultIterations = 100000
+	pbkdf2DefaultSaltSize   = 16
+
+	//Upper bounds for parsed and generated hashes, shared by mosquitto7 ones, so a malformed hash can't make a check run for ages.
+	pbkdf2MaxIterations = 10000000
+	pbkdf2MaxKeyLen     = 1024
+)
+
+func init() {
+	RegisteredHashers[HashPBKDF2] = Hasher{
+		Match:    func(passwordHash string) bool { return strings.HasPrefix(passwordHash, "PBKDF2$") },
+		Parse:    parsePBKDF2,
+		Verify:   verifyPBKDF2,
+		Generate: generatePBKDF2,
+	}
+}
+
+//pbkdf2Function returns the digest for a PBKDF2 function name.
+func pbkdf2Function(function string) (func() hash.Hash, int, error) {
+	switch function {
+	case "sha256":
+		return sha256.New, sha256.Size, nil
+	case "sha512":
+		return sha512.New, sha512.Size, nil
+	}
+	return nil, 0, errors.Errorf("unknown PBKDF2 function %s", function)
+}
+
+func parsePBKDF2(passwordHash string) (*HashParams, error) {
+	// Split the hash string into its parts.
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 5 {
+		return nil, errors.Errorf("expected 5 fields, got %d", len(hashSplit))
+	}
+
+	if _, _, err := pbkdf2Function(hashSplit[1]); err != nil {
+		return nil, err
+	}
+
+	iterations, err := parsePBKDF2Iterations(hashSplit[2])
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := decodeBase64(base64.StdEncoding, hashSplit[3], "salt")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := decodePBKDF2Key(hashSplit[4])
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashParams{
+		Function:   hashSplit[1],
+		Iterations: iterations,
+		Salt:       salt,
+		Key:        key,
+	}, nil
+}
+
+//parsePBKDF2Iterations parses the iterations of PBKDF2 and mosquitto7 hashes, checking their bounds.
+func parsePBKDF2Iterations(s string) (int, error) {
+	iterations, err := strconv.Atoi(s)
+	if err != nil || iterations <= 0 {
+		return 0, errors.Errorf("invalid iterations %s", s)
+	}
+	if iterations > pbkdf2MaxIterations {
+		return 0, errors.Errorf("iterations can't exceed %d, got %d", pbkdf2MaxIterations, iterations)
+	}
+	return iterations, nil
+}
+
+//decodePBKDF2Key decodes the key of PBKDF2 and mosquitto7 hashes, checking its length.
+func decodePBKDF2Key(s string) ([]byte, error) {
+	key, err := decodeBase64(base64.StdEncoding, s, "key")
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > pbkdf2MaxKeyLen {
+		return nil, errors.Errorf("key can't exceed %d bytes, got %d", pbkdf2MaxKeyLen, len(key))
+	}
+	return key, nil
+}
+
+func verifyPBKDF2(password string, params *HashParams) (bool, error) {
+	shaHash, _, err := pbkdf2Function(params.Function)
+	if err != nil {
+		return false, err
+	}
+	key := pbkdf2.Key([]byte(password), params.Salt, params.Iterations, len(params.Key), shaHash)
+	return keysEqual(key, params.Key), nil
+}
+
+// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
+func generatePBKDF2(password string, opts HashOptions) (string, error) {
+	if opts.Function == "" {
+		opts.Function = pbkdf2DefaultFunction
+	}
+	if opts.Iterations == 0 {
+		opts.Iterations = pbkdf2DefaultIterations
+	}
+	if opts.SaltSize == 0 {
+		opts.SaltSize = pbkdf2DefaultSaltSize
+	}
+
+	shaHash, shaSize, err := pbkdf2Function(opts.Function)
+	if err != nil {
+		return "", err
+	}
+	if opts.KeyLen == 0 {
+		opts.KeyLen = shaSize
+	}
+	if opts.Iterations > pbkdf2MaxIterations {
+		return "", errors.Errorf("PBKDF2 iterations can't exceed %d, got %d", pbkdf2MaxIterations, opts.Iterations)
+	}
+	if opts.KeyLen > pbkdf2MaxKeyLen {
+		return "", errors.Errorf("PBKDF2 key length can't exceed %d bytes, got %d", pbkdf2MaxKeyLen, opts.KeyLen)
+	}
+
+	// Generate a random salt value, 128 bits by default.
+	salt, err := randomSalt(opts.SaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate the hash.  This should be a little painful, adjust ITERATIONS
+	// if it needs performance tweeking.  Greatly depends on the hardware.
+	// NOTE: We store these details with the returned hash, so changes will not
+	// affect our ability to do password compares.
+	key := pbkdf2.Key([]byte(password), salt, opts.Iterations, opts.KeyLen, shaHash)
+
+	// Build up the parameters and hash into a single string so we can compare
+	// other string to the same hash.
+	return fmt.Sprintf("PBKDF2$%s$%d$%s$%s", opts.Function, opts.Iterations, base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(key)), nil
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+//Defaults for scrypt hashes, stored as $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<key>,
+//with salt and key encoded as unpadded base64.
+const (
+	scryptDefaultN        = 1 << 15
+	scryptDefaultR        = 8
+	scryptDefaultP        = 1
+	scryptDefaultSaltSize = 16
+	scryptDefaultKeyLen   = 32
+
+	//Upper bound for the 128*r*N bytes a hash needs, 1 GiB, so a malformed hash can't make a check allocate absurd amounts of memory.
+	scryptMaxMemory = 1 << 30
+)
+
+func init() {
+	RegisteredHashers[HashScrypt] = Hasher{
+		Match:    func(passwordHash string) bool { return strings.HasPrefix(passwordHash, "$scrypt$") },
+		Parse:    parseScrypt,
+		Verify:   verifyScrypt,
+		Generate: generateScrypt,
+	}
+}
+
+func parseScrypt(passwordHash string) (*HashParams, error) {
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 5 {
+		return nil, errors.Errorf("expected 5 fields, got %d", len(hashSplit))
+	}
+
+	var ln, r, p int
+	if _, err := fmt.Sscanf(hashSplit[2], "ln=%d,r=%d,p=%d", &ln, &r, &p); err != nil {
+		return nil, errors.Errorf("invalid parameters %s", hashSplit[2])
+	}
+	//Limits match those enforced by scrypt.Key.
+	if ln <= 0 || ln >= 31 || r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 {
+		return nil, errors.Errorf("invalid parameters %s", hashSplit[2])
+	}
+	if err := checkScryptMemory(1<<uint(ln), r); err != nil {
+		return nil, err
+	}
+
+	salt, err := decodeBase64(base64.RawStdEncoding, hashSplit[3], "salt")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := decodeBase64(base64.RawStdEncoding, hashSplit[4], "key")
+	if err != nil {
+		return nil, err
+	}
+
+	return &HashParams{
+		Iterations:  1 << uint(ln),
+		BlockSize:   r,
+		Parallelism: p,
+		Salt:        salt,
+		Key:         key,
+	}, nil
+}
+
+//checkScryptMemory fails when hashing with n and r would need more than scryptMaxMemory bytes.
+func checkScryptMemory(n, r int) error {
+	if uint64(128)*uint64(r)*uint64(n) > scryptMaxMemory {
+		return errors.Errorf("scrypt memory can't exceed %d bytes, got 128*r*N = %d", scryptMaxMemory, uint64(128)*uint64(r)*uint64(n))
+	}
+	return nil
+}
+
+func verifyScrypt(password string, params *HashParams) (bool, error) {
+	key, err := scrypt.Key([]byte(password), params.Salt, params.Iterations, params.BlockSize, params.Parallelism, len(params.Key))
+	if err != nil {
+		return false, err
+	}
+	return keysEqual(key, params.Key), nil
+}
+
+func generateScrypt(password string, opts HashOptions) (string, error) {
+	if opts.Iterations == 0 {
+		opts.Iterations = scryptDefaultN
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = scryptDefaultR
+	}
+	if opts.Parallelism == 0 {
+		opts.Parallelism = scryptDefaultP
+	}
+	if opts.SaltSize == 0 {
+		opts.SaltSize = scryptDefaultSaltSize
+	}
+	if opts.KeyLen == 0 {
+		opts.KeyLen = scryptDefaultKeyLen
+	}
+
+	//N must be a power of two, which is stored as its logarithm.
+	ln := 0
+	for n := opts.Iterations; n > 1; n >>= 1 {
+		if n&1 != 0 {
+			return "", errors.Errorf("scrypt N must be a power of 2, got %d", opts.Iterations)
+		}
+		ln++
+	}
+	if err := checkScryptMemory(opts.Iterations, opts.BlockSize); err != nil {
+		return "", err
+	}
+
+	salt, err := randomSalt(opts.SaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, opts.Iterations, opts.BlockSize, opts.Parallelism, opts.KeyLen)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", ln, opts.BlockSize, opts.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
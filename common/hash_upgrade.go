@@ -0,0 +1,135 @@
+package common
+
+import (
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//HashPolicy is the target hashing algorithm and parameters for stored passwords.
+//Hashes weaker than the target are upgraded on successful logins, when the cleartext password is known.
+type HashPolicy struct {
+	Options HashOptions
+	target  *HashParams
+}
+
+//NewHashPolicy reads the hash_upgrade_* options. It returns a nil policy, which never upgrades, when no algorithm is given.
+func NewHashPolicy(authOpts map[string]string) (*HashPolicy, error) {
+	algorithm, ok := authOpts["hash_upgrade_algorithm"]
+	if !ok || algorithm == "" {
+		return nil, nil
+	}
+
+	policy := &HashPolicy{
+		Options: HashOptions{
+			Algorithm: algorithm,
+			Function:  authOpts["hash_upgrade_function"],
+		},
+	}
+
+	intOpts := map[string]*int{
+		"hash_upgrade_iterations":  &policy.Options.Iterations,
+		"hash_upgrade_memory":      &policy.Options.Memory,
+		"hash_upgrade_parallelism": &policy.Options.Parallelism,
+		"hash_upgrade_blocksize":   &policy.Options.BlockSize,
+		"hash_upgrade_saltsize":    &policy.Options.SaltSize,
+		"hash_upgrade_keylen":      &policy.Options.KeyLen,
+	}
+
+	for opt, value := range intOpts {
+		s, ok := authOpts[opt]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid %s %s", opt, s)
+		}
+		*value = n
+	}
+
+	//Generating a sample hash validates the options and resolves the algorithm defaults to compare against.
+	sample, err := GenerateHash("", policy.Options)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid hash upgrade policy")
+	}
+
+	policy.target, err = ParseHash(sample)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid hash upgrade policy")
+	}
+
+	return policy, nil
+}
+
+//NeedsUpgrade tells if a stored hash is weaker than the target: it uses another algorithm or digest, or any of its cost
+//parameters or key length is lower than the target's while none is higher. Hashes with some higher parameter are kept,
+//as upgrading them would lower it, so stronger hashes are never downgraded.
+func (p *HashPolicy) NeedsUpgrade(params *HashParams) bool {
+	if p == nil {
+		return false
+	}
+
+	target := p.target
+
+	if params.Algorithm != target.Algorithm || params.Function != target.Function {
+		return true
+	}
+
+	stored := []int{params.Iterations, params.Memory, params.Parallelism, params.BlockSize, len(params.Key)}
+	wanted := []int{target.Iterations, target.Memory, target.Parallelism, target.BlockSize, len(target.Key)}
+
+	weaker := false
+	for i := range stored {
+		if stored[i] > wanted[i] {
+			return false
+		}
+		if stored[i] < wanted[i] {
+			weaker = true
+		}
+	}
+
+	return weaker
+}
+
+//UpgradeHash returns a new hash for password when passwordHash is weaker than the target, or an empty string otherwise.
+//The password must have been verified against passwordHash already.
+func (p *HashPolicy) UpgradeHash(password, passwordHash string) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+
+	params, err := ParseHash(passwordHash)
+	if err != nil {
+		return "", err
+	}
+
+	if !p.NeedsUpgrade(params) {
+		return "", nil
+	}
+
+	return GenerateHash(password, p.Options)
+}
+
+//Upgrade re-hashes a verified password when needed and stores it by calling update with the new hash.
+//Errors are only logged, as they shouldn't make the login that triggered the upgrade fail.
+func (p *HashPolicy) Upgrade(username, password, passwordHash string, update func(newHash string) error) {
+	newHash, err := p.UpgradeHash(password, passwordHash)
+	if err != nil {
+		log.Errorf("hash upgrade error for user %s: %s", username, err)
+		return
+	}
+
+	if newHash == "" {
+		return
+	}
+
+	if err := update(newHash); err != nil {
+		log.Errorf("hash upgrade error for user %s: couldn't store new hash: %s", username, err)
+		return
+	}
+
+	log.Infof("upgraded password hash for user %s to %s", username, p.Options.Algorithm)
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//Names of the registered hashing algorithms.
+const (
+	HashPBKDF2     = "pbkdf2"
+	HashBcrypt     = "bcrypt"
+	HashArgon2id   = "argon2id"
+	HashScrypt     = "scrypt"
+	HashMosquitto6 = "mosquitto6"
+	HashMosquitto7 = "mosquitto7"
+)
+
+//Hasher parses, verifies and generates password hashes for a single algorithm.
+type Hasher struct {
+	//Match tells if a stored hash belongs to the algorithm, usually by looking at its prefix.
+	Match func(passwordHash string) bool
+	//Parse extracts the parameters, salt and key from a stored hash, failing for malformed ones.
+	Parse func(passwordHash string) (*HashParams, error)
+	//Verify checks, in constant time, that the password hashes to the key in params.
+	Verify func(password string, params *HashParams) (bool, error)
+	//Generate hashes a password, using the algorithm defaults for zero options.
+	Generate func(password string, opts HashOptions) (string, error)
+}
+
+//HashParams holds the parameters of a stored hash. Fields not used by an algorithm are left zero.
+type HashParams struct {
+	Algorithm   string
+	Function    string //Digest of PBKDF2 based hashes, e.g. sha512.
+	Iterations  int    //PBKDF2 iterations, bcrypt cost, argon2 time or scrypt N.
+	Memory      int    //Argon2 memory in KiB.
+	Parallelism int    //Argon2 threads or scrypt p.
+	BlockSize   int    //Scrypt r.
+	Salt        []byte
+	Key         []byte
+	Hash        string //The stored hash, for algorithms that verify against it directly.
+}
+
+//HashOptions holds the parameters used to generate a hash. Zero values are replaced by the algorithm's defaults.
+type HashOptions struct {
+	Algorithm   string
+	Function    string
+	Iterations  int
+	Memory      int
+	Parallelism int
+	BlockSize   int
+	SaltSize    int
+	KeyLen      int
+}
+
+//RegisteredHashers holds the available hashing algorithms by name. Every algorithm registers itself on init.
+var RegisteredHashers = make(map[string]Hasher)
+
+//ParseHash finds the algorithm of a stored hash and returns its parameters.
+//Unknown and malformed hashes return an error.
+func ParseHash(passwordHash string) (*HashParams, error) {
+	for name, hasher := range RegisteredHashers {
+		if !hasher.Match(passwordHash) {
+			continue
+		}
+		params, err := hasher.Parse(passwordHash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed %s hash", name)
+		}
+		params.Algorithm = name
+		params.Hash = passwordHash
+		return params, nil
+	}
+	return nil, errors.New("unknown hash format")
+}
+
+//VerifyHash checks that the password hashes to the stored hash. Unknown and malformed hashes return an error.
+func VerifyHash(password, passwordHash string) (bool, error) {
+	params, err := ParseHash(passwordHash)
+	if err != nil {
+		return false, err
+	}
+	return RegisteredHashers[params.Algorithm].Verify(password, params)
+}
+
+//GenerateHash hashes a password with the algorithm and parameters given in opts.
+func GenerateHash(password string, opts HashOptions) (string, error) {
+	hasher, ok := RegisteredHashers[opts.Algorithm]
+	if !ok {
+		return "", errors.Errorf("unknown hash algorithm %s", opts.Algorithm)
+	}
+	return hasher.Generate(password, opts)
+}
+
+// Hash generates the PBKDF2 hash of a password for storage in the database.
+// NOTE: We store the details of the hashing algorithm with the hash itself,
+// making it easy to recreate the hash for password checking, even if we change
+// the default criteria here.
+// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
+func Hash(password string, saltSize int, iterations int, algorithm string) (string, error) {
+	return GenerateHash(password, HashOptions{
+		Algorithm:  HashPBKDF2,
+		Function:   algorithm,
+		Iterations: iterations,
+		SaltSize:   saltSize,
+	})
+}
+
+// HashCompare verifies that passed password hashes to the same value as the
+// passed passwordHash. Unknown or malformed hashes never match.
+func HashCompare(password string, passwordHash string) bool {
+	ok, err := VerifyHash(password, passwordHash)
+	if err != nil {
+		log.Errorf("hash compare error: %s", err)
+		return false
+	}
+	return ok
+}
+
+//randomSalt returns size random bytes.
+func randomSalt(size int) ([]byte, error) {
+	salt := make([]byte, size)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "read random bytes error")
+	}
+	return salt, nil
+}
+
+//decodeBase64 decodes s with enc, failing for empty values.
+func decodeBase64(enc *base64.Encoding, s, what string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.Errorf("empty %s", what)
+	}
+	b, err := enc.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", what)
+	}
+	return b, nil
+}
+
+//keysEqual compares two derived keys in constant time.
+func keysEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
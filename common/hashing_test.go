@@ -0,0 +1,296 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHashing(t *testing.T) {
+
+	password := "password"
+
+	Convey("Given hashes generated by other tools, they should be verified", t, func() {
+
+		//Hashes generated with python's hashlib and pw (for PBKDF2) for the password "password".
+		hashes := map[string]string{
+			HashPBKDF2:     "PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg==",
+			HashMosquitto6: "$6$MDEyMzQ1Njc4OWFi$QQ3PWSJ3IyGPP66YMDh3aUdVyS29efC2oPtFLnz5O/EXQO4dovrApaaZv32acQ3b0Lt02H8GBYcsYpkBYYcERg==",
+			HashMosquitto7: "$7$101$MDEyMzQ1Njc4OWFi$uAhjSMFrFKPND0iWyTXsxET36hDBAvu7LqiX1au82iDOT9W7IG9XGjasDAepCB3nZMPp79k+PyCilDXRAZuIVA==",
+			HashScrypt:     "$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFi$8pJi4Pc31Un/WXt9hXFLypwybjc0WWTRUB6CgXLIxJs",
+		}
+
+		for algorithm, hash := range hashes {
+			params, err := ParseHash(hash)
+			So(err, ShouldBeNil)
+			So(params.Algorithm, ShouldEqual, algorithm)
+
+			//The PBKDF2 hash is test1's from the test files, whose password is test1.
+			candidate := password
+			if algorithm == HashPBKDF2 {
+				candidate = "test1"
+			}
+
+			So(HashCompare(candidate, hash), ShouldBeTrue)
+			So(HashCompare("wrong", hash), ShouldBeFalse)
+		}
+
+	})
+
+	Convey("Given any registered algorithm, generated hashes should verify and report their parameters", t, func() {
+
+		options := []HashOptions{
+			{Algorithm: HashPBKDF2, Function: "sha256", Iterations: 1000},
+			{Algorithm: HashPBKDF2, Iterations: 1000},
+			{Algorithm: HashBcrypt, Iterations: 4},
+			{Algorithm: HashArgon2id, Iterations: 1, Memory: 1024, Parallelism: 1},
+			{Algorithm: HashScrypt, Iterations: 1024},
+			{Algorithm: HashMosquitto6},
+			{Algorithm: HashMosquitto7},
+		}
+
+		for _, opts := range options {
+			hash, err := GenerateHash(password, opts)
+			So(err, ShouldBeNil)
+
+			params, err := ParseHash(hash)
+			So(err, ShouldBeNil)
+			So(params.Algorithm, ShouldEqual, opts.Algorithm)
+			if opts.Iterations != 0 {
+				So(params.Iterations, ShouldEqual, opts.Iterations)
+			}
+
+			ok, err := VerifyHash(password, hash)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			ok, err = VerifyHash("wrong", hash)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		}
+
+		Convey("Hash should keep generating PBKDF2 hashes", func() {
+			hash, err := Hash(password, 16, 1000, "sha256")
+			So(err, ShouldBeNil)
+			params, err := ParseHash(hash)
+			So(err, ShouldBeNil)
+			So(params.Algorithm, ShouldEqual, HashPBKDF2)
+			So(params.Function, ShouldEqual, "sha256")
+		})
+
+		Convey("Unknown algorithms and invalid options should fail", func() {
+			_, err := GenerateHash(password, HashOptions{Algorithm: "md5"})
+			So(err, ShouldNotBeNil)
+			_, err = Hash(password, 16, 1000, "md5")
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashScrypt, Iterations: 1000})
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashArgon2id, Memory: argon2MaxMemory + 1})
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashArgon2id, KeyLen: argon2MaxKeyLen + 1})
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashArgon2id, Iterations: argon2MaxTime + 1})
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashScrypt, Iterations: 1 << 20, BlockSize: 16})
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashPBKDF2, Iterations: pbkdf2MaxIterations + 1})
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashPBKDF2, KeyLen: pbkdf2MaxKeyLen + 1})
+			So(err, ShouldNotBeNil)
+			_, err = GenerateHash(password, HashOptions{Algorithm: HashMosquitto7, Iterations: pbkdf2MaxIterations + 1})
+			So(err, ShouldNotBeNil)
+		})
+
+	})
+
+	Convey("Given malformed hashes, they should return errors and never match", t, func() {
+
+		malformed := []string{
+			"",
+			"plaintext",
+			"PBKDF2$sha512",
+			"PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==",
+			"PBKDF2$md5$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4",
+			"PBKDF2$sha512$-1$2WQHK5rjNN+oOT+TZAsWAw==$TDf4",
+			"PBKDF2$sha512$100000$not base64$TDf4",
+			"$6$",
+			"$6$MDEyMzQ1Njc4OWFi",
+			"$7$abc$MDEyMzQ1Njc4OWFi$uAhj",
+			"$2a$10$short",
+			"$argon2id$v=19$m=1024,t=1$c2FsdA$a2V5",
+			"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=1024,t=1,p=1000$c2FsdA$a2V5",
+			"$argon2id$v=19$m=1048577,t=1,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=1024,t=101,p=1$c2FsdA$a2V5",
+			"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$" + strings.Repeat("a2V5", 342),
+			"$scrypt$ln=40,r=8,p=1$c2FsdA$a2V5",
+			"$scrypt$ln=4,r=8,p=1$$a2V5",
+			"$scrypt$ln=30,r=8,p=1$c2FsdA$a2V5",
+			"$scrypt$ln=20,r=1024,p=1$c2FsdA$a2V5",
+			"PBKDF2$sha512$10000001$2WQHK5rjNN+oOT+TZAsWAw==$TDf4",
+			"$7$10000001$MDEyMzQ1Njc4OWFi$uAhj",
+		}
+
+		for _, hash := range malformed {
+			ok, err := VerifyHash(password, hash)
+			So(err, ShouldNotBeNil)
+			So(ok, ShouldBeFalse)
+			So(HashCompare(password, hash), ShouldBeFalse)
+		}
+
+	})
+
+	Convey("Given a hash upgrade policy, weaker hashes should be upgraded", t, func() {
+
+		Convey("Without an algorithm there should be no policy", func() {
+			policy, err := NewHashPolicy(map[string]string{})
+			So(err, ShouldBeNil)
+			So(policy, ShouldBeNil)
+
+			newHash, err := policy.UpgradeHash(password, "PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4")
+			So(err, ShouldBeNil)
+			So(newHash, ShouldBeEmpty)
+		})
+
+		Convey("Invalid options should fail", func() {
+			_, err := NewHashPolicy(map[string]string{"hash_upgrade_algorithm": "md5"})
+			So(err, ShouldNotBeNil)
+			_, err = NewHashPolicy(map[string]string{"hash_upgrade_algorithm": HashArgon2id, "hash_upgrade_memory": "lots"})
+			So(err, ShouldNotBeNil)
+		})
+
+		policy, err := NewHashPolicy(map[string]string{
+			"hash_upgrade_algorithm":  HashPBKDF2,
+			"hash_upgrade_function":   "sha512",
+			"hash_upgrade_iterations": "2000",
+		})
+		So(err, ShouldBeNil)
+
+		weaker := []HashOptions{
+			{Algorithm: HashPBKDF2, Function: "sha256", Iterations: 2000},
+			{Algorithm: HashPBKDF2, Function: "sha512", Iterations: 1000},
+			{Algorithm: HashPBKDF2, Function: "sha512", Iterations: 2000, KeyLen: 32},
+			{Algorithm: HashMosquitto7},
+			{Algorithm: HashBcrypt, Iterations: 4},
+		}
+
+		for _, opts := range weaker {
+			hash, err := GenerateHash(password, opts)
+			So(err, ShouldBeNil)
+
+			newHash, err := policy.UpgradeHash(password, hash)
+			So(err, ShouldBeNil)
+			So(newHash, ShouldStartWith, "PBKDF2$sha512$2000$")
+			So(HashCompare(password, newHash), ShouldBeTrue)
+		}
+
+		stronger := []HashOptions{
+			{Algorithm: HashPBKDF2, Function: "sha512", Iterations: 2000},
+			{Algorithm: HashPBKDF2, Function: "sha512", Iterations: 3000},
+		}
+
+		for _, opts := range stronger {
+			hash, err := GenerateHash(password, opts)
+			So(err, ShouldBeNil)
+
+			newHash, err := policy.UpgradeHash(password, hash)
+			So(err, ShouldBeNil)
+			So(newHash, ShouldBeEmpty)
+		}
+
+		Convey("Hashes with any parameter above the target should be kept", func() {
+			argon2Policy, err := NewHashPolicy(map[string]string{
+				"hash_upgrade_algorithm":   HashArgon2id,
+				"hash_upgrade_iterations":  "2",
+				"hash_upgrade_memory":      "1024",
+				"hash_upgrade_parallelism": "1",
+			})
+			So(err, ShouldBeNil)
+
+			hash, err := GenerateHash(password, HashOptions{Algorithm: HashArgon2id, Iterations: 1, Memory: 2048, Parallelism: 1})
+			So(err, ShouldBeNil)
+			newHash, err := argon2Policy.UpgradeHash(password, hash)
+			So(err, ShouldBeNil)
+			So(newHash, ShouldBeEmpty)
+
+			hash, err = GenerateHash(password, HashOptions{Algorithm: HashArgon2id, Iterations: 1, Memory: 1024, Parallelism: 1})
+			So(err, ShouldBeNil)
+			newHash, err = argon2Policy.UpgradeHash(password, hash)
+			So(err, ShouldBeNil)
+			So(newHash, ShouldStartWith, "$argon2id$v=19$m=1024,t=2,p=1$")
+		})
+
+		Convey("Upgrade should only store new hashes when needed", func() {
+			stored := ""
+			update := func(newHash string) error {
+				stored = newHash
+				return nil
+			}
+
+			hash, err := GenerateHash(password, HashOptions{Algorithm: HashPBKDF2, Iterations: 2000})
+			So(err, ShouldBeNil)
+			policy.Upgrade("test", password, hash, update)
+			So(stored, ShouldBeEmpty)
+
+			hash, err = GenerateHash(password, HashOptions{Algorithm: HashPBKDF2, Iterations: 1000})
+			So(err, ShouldBeNil)
+			policy.Upgrade("test", password, hash, update)
+			So(stored, ShouldStartWith, "PBKDF2$sha512$2000$")
+		})
+
+	})
+
+	Convey("Given a target time, hashing costs should be calibrated", t, func() {
+
+		Convey("Each algorithm's cost parameter should be scaled", func() {
+			for _, opts := range []HashOptions{
+				{Algorithm: HashPBKDF2, Iterations: 1000},
+				{Algorithm: HashMosquitto7},
+				{Algorithm: HashBcrypt, Iterations: 4},
+				{Algorithm: HashArgon2id, Iterations: 1, Memory: 1024},
+				{Algorithm: HashScrypt, Iterations: 1024},
+			} {
+				calibrated, elapsed, err := CalibrateHash(opts, 5*time.Millisecond)
+				So(err, ShouldBeNil)
+				So(elapsed, ShouldBeGreaterThan, 0)
+				So(calibrated.Algorithm, ShouldEqual, opts.Algorithm)
+				So(calibrated.Iterations, ShouldBeGreaterThan, 0)
+
+				hash, err := GenerateHash(password, calibrated)
+				So(err, ShouldBeNil)
+				So(HashCompare(password, hash), ShouldBeTrue)
+			}
+		})
+
+		Convey("Argon2id memory should be kept when given", func() {
+			calibrated, _, err := CalibrateHash(HashOptions{Algorithm: HashArgon2id, Memory: 1024}, 5*time.Millisecond)
+			So(err, ShouldBeNil)
+			So(calibrated.Memory, ShouldEqual, 1024)
+		})
+
+		Convey("Scaled values should be rounded and kept within limits", func() {
+			value := 1000
+			So(costKnob{value: &value, min: 1, max: 1 << 20, round: 1000, linear: true}.scale(123.4), ShouldEqual, 123000)
+			So(costKnob{value: &value, min: 1, max: 1 << 20, round: 1000, linear: true}.scale(0.0015), ShouldEqual, 2)
+			So(costKnob{value: &value, min: 1, max: 1 << 16, round: 1000, linear: true}.scale(1000), ShouldEqual, 1<<16)
+			n := 1024
+			So(costKnob{value: &n, min: 2, max: 1 << 20, powerOfTwo: true}.scale(3), ShouldEqual, 4096)
+			cost := 10
+			So(costKnob{value: &cost, min: 4, max: 31}.scale(0.3), ShouldEqual, 8)
+			So(costKnob{value: &cost, min: 4, max: 31}.scale(0.001), ShouldEqual, 4)
+		})
+
+		Convey("Algorithms without a cost and invalid targets should fail", func() {
+			_, _, err := CalibrateHash(HashOptions{Algorithm: HashMosquitto6}, 5*time.Millisecond)
+			So(err, ShouldNotBeNil)
+			_, _, err = CalibrateHash(HashOptions{Algorithm: HashPBKDF2}, 0)
+			So(err, ShouldNotBeNil)
+			_, _, err = CalibrateHash(HashOptions{Algorithm: "md5"}, 5*time.Millisecond)
+			So(err, ShouldNotBeNil)
+		})
+
+	})
+
+}
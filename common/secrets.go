@@ -0,0 +1,78 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//SecretOptions holds the options with credentials and the backends (or the cache) using them.
+//Any of them may be given as <option>_file, to read it from a file, or <option>_env, to read it from an environment variable.
+var SecretOptions = map[string][]string{
+	"pg_user":                       {"postgres", "jwt"},
+	"pg_password":                   {"postgres", "jwt"},
+	"mysql_user":                    {"mysql", "jwt"},
+	"mysql_password":                {"mysql", "jwt"},
+	"redis_password":                {"redis", "jwt"},
+	"mongo_username":                {"mongo", "jwt"},
+	"mongo_password":                {"mongo", "jwt"},
+	"jwt_secret":                    {"jwt"},
+	"jwt_revocation_redis_password": {"jwt"},
+	"introspection_client_secret":   {"introspection"},
+	"http_bearer_token":             {"http"},
+	"http_basic_password":           {"http"},
+	"http_api_key":                  {"http"},
+	"cache_password":                {"cache"},
+}
+
+//ResolveSecrets returns a copy of authOpts with every secret given as a file or environment variable set as a regular option.
+//Trailing new lines are removed from files. Giving more than one variant of a secret, unreadable files and unset variables are errors.
+func ResolveSecrets(authOpts map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(authOpts))
+	for k, v := range authOpts {
+		resolved[k] = v
+	}
+
+	for option := range SecretOptions {
+		path, fromFile := authOpts[option+"_file"]
+		name, fromEnv := authOpts[option+"_env"]
+		_, inline := authOpts[option]
+
+		if (inline && fromFile) || (inline && fromEnv) || (fromFile && fromEnv) {
+			return nil, errors.Errorf("only one of %s, %s_file and %s_env may be given", option, option, option)
+		}
+
+		if fromFile {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't read %s_file", option)
+			}
+			resolved[option] = strings.TrimRight(string(content), "\r\n")
+		}
+
+		if fromEnv {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return nil, errors.Errorf("%s_env variable %s is not set", option, name)
+			}
+			resolved[option] = value
+		}
+	}
+
+	return resolved, nil
+}
+
+//ChangedSecrets returns the secret options whose values differ between two sets of options, in lexical order.
+func ChangedSecrets(previous, current map[string]string) []string {
+	changed := make([]string, 0)
+	for option := range SecretOptions {
+		if previous[option] != current[option] {
+			changed = append(changed, option)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSecrets(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretPath := filepath.Join(dir, "pg_password")
+	os.Setenv("TEST_REDIS_PASSWORD", "redis secret")
+	defer os.Unsetenv("TEST_REDIS_PASSWORD")
+
+	Convey("Given secrets as files and environment variables, they should be set as regular options", t, func() {
+		So(ioutil.WriteFile(secretPath, []byte("pg secret\n"), 0600), ShouldBeNil)
+
+		authOpts := map[string]string{
+			"pg_password_file":   secretPath,
+			"redis_password_env": "TEST_REDIS_PASSWORD",
+			"mongo_password":     "mongo secret",
+			"backends":           "postgres, redis, mongo",
+		}
+
+		resolved, err := ResolveSecrets(authOpts)
+		So(err, ShouldBeNil)
+		So(resolved["pg_password"], ShouldEqual, "pg secret")
+		So(resolved["redis_password"], ShouldEqual, "redis secret")
+		So(resolved["mongo_password"], ShouldEqual, "mongo secret")
+		So(resolved["backends"], ShouldEqual, "postgres, redis, mongo")
+
+		//Given options shouldn't be modified, so they may be resolved again on reload.
+		_, ok := authOpts["pg_password"]
+		So(ok, ShouldBeFalse)
+
+		Convey("Resolving them again should report rotated secrets only", func() {
+			So(ioutil.WriteFile(secretPath, []byte("new pg secret\n"), 0600), ShouldBeNil)
+
+			rotated, err := ResolveSecrets(authOpts)
+			So(err, ShouldBeNil)
+			So(rotated["pg_password"], ShouldEqual, "new pg secret")
+			So(ChangedSecrets(resolved, rotated), ShouldResemble, []string{"pg_password"})
+			So(ChangedSecrets(rotated, rotated), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given invalid secrets, resolving them should fail", t, func() {
+		_, err := ResolveSecrets(map[string]string{"pg_password": "secret", "pg_password_file": secretPath})
+		So(err, ShouldNotBeNil)
+
+		_, err = ResolveSecrets(map[string]string{"pg_password_env": "TEST_REDIS_PASSWORD", "pg_password_file": secretPath})
+		So(err, ShouldNotBeNil)
+
+		_, err = ResolveSecrets(map[string]string{"jwt_secret_file": filepath.Join(dir, "missing")})
+		So(err, ShouldNotBeNil)
+
+		_, err = ResolveSecrets(map[string]string{"cache_password_env": "TEST_UNSET_VARIABLE"})
+		So(err, ShouldNotBeNil)
+	})
+
+}
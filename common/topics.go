@@ -0,0 +1,202 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//sharedPrefix starts MQTT 5 shared subscriptions: $share/<share name>/<filter>.
+const sharedPrefix = "$share/"
+
+//maxTopicLength is the longest topic allowed, as topics are encoded as UTF-8 strings with a 2 bytes length.
+const maxTopicLength = 65535
+
+//TopicsMatch checks if givenTopic, which may be a topic name or a subscription filter, is matched by the filter in savedTopic.
+//Following the MQTT spec, wildcards at the first level don't match topics starting with $, e.g. # doesn't match $SYS/broker/uptime.
+//Shared subscriptions are matched by their inner filter, unless savedTopic is a shared subscription too, when share names must be equal.
+//Invalid topics and filters never match.
+func TopicsMatch(savedTopic, givenTopic string) bool {
+	savedFilter, givenFilter, ok := unshare(savedTopic, givenTopic)
+	if !ok {
+		return false
+	}
+
+	return givenFilter == savedFilter || match(strings.Split(savedFilter, "/"), strings.Split(givenFilter, "/"))
+}
+
+//FilterSubsumes checks if every topic the subscription filter may match is also matched by aclFilter,
+//e.g. devices/# subsumes devices/+/status, but devices/+/status doesn't subsume devices/#.
+//Shared subscriptions, $ topics and invalid filters are handled as in TopicsMatch.
+func FilterSubsumes(aclFilter, filter string) bool {
+	aclFilter, filter, ok := unshare(aclFilter, filter)
+	if !ok {
+		return false
+	}
+
+	route := strings.Split(aclFilter, "/")
+	levels := strings.Split(filter, "/")
+
+	//A leading wildcard in the filter doesn't match $ topics either, so only a literal $ level needs a literal acl level.
+	if strings.HasPrefix(levels[0], "$") && (route[0] == "#" || route[0] == "+") {
+		return false
+	}
+
+	for i, level := range route {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(levels) {
+			return false
+		}
+
+		switch levels[i] {
+		case "#":
+			//Only # covers a multi-level wildcard, as it matches the parent level and any number of levels below.
+			return false
+		case "+":
+			if level != "+" {
+				return false
+			}
+		default:
+			if level != "+" && level != levels[i] {
+				return false
+			}
+		}
+	}
+
+	return len(route) == len(levels)
+}
+
+//FiltersOverlap checks if some topic may be matched by both filters, e.g. secret/# and # overlap, as do a/+ and +/b,
+//while a/+ and b/# don't. Shared subscriptions, $ topics and invalid filters are handled as in TopicsMatch.
+func FiltersOverlap(aclFilter, filter string) bool {
+	aclFilter, filter, ok := unshare(aclFilter, filter)
+	if !ok {
+		return false
+	}
+
+	route := strings.Split(aclFilter, "/")
+	levels := strings.Split(filter, "/")
+
+	//A leading wildcard never matches $ topics, so it can't overlap a filter starting with a literal $ level.
+	if strings.HasPrefix(route[0], "$") && (levels[0] == "#" || levels[0] == "+") ||
+		strings.HasPrefix(levels[0], "$") && (route[0] == "#" || route[0] == "+") {
+		return false
+	}
+
+	for i := 0; i < len(route) || i < len(levels); i++ {
+		//# matches the parent level too, so it overlaps any filter with the same levels before it.
+		if (i < len(route) && route[i] == "#") || (i < len(levels) && levels[i] == "#") {
+			return true
+		}
+
+		if i >= len(route) || i >= len(levels) {
+			return false
+		}
+
+		if route[i] != "+" && levels[i] != "+" && route[i] != levels[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//unshare strips share names from an acl topic and a requested topic, checking that both are valid filters.
+//An acl written as a shared subscription only applies to the same share name.
+func unshare(aclTopic, topic string) (string, string, bool) {
+	aclShare, aclFilter, err := SplitShared(aclTopic)
+	if err != nil {
+		return "", "", false
+	}
+
+	share, filter, err := SplitShared(topic)
+	if err != nil {
+		return "", "", false
+	}
+
+	if aclShare != "" && aclShare != share {
+		return "", "", false
+	}
+
+	if !ValidTopicFilter(aclFilter) || !ValidTopicFilter(filter) {
+		return "", "", false
+	}
+
+	return aclFilter, filter, true
+}
+
+//match checks topic levels against filter levels, which are already known to be valid.
+func match(route []string, topic []string) bool {
+	//Topics starting with $ are reserved for the server and can't be matched by a leading wildcard.
+	if strings.HasPrefix(topic[0], "$") && (route[0] == "#" || route[0] == "+") {
+		return false
+	}
+
+	for i, level := range route {
+		//# matches the parent level too, so sport/# matches sport.
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topic) {
+			return false
+		}
+
+		if level != "+" && level != topic[i] {
+			return false
+		}
+	}
+
+	return len(route) == len(topic)
+}
+
+//SplitShared returns the share name and inner filter of a $share/<share name>/<filter> subscription.
+//Other topics return an empty share name and the topic as is. Malformed shared subscriptions return an error.
+func SplitShared(topic string) (string, string, error) {
+	if !strings.HasPrefix(topic, sharedPrefix) {
+		return "", topic, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(topic, sharedPrefix), "/", 2)
+	if len(parts) != 2 {
+		return "", "", errors.Errorf("shared subscription %s has no filter", topic)
+	}
+
+	if parts[0] == "" || strings.ContainsAny(parts[0], "+#") {
+		return "", "", errors.Errorf("invalid share name in %s", topic)
+	}
+
+	if parts[1] == "" {
+		return "", "", errors.Errorf("shared subscription %s has no filter", topic)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+//ValidTopicName checks that topic may be published to: it can't be empty, nor contain wildcards or null characters.
+func ValidTopicName(topic string) bool {
+	return topic != "" && len(topic) <= maxTopicLength && !strings.ContainsAny(topic, "+#\x00")
+}
+
+//ValidTopicFilter checks that filter may be subscribed to: it can't be empty nor contain null characters,
+//+ must take a whole level and # must take the whole last level. Levels may be empty, e.g. sport//player1.
+func ValidTopicFilter(filter string) bool {
+	if filter == "" || len(filter) > maxTopicLength || strings.Contains(filter, "\x00") {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,212 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//Examples taken from the MQTT 3.1.1 (section 4.7) and 5.0 (sections 4.7 and 4.8.2) specs.
+func TestTopicsMatch(t *testing.T) {
+
+	Convey("Given filters and topics from the MQTT specs, they should match as the spec says", t, func() {
+
+		table := []struct {
+			filter string
+			topic  string
+			match  bool
+		}{
+			//Multi-level wildcard.
+			{"sport/tennis/player1/#", "sport/tennis/player1", true},
+			{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+			{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+			{"sport/#", "sport", true},
+			{"#", "sport/tennis/player1", true},
+			{"#", "/", true},
+
+			//Single-level wildcard.
+			{"sport/tennis/+", "sport/tennis/player1", true},
+			{"sport/tennis/+", "sport/tennis/player2", true},
+			{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+			{"sport/+", "sport", false},
+			{"sport/+", "sport/", true},
+			{"sport/+/player1", "sport/tennis/player1", true},
+			{"+/tennis/#", "sport/tennis/player1/ranking", true},
+			{"+/+", "/finance", true},
+			{"/+", "/finance", true},
+			{"+", "/finance", false},
+
+			//Topics beginning with $.
+			{"#", "$SYS/monitor/Clients", false},
+			{"+/monitor/Clients", "$SYS/monitor/Clients", false},
+			{"$SYS/#", "$SYS/monitor/Clients", true},
+			{"$SYS/#", "$SYS", true},
+			{"$SYS/monitor/+", "$SYS/monitor/Clients", true},
+			{"$SYS/+/Clients", "$SYS/monitor/Clients", true},
+
+			//Topic semantics: case sensitivity, spaces and empty levels.
+			{"ACCOUNTS", "Accounts", false},
+			{"Accounts payable", "Accounts payable", true},
+			{"sport//player1", "sport//player1", true},
+			{"sport/+/player1", "sport//player1", true},
+			{"sport/tennis", "sport/tennis/", false},
+			{"/", "/", true},
+
+			//Shared subscriptions are matched by their inner filter.
+			{"sport/tennis/+", "$share/consumer1/sport/tennis/+", true},
+			{"sport/tennis/#", "$share/consumer1/sport/tennis/player1", true},
+			{"sport/#", "$share/consumer2/other/#", false},
+			{"$share/consumer1/sport/#", "$share/consumer1/sport/tennis", true},
+			{"$share/consumer1/sport/#", "$share/consumer2/sport/tennis", false},
+			{"$share/consumer1/sport/#", "sport/tennis", false},
+
+			//Invalid filters and topics never match.
+			{"sport/tennis#", "sport/tennis#", false},
+			{"sport/tennis/#/ranking", "sport/tennis/#/ranking", false},
+			{"sport+", "sport+", false},
+			{"#", "", false},
+			{"", "", false},
+			{"#", "sport/+tennis", false},
+			{"#", "sport/\x00", false},
+			{"#", strings.Repeat("a", maxTopicLength+1), false},
+			{"#", "$share/consumer1", false},
+			{"#", "$share//sport", false},
+			{"#", "$share/consumer+/sport", false},
+			{"#", "$share/consumer1/", false},
+		}
+
+		for _, entry := range table {
+			So(TopicsMatch(entry.filter, entry.topic), ShouldEqual, entry.match)
+		}
+
+	})
+
+	Convey("Given topic names and filters, they should be validated", t, func() {
+
+		So(ValidTopicName("sport/tennis/player1"), ShouldBeTrue)
+		So(ValidTopicName("/"), ShouldBeTrue)
+		So(ValidTopicName("sport/tennis/+"), ShouldBeFalse)
+		So(ValidTopicName("sport/#"), ShouldBeFalse)
+		So(ValidTopicName(""), ShouldBeFalse)
+
+		So(ValidTopicFilter("#"), ShouldBeTrue)
+		So(ValidTopicFilter("+"), ShouldBeTrue)
+		So(ValidTopicFilter("+/tennis/#"), ShouldBeTrue)
+		So(ValidTopicFilter("sport/+/player1"), ShouldBeTrue)
+		So(ValidTopicFilter("sport/tennis#"), ShouldBeFalse)
+		So(ValidTopicFilter("sport/tennis/#/ranking"), ShouldBeFalse)
+		So(ValidTopicFilter("sport+"), ShouldBeFalse)
+
+		share, filter, err := SplitShared("$share/consumer1/sport/tennis/+")
+		So(err, ShouldBeNil)
+		So(share, ShouldEqual, "consumer1")
+		So(filter, ShouldEqual, "sport/tennis/+")
+
+		share, filter, err = SplitShared("sport/tennis/+")
+		So(err, ShouldBeNil)
+		So(share, ShouldBeEmpty)
+		So(filter, ShouldEqual, "sport/tennis/+")
+
+		_, _, err = SplitShared("$share/consumer1")
+		So(err, ShouldNotBeNil)
+
+	})
+
+	Convey("Given acl filters and subscription filters, subsumption should only hold when the acl covers every topic", t, func() {
+
+		table := []struct {
+			acl    string
+			filter string
+			match  bool
+		}{
+			{"devices/#", "devices/+/status", true},
+			{"devices/#", "devices/#", true},
+			{"devices/#", "devices", true},
+			{"devices/+/status", "devices/#", false},
+			{"devices/+/status", "devices/+/status", true},
+			{"devices/+/status", "devices/1/status", true},
+			{"devices/+/status", "devices/1/+", false},
+			{"devices/+/+", "devices/1/+", true},
+			{"devices/+/#", "devices/1/#", true},
+			{"devices/+/#", "devices/#", false},
+			{"devices/+", "devices/+/status", false},
+			{"devices/1/status", "devices/+/status", false},
+			{"#", "#", true},
+			{"#", "+/status", true},
+			{"+", "#", false},
+			{"+/#", "#", false},
+
+			//$ topics and shared subscriptions.
+			{"#", "$SYS/#", false},
+			{"+/#", "$SYS/broker/+", false},
+			{"$SYS/#", "$SYS/broker/+", true},
+			{"devices/#", "$share/group/devices/+/status", true},
+			{"$share/group/devices/#", "$share/other/devices/+/status", false},
+
+			//Invalid filters.
+			{"devices/#/status", "devices/1/status", false},
+			{"devices/#", "devices/#/status", false},
+			{"devices/#", "devices/1+", false},
+		}
+
+		for _, entry := range table {
+			So(FilterSubsumes(entry.acl, entry.filter), ShouldEqual, entry.match)
+		}
+
+		Convey("For topics without wildcards it should be the same as TopicsMatch", func() {
+			acls := []string{"#", "+", "sport/#", "sport/+", "sport/tennis", "+/tennis/#", "$SYS/#", "/+"}
+			topics := []string{"sport", "sport/tennis", "sport/tennis/player1", "/finance", "$SYS/broker", "sport/"}
+			for _, acl := range acls {
+				for _, topic := range topics {
+					So(FilterSubsumes(acl, topic), ShouldEqual, TopicsMatch(acl, topic))
+				}
+			}
+		})
+
+	})
+
+	Convey("Given two filters, they should overlap when some topic may be matched by both", t, func() {
+
+		table := []struct {
+			acl    string
+			filter string
+			match  bool
+		}{
+			{"secret/#", "#", true},
+			{"secret/#", "+/+", true},
+			{"secret/#", "secret", true},
+			{"secret/#", "public/#", false},
+			{"a/+", "+/b", true},
+			{"a/+", "b/#", false},
+			{"a/+", "a/b/c", false},
+			{"a/+/c", "a/#", true},
+			{"a/b", "a/b", true},
+			{"a/b", "a/c", false},
+			{"+", "#", true},
+			{"+/+", "+", false},
+
+			//$ topics and shared subscriptions.
+			{"$SYS/#", "#", false},
+			{"#", "$SYS/broker", false},
+			{"$SYS/#", "$SYS/+", true},
+			{"secret/#", "$share/group/#", true},
+			{"$share/group/secret/#", "$share/other/#", false},
+
+			//Invalid filters.
+			{"secret/#/a", "#", false},
+			{"secret/#", "a+", false},
+		}
+
+		for _, entry := range table {
+			So(FiltersOverlap(entry.acl, entry.filter), ShouldEqual, entry.match)
+		}
+
+		Convey("Overlapping should not depend on the order of the filters", func() {
+			So(FiltersOverlap("devices/#", "devices/+/status"), ShouldBeTrue)
+			So(FiltersOverlap("devices/+/status", "devices/#"), ShouldBeTrue)
+		})
+
+	})
+
+}
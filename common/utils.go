@@ -1,150 +1,42 @@
 package common
 
 import (
-	"bytes"
-	"crypto/rand"
-	"crypto/sha256"
-	"crypto/sha512"
-	"encoding/base64"
-	"fmt"
-	"strconv"
-	"strings"
-	"time"
-
-	log "github.com/sirupsen/logrus"
+	"context"
 
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/pbkdf2"
 
 	"github.com/jmoiron/sqlx"
 )
 
-// OpenDatabase opens the database and performs a ping to make sure the
-// database is up.
+// OpenDatabase opens the database, applies pool options and pings it to make sure the
+// database is up, retrying as set in connect. The returned func cancels background
+// connection attempts in lazy mode.
 // Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
-func OpenDatabase(dsn, engine string) (*sqlx.DB, error) {
+func OpenDatabase(dsn, engine string, pool PoolOptions, connect ConnectOptions) (*sqlx.DB, context.CancelFunc, error) {
 
 	db, err := sqlx.Open(engine, dsn)
 	if err != nil {
-		return nil, errors.Wrap(err, "database connection error")
-	}
-
-	for {
-		if err = db.Ping(); err != nil {
-			log.Errorf("ping database error, will retry in 2s: %s", err)
-			time.Sleep(2 * time.Second)
-		} else {
-			break
-		}
-	}
-
-	return db, nil
-}
-
-func TopicsMatch(savedTopic, givenTopic string) bool {
-	return givenTopic == savedTopic || match(strings.Split(savedTopic, "/"), strings.Split(givenTopic, "/"))
-}
-
-func match(route []string, topic []string) bool {
-	if len(route) == 0 {
-		if len(topic) == 0 {
-			return true
-		}
-		return false
+		return nil, nil, errors.Wrap(err, "database connection error")
 	}
 
-	if len(topic) == 0 {
-		if route[0] == "#" {
-			return true
-		}
-		return false
+	if pool.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.MaxOpenConns)
 	}
 
-	if route[0] == "#" {
-		return true
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
 	}
 
-	if (route[0] == "+") || (route[0] == topic[0]) {
-		return match(route[1:], topic[1:])
+	if pool.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(pool.ConnMaxLifetime)
 	}
 
-	return false
-}
-
-/*
-* PBKDF2 passwords usage taken from github.com/brocaar/lora-app-server, comments included.
- */
-
-// Generate the hash of a password for storage in the database.
-// NOTE: We store the details of the hashing algorithm with the hash itself,
-// making it easy to recreate the hash for password checking, even if we change
-// the default criteria here.
-// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
-func Hash(password string, saltSize int, iterations int, algorithm string) (string, error) {
-	// Generate a random salt value, 128 bits.
-	salt := make([]byte, saltSize)
-	_, err := rand.Read(salt)
+	cancel, err := StartConnection(connect, engine, db.PingContext)
 	if err != nil {
-		return "", errors.Wrap(err, "read random bytes error")
-	}
-
-	return hashWithSalt(password, salt, iterations, algorithm), nil
-}
-
-// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
-func hashWithSalt(password string, salt []byte, iterations int, algorithm string) string {
-	// Generate the hash.  This should be a little painful, adjust ITERATIONS
-	// if it needs performance tweeking.  Greatly depends on the hardware.
-	// NOTE: We store these details with the returned hash, so changes will not
-	// affect our ability to do password compares.
-	shaSize := sha512.Size
-	shaHash := sha512.New
-	if algorithm == "sha256" {
-		shaSize = sha256.Size
-		shaHash = sha256.New
-	}
-	hash := pbkdf2.Key([]byte(password), salt, iterations, shaSize, shaHash)
-
-	// Build up the parameters and hash into a single string so we can compare
-	// other string to the same hash.  Note that the hash algorithm is hard-
-	// coded here, as it is above.  Introducing alternate encodings must support
-	// old encodings as well, and build this string appropriately.
-	var buffer bytes.Buffer
-
-	buffer.WriteString("PBKDF2$")
-	buffer.WriteString(fmt.Sprintf("%s$", algorithm))
-	buffer.WriteString(strconv.Itoa(iterations))
-	buffer.WriteString("$")
-	buffer.WriteString(base64.StdEncoding.EncodeToString(salt))
-	buffer.WriteString("$")
-	buffer.WriteString(base64.StdEncoding.EncodeToString(hash))
-
-	return buffer.String()
-}
-
-func hashCompareMosquitto(password string, passwordHash string) bool {
-	hashSplit := strings.Split(passwordHash, "$")
-	salt, _ := base64.StdEncoding.DecodeString(hashSplit[2])
-	sum := sha512.Sum512([]byte(fmt.Sprintf("%s%s", password, string(salt[:]))))
-	hashedPassword := base64.StdEncoding.EncodeToString(sum[:])
-	return hashedPassword == hashSplit[3]
-}
-
-// HashCompare verifies that passed password hashes to the same value as the
-// passed passwordHash.
-// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
-func HashCompare(password string, passwordHash string) bool {
-	if strings.HasPrefix(passwordHash, "$6$") {
-		return hashCompareMosquitto(password, passwordHash)
+		cancel()
+		db.Close()
+		return nil, nil, err
 	}
-	// SPlit the hash string into its parts.
-	hashSplit := strings.Split(passwordHash, "$")
 
-	// Get the iterations and the salt and use them to encode the password
-	// being compared.cre
-	iterations, _ := strconv.Atoi(hashSplit[2])
-	salt, _ := base64.StdEncoding.DecodeString(hashSplit[3])
-	algorithm := hashSplit[1]
-	newHash := hashWithSalt(password, salt, iterations, algorithm)
-	return newHash == passwordHash
+	return db, cancel, nil
 }
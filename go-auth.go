@@ -20,6 +20,7 @@ import (
 
 	goredis "github.com/go-redis/redis"
 	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/common"
 )
 
 type Backend bes.Backend
@@ -53,10 +54,17 @@ type Cache struct {
 	DB       int32
 }
 
-var backends []string          //List of selected backends.
-var authOpts map[string]string //Options passed by mosquitto.
-var cache Cache                //Cache conf.
-var commonData CommonData      //General struct with options and conf.
+var backends []string            //List of selected backends.
+var configOpts map[string]string //Options passed by mosquitto.
+var authOpts map[string]string   //Options passed by mosquitto, with secrets read from files and environment variables.
+var cache Cache                  //Cache conf.
+var commonData CommonData        //General struct with options and conf.
+
+var declaredBackends []string         //Backends given in options, including those that failed to start.
+var backendPrefixes map[string]string //Prefix of each declared backend, when prefixes are enabled.
+
+var retrying = make(map[string]bool)                //Backends being started again in the background.
+var retriedBackends = make(chan retriedBackend, 16) //Results of background starts, picked up by the broker's thread.
 
 func setLogLevel(authOpts map[string]string) {
 	//Check if log level is given. Set level if any valid option is given.
@@ -116,10 +124,16 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 
 	//First, get backends
 	backendsOk := false
-	authOpts = make(map[string]string)
+	configOpts = make(map[string]string)
 	for i := 0; i < authOptsNum; i++ {
 		log.Debugf("%s = %s", keys[i], values[i])
-		authOpts[keys[i]] = values[i]
+		configOpts[keys[i]] = values[i]
+	}
+
+	var sErr error
+	authOpts, sErr = common.ResolveSecrets(configOpts)
+	if sErr != nil {
+		log.Fatalf("\nsecrets error: %s\n", sErr)
 	}
 
 	if backendsStr, ok := authOpts["backends"]; ok {
@@ -162,7 +176,9 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 	}
 
 	//Initialize backends
-	for _, bename := range backends {
+	declaredBackends = backends
+	backendPrefixes = make(map[string]string)
+	for _, bename := range declaredBackends {
 		var bErr error
 
 		//		if bename == "plugin" {
@@ -257,11 +273,14 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		//
 		//			}
 		//		} else {
-		cmbackends[bename], bErr = bes.RegisteredBackends[bename](authOpts, commonData.LogLevel)
+		var backend Backend
+		backend, bErr = bes.RegisteredBackends[bename](authOpts, commonData.LogLevel)
 		if bErr != nil {
-			log.Warnf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+			//Backends that failed to start, e.g. when their database wasn't available in time, are left out until a reload starts them.
+			log.Errorf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
 		} else {
-			log.Infof("Backend registered: %s", cmbackends[bename].GetName())
+			cmbackends[bename] = backend
+			log.Infof("Backend registered: %s", backend.GetName())
 		}
 		//		}
 	}
@@ -341,15 +360,14 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		//Check that backends match prefixes.
 		if prefixesStr, ok := authOpts["prefixes"]; ok {
 			prefixes := strings.Split(strings.Replace(prefixesStr, " ", "", -1), ",")
-			if len(prefixes) == len(backends) {
-				//Set prefixes
-				for i, backend := range backends {
-					commonData.Prefixes[prefixes[i]] = backend
+			if len(prefixes) == len(declaredBackends) {
+				for i, backend := range declaredBackends {
+					backendPrefixes[backend] = prefixes[i]
 				}
 				log.Infof("Prefixes enabled for backends %s with prefixes %s.", authOpts["backends"], authOpts["prefixes"])
 				commonData.CheckPrefix = true
 			} else {
-				log.Errorf("Error: got %d backends and %d prefixes, defaulting to prefixes disabled.", len(backends), len(prefixes))
+				log.Errorf("Error: got %d backends and %d prefixes, defaulting to prefixes disabled.", len(declaredBackends), len(prefixes))
 				commonData.CheckPrefix = false
 			}
 
@@ -362,23 +380,83 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 	}
 
 	commonData.Backends = cmbackends
+	setActiveBackends()
 
 }
 
-//export AuthUnpwdCheck
-func AuthUnpwdCheck(username, password string) bool {
+//setActiveBackends only checks against backends that could be initialized, along with their prefixes.
+func setActiveBackends() {
+	backends = make([]string, 0, len(declaredBackends))
+	commonData.Prefixes = make(map[string]string)
 
-	authenticated := false
-	var cached = false
-	var granted = false
-	if commonData.UseCache {
-		log.Debugf("checking auth cache for %s", username)
-		cached, granted = CheckAuthCache(username, password)
-		if cached {
-			log.Debugf("found in cache: %s", username)
-			return granted
+	for _, bename := range declaredBackends {
+		if _, ok := commonData.Backends[bename]; !ok {
+			continue
+		}
+		backends = append(backends, bename)
+		if prefix, ok := backendPrefixes[bename]; ok {
+			commonData.Prefixes[prefix] = bename
 		}
 	}
+}
+
+//retriedBackend is the result of starting a backend again in the background.
+type retriedBackend struct {
+	name    string
+	backend Backend
+	err     error
+}
+
+//retryBackends starts again, in the background, backends that failed to start and aren't being retried already,
+//so waiting for their databases never blocks the broker. Those that succeed are picked up by startRetriedBackends.
+func retryBackends() {
+	for _, bename := range declaredBackends {
+		if _, ok := commonData.Backends[bename]; ok || retrying[bename] {
+			continue
+		}
+
+		log.Infof("- Retrying %s backend in the background", bename)
+		retrying[bename] = true
+
+		go func(bename string, opts map[string]string, level log.Level) {
+			backend, err := bes.RegisteredBackends[bename](opts, level)
+			retriedBackends <- retriedBackend{name: bename, backend: backend, err: err}
+		}(bename, authOpts, commonData.LogLevel)
+	}
+}
+
+//startRetriedBackends adds backends started in the background to the checked ones. It doesn't wait for pending ones,
+//and it's called from the broker's thread before checks and reloads, so backends are never changed while in use.
+func startRetriedBackends() {
+	started := false
+
+	for {
+		select {
+		case retried := <-retriedBackends:
+			delete(retrying, retried.name)
+			if retried.err != nil {
+				log.Errorf("couldn't start %s backend: %s", retried.name, retried.err)
+				continue
+			}
+			log.Infof("started %s", retried.backend.GetName())
+			commonData.Backends[retried.name] = retried.backend
+			started = true
+		default:
+			if started {
+				setActiveBackends()
+			}
+			return
+		}
+	}
+}
+
+//export AuthUnpwdCheck
+func AuthUnpwdCheck(username, password, clientid string) bool {
+
+	startRetriedBackends()
+
+	authenticated := false
+	checker := &userChecker{username: username, password: password, clientid: clientid}
 
 	//If prefixes are enabled, checkt if username has a valid prefix and use the correct backend if so.
 	if commonData.CheckPrefix {
@@ -391,7 +469,7 @@ func AuthUnpwdCheck(username, password string) bool {
 
 			var backend = commonData.Backends[bename]
 
-			if backend.GetUser(username, password) {
+			if checker.check(backend) {
 				authenticated = true
 				log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
 			}
@@ -400,28 +478,21 @@ func AuthUnpwdCheck(username, password string) bool {
 
 		} else {
 			//If there's no valid prefix, check all backends.
-			authenticated = CheckBackendsAuth(username, password)
+			authenticated = CheckBackendsAuth(checker)
 			//If not authenticated, check for a present plugin
 			//			if !authenticated {
 			//				authenticated = CheckPluginAuth(username, password)
 			//			}
 		}
 	} else {
-		authenticated = CheckBackendsAuth(username, password)
+		authenticated = CheckBackendsAuth(checker)
 		//If not authenticated, check for a present plugin
 		//		if !authenticated {
 		//			authenticated = CheckPluginAuth(username, password)
 		//		}
 	}
 
-	if commonData.UseCache {
-		authGranted := "false"
-		if authenticated {
-			authGranted = "true"
-		}
-		log.Debugf("setting auth cache for %s", username)
-		SetAuthCache(username, password, authGranted)
-	}
+	checker.cache(authenticated)
 
 	return authenticated
 }
@@ -429,17 +500,10 @@ func AuthUnpwdCheck(username, password string) bool {
 //export AuthAclCheck
 func AuthAclCheck(clientid, username, topic string, acc int) bool {
 
+	startRetriedBackends()
+
 	aclCheck := false
-	var cached = false
-	var granted = false
-	if commonData.UseCache {
-		log.Debugf("checking acl cache for %s", username)
-		cached, granted = CheckAclCache(username, topic, clientid, acc)
-		if cached {
-			log.Debugf("found in cache: %s", username)
-			return granted
-		}
-	}
+	checker := &aclChecker{username: username, topic: topic, clientid: clientid, acc: acc}
 
 	//If prefixes are enabled, checkt if username has a valid prefix and use the correct backend if so.
 	//Else, check all backends.
@@ -456,7 +520,7 @@ func AuthAclCheck(clientid, username, topic string, acc int) bool {
 			var backend = commonData.Backends[bename]
 
 			log.Debugf("Superuser check with backend %s", backend.GetName())
-			if backend.GetSuperuser(username) {
+			if checker.superuser(backend) {
 				log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
 				aclCheck = true
 			}
@@ -464,7 +528,7 @@ func AuthAclCheck(clientid, username, topic string, acc int) bool {
 			//If not superuser, check acl.
 			if !aclCheck {
 				log.Debugf("Acl check with backend %s", backend.GetName())
-				if backend.CheckAcl(username, topic, clientid, int32(acc)) {
+				if checker.acl(backend) {
 					log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
 					aclCheck = true
 				}
@@ -473,34 +537,41 @@ func AuthAclCheck(clientid, username, topic string, acc int) bool {
 
 		} else {
 			//If there's no valid prefix, check all backends.
-			aclCheck = CheckBackendsAcl(username, topic, clientid, acc)
+			aclCheck = CheckBackendsAcl(checker)
 			//If acl hasn't passed, check for plugin.
 			//			if !aclCheck {
 			//				aclCheck = CheckPluginAcl(username, topic, clientid, acc)
 			//			}
 		}
 	} else {
-		aclCheck = CheckBackendsAcl(username, topic, clientid, acc)
+		aclCheck = CheckBackendsAcl(checker)
 		//If acl hasn't passed, check for plugin.
 		//		if !aclCheck {
 		//			aclCheck = CheckPluginAcl(username, topic, clientid, acc)
 		//		}
 	}
 
-	if commonData.UseCache {
-		authGranted := "false"
-		if aclCheck {
-			authGranted = "true"
-		}
-		log.Debugf("setting acl cache (granted = %s) for %s", authGranted, username)
-		SetAclCache(username, topic, clientid, acc, authGranted)
-	}
+	checker.cache(aclCheck)
 
 	log.Debugf("Acl is %t for user %s", aclCheck, username)
 
 	return aclCheck
 }
 
+//export AuthClientExpired
+func AuthClientExpired(clientid, username string) bool {
+	//Clients whose credentials expired for any backend are disconnected by the plugin, when the broker allows it.
+	for _, bename := range backends {
+		expirer, ok := commonData.Backends[bename].(bes.ClientExpirer)
+		if ok && expirer.ClientExpired(username, clientid) {
+			log.Debugf("client %s of user %s expired with backend %s", clientid, username, commonData.Backends[bename].GetName())
+			return true
+		}
+	}
+
+	return false
+}
+
 //export AuthPskKeyGet
 func AuthPskKeyGet() bool {
 	return true
@@ -571,9 +642,10 @@ func CheckPrefix(username string) (bool, string) {
 }
 
 //CheckBackendsAuth checks for all backends if a username is authenticated and sets the authenticated param.
-func CheckBackendsAuth(username, password string) bool {
+func CheckBackendsAuth(checker *userChecker) bool {
 
 	authenticated := false
+	username := checker.username
 
 	for _, bename := range backends {
 
@@ -585,7 +657,7 @@ func CheckBackendsAuth(username, password string) bool {
 
 		log.Debugf("checking user %s with backend %s", username, backend.GetName())
 
-		if backend.GetUser(username, password) {
+		if checker.check(backend) {
 			authenticated = true
 			log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
 			break
@@ -597,10 +669,11 @@ func CheckBackendsAuth(username, password string) bool {
 }
 
 //CheckBackendsAcl  checks for all backends if a username is superuser or has acl rights and sets the aclCheck param.
-func CheckBackendsAcl(username, topic, clientid string, acc int) bool {
+func CheckBackendsAcl(checker *aclChecker) bool {
 	//Check superusers first
 
 	aclCheck := false
+	username := checker.username
 
 	for _, bename := range backends {
 
@@ -611,7 +684,7 @@ func CheckBackendsAcl(username, topic, clientid string, acc int) bool {
 		var backend = commonData.Backends[bename]
 
 		log.Debugf("Superuser check with backend %s", backend.GetName())
-		if backend.GetSuperuser(username) {
+		if checker.superuser(backend) {
 			log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
 			aclCheck = true
 			break
@@ -625,7 +698,7 @@ func CheckBackendsAcl(username, topic, clientid string, acc int) bool {
 			}
 			var backend = commonData.Backends[bename]
 			log.Debugf("Acl check with backend %s", backend.GetName())
-			if backend.CheckAcl(username, topic, clientid, int32(acc)) {
+			if checker.acl(backend) {
 				log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
 				aclCheck = true
 				break
@@ -637,6 +710,157 @@ func CheckBackendsAcl(username, topic, clientid string, acc int) bool {
 
 }
 
+//userChecker checks a user's credentials against backends. The result of backends that don't remember clients is cached, as a
+//whole, while backends that remember clients are always asked, as they must see every connection.
+type userChecker struct {
+	username string
+	password string
+	clientid string
+
+	cacheChecked bool //The cache has been looked up.
+	cached       bool //The cache had a result, which answers for every backend that doesn't remember clients.
+	granted      bool //The cached result.
+	checked      bool //Some backend that doesn't remember clients was asked, so its result may be cached.
+	remembered   bool //The user was authenticated by a backend that remembers clients.
+}
+
+//check asks a backend if the user is authenticated, or the cache when enabled and the backend doesn't remember clients.
+func (c *userChecker) check(backend Backend) bool {
+	if remembersClients(backend) {
+		authenticated := getUser(backend, c.username, c.password, c.clientid)
+		c.remembered = authenticated
+		return authenticated
+	}
+
+	if !commonData.UseCache {
+		return getUser(backend, c.username, c.password, c.clientid)
+	}
+
+	if !c.cacheChecked {
+		log.Debugf("checking auth cache for %s", c.username)
+		c.cached, c.granted = CheckAuthCache(c.username, c.password)
+		c.cacheChecked = true
+	}
+
+	if c.cached {
+		log.Debugf("found in cache: %s", c.username)
+		return c.granted
+	}
+
+	c.checked = true
+	return getUser(backend, c.username, c.password, c.clientid)
+}
+
+//cache stores the result of backends that don't remember clients. Users authenticated by a backend that does aren't cached,
+//as backends after it weren't asked.
+func (c *userChecker) cache(authenticated bool) {
+	if !c.checked || c.remembered {
+		return
+	}
+
+	authGranted := "false"
+	if authenticated {
+		authGranted = "true"
+	}
+	log.Debugf("setting auth cache for %s", c.username)
+	SetAuthCache(c.username, c.password, authGranted)
+}
+
+//aclChecker checks a user's superuser status and acls against backends. As with users, the result of backends is cached as a
+//whole, except for backends that bypass the acl cache, which are always asked.
+type aclChecker struct {
+	username string
+	topic    string
+	clientid string
+	acc      int
+
+	cacheChecked bool //The cache has been looked up.
+	cached       bool //The cache had a result, which answers for every backend that doesn't bypass it.
+	granted      bool //The cached result.
+	checked      bool //Some backend that doesn't bypass the cache was asked, so its result may be cached.
+	bypassed     bool //Access was granted by a backend that bypasses the cache.
+}
+
+//superuser checks if the user is a superuser with a backend.
+func (c *aclChecker) superuser(backend Backend) bool {
+	return c.check(backend, func() bool { return getSuperuser(backend, c.username, c.clientid) })
+}
+
+//acl checks the user's acls with a backend.
+func (c *aclChecker) acl(backend Backend) bool {
+	return c.check(backend, func() bool { return backend.CheckAcl(c.username, c.topic, c.clientid, int32(c.acc)) })
+}
+
+//check runs a check with a backend, or looks up the cache when enabled and the backend doesn't bypass it.
+func (c *aclChecker) check(backend Backend, check func() bool) bool {
+	if bypassesAclCache(backend) {
+		granted := check()
+		c.bypassed = c.bypassed || granted
+		return granted
+	}
+
+	if !commonData.UseCache {
+		return check()
+	}
+
+	if !c.cacheChecked {
+		log.Debugf("checking acl cache for %s", c.username)
+		c.cached, c.granted = CheckAclCache(c.username, c.topic, c.clientid, c.acc)
+		c.cacheChecked = true
+	}
+
+	if c.cached {
+		log.Debugf("found in cache: %s", c.username)
+		return c.granted
+	}
+
+	c.checked = true
+	return check()
+}
+
+//cache stores the result of backends that don't bypass the acl cache. Access granted by a backend that does isn't cached,
+//as backends after it weren't asked.
+func (c *aclChecker) cache(granted bool) {
+	if !c.checked || c.bypassed {
+		return
+	}
+
+	authGranted := "false"
+	if granted {
+		authGranted = "true"
+	}
+	log.Debugf("setting acl cache (granted = %s) for %s", authGranted, c.username)
+	SetAclCache(c.username, c.topic, c.clientid, c.acc, authGranted)
+}
+
+//getUser authenticates a user with a backend, passing the client id along to backends that remember clients.
+func getUser(backend Backend, username, password, clientid string) bool {
+	if ca, ok := backend.(bes.ClientAuthenticator); ok && ca.RemembersClients() {
+		return ca.GetClientUser(username, password, clientid)
+	}
+	return backend.GetUser(username, password)
+}
+
+//getSuperuser checks if a user is a superuser with a backend, passing the client id along to backends that remember clients.
+func getSuperuser(backend Backend, username, clientid string) bool {
+	if ca, ok := backend.(bes.ClientAuthenticator); ok && ca.RemembersClients() {
+		return ca.GetClientSuperuser(username, clientid)
+	}
+	return backend.GetSuperuser(username)
+}
+
+//bypassesAclCache tells if a backend's grants may be withdrawn before cached results expire.
+func bypassesAclCache(backend Backend) bool {
+	bypasser, ok := backend.(bes.AclCacheBypasser)
+	return ok && bypasser.BypassesAclCache()
+}
+
+//remembersClients tells if a backend remembers what clients authenticated with.
+func remembersClients(backend Backend) bool {
+	ca, ok := backend.(bes.ClientAuthenticator)
+	return ok && ca.RemembersClients()
+}
+
 ////CheckPluginAuth checks that the plugin is not nil and returns the plugins auth response.
 //func CheckPluginAuth(username, password string) bool {
 //	if commonData.Plugin != nil {
@@ -664,7 +888,9 @@ func AuthPluginCleanup() {
 		commonData.RedisCache.Close()
 	}
 
-	//Halt every registered backend.
+	//Halt every registered backend, including any started in the background since the last check.
+
+	startRetriedBackends()
 
 	for _, v := range commonData.Backends {
 		v.Halt()
@@ -678,14 +904,97 @@ func AuthPluginCleanup() {
 //export AuthReload
 func AuthReload() {
 	log.Info("Reloading.")
+
+	startRetriedBackends()
+
+	changed := reloadSecrets()
+
 	for _, bename := range backends {
 		var backend = commonData.Backends[bename]
+		if usesSecrets(bename, changed) {
+			log.Infof("- Restarting %s with new credentials", backend.GetName())
+			restartBackend(bename)
+			continue
+		}
 		log.Infof("- Reloading %s", backend.GetName())
 		backend.Reload()
 	}
+
+	retryBackends()
+
+	if commonData.UseCache && usesSecrets("cache", changed) {
+		log.Info("- Restarting cache with new credentials")
+		restartCache()
+	}
+
 	log.Info("Reloaded.")
 }
 
+//reloadSecrets reads secrets from their files and environment variables again and returns those that changed.
+//On error, current secrets are kept.
+func reloadSecrets() []string {
+	resolved, err := common.ResolveSecrets(configOpts)
+	if err != nil {
+		log.Errorf("couldn't reload secrets, keeping current ones: %s", err)
+		return nil
+	}
+
+	changed := common.ChangedSecrets(authOpts, resolved)
+	authOpts = resolved
+
+	return changed
+}
+
+//usesSecrets checks if any of the changed secrets is used by the given backend or the cache.
+func usesSecrets(name string, changed []string) bool {
+	for _, option := range changed {
+		for _, user := range common.SecretOptions[option] {
+			if user == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//restartBackend initializes the backend again with current options, halting the previous instance.
+//If it fails, the previous instance is kept.
+func restartBackend(bename string) {
+	backend, err := bes.RegisteredBackends[bename](authOpts, commonData.LogLevel)
+	if err != nil {
+		log.Errorf("couldn't restart %s backend, keeping current one: %s", bename, err)
+		return
+	}
+
+	//Clients connected to the current instance are still connected, so the new one must know them.
+	if keeper, ok := backend.(bes.ClientKeeper); ok {
+		keeper.KeepClients(commonData.Backends[bename])
+	}
+
+	commonData.Backends[bename].Halt()
+	commonData.Backends[bename] = backend
+}
+
+//restartCache connects to the cache with the current password, closing the previous client.
+//If it fails, the previous client is kept.
+func restartCache() {
+	goredisClient := goredis.NewClient(&goredis.Options{
+		Addr:     fmt.Sprintf("%s:%s", cache.Host, cache.Port),
+		Password: authOpts["cache_password"],
+		DB:       int(cache.DB),
+	})
+
+	if _, err := goredisClient.Ping().Result(); err != nil {
+		log.Errorf("couldn't restart cache, keeping current client: %s", err)
+		goredisClient.Close()
+		return
+	}
+
+	cache.Password = authOpts["cache_password"]
+	commonData.RedisCache.Close()
+	commonData.RedisCache = goredisClient
+}
+
 //export AuthLogInfo
 func AuthLogInfo(message string) {
 	log.Info(message)
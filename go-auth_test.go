@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//testBackend is a minimal backend that grants nothing.
+type testBackend struct {
+	name string
+}
+
+func (o testBackend) GetUser(username, password string) bool                    { return false }
+func (o testBackend) GetSuperuser(username string) bool                         { return false }
+func (o testBackend) CheckAcl(username, topic, clientId string, acc int32) bool { return false }
+func (o testBackend) GetName() string                                           { return o.name }
+func (o testBackend) Halt()                                                     {}
+func (o testBackend) Reload()                                                   {}
+
+//testExpirer is a backend whose clients' credentials may expire.
+type testExpirer struct {
+	testBackend
+	expired map[string]string //Client ids of expired clients, with their username.
+}
+
+func (o testExpirer) ClientExpired(username, clientid string) bool {
+	expiredUser, ok := o.expired[clientid]
+	return ok && expiredUser == username
+}
+
+func TestAuthClientExpired(t *testing.T) {
+
+	Convey("Given backends that don't tell expired clients, no client should be expired", t, func() {
+		backends = []string{"files"}
+		commonData.Backends = map[string]Backend{"files": testBackend{name: "Files"}}
+
+		So(AuthClientExpired("client1", "test1"), ShouldBeFalse)
+	})
+
+	Convey("Given a backend that tells expired clients, clients expired for it should be expired", t, func() {
+		backends = []string{"files", "jwt"}
+		commonData.Backends = map[string]Backend{
+			"files": testBackend{name: "Files"},
+			"jwt":   testExpirer{testBackend: testBackend{name: "JWT"}, expired: map[string]string{"client1": "test1"}},
+		}
+
+		So(AuthClientExpired("client1", "test1"), ShouldBeTrue)
+		So(AuthClientExpired("client1", "test2"), ShouldBeFalse)
+		So(AuthClientExpired("client2", "test1"), ShouldBeFalse)
+
+		Convey("Backends that aren't active shouldn't be asked", func() {
+			backends = []string{"files"}
+			So(AuthClientExpired("client1", "test1"), ShouldBeFalse)
+		})
+	})
+
+}
+
+func TestRetryBackends(t *testing.T) {
+
+	Convey("Given a backend started in the background, it should be checked once picked up", t, func() {
+		declaredBackends = []string{"files", "jwt"}
+		backendPrefixes = map[string]string{"files": "files", "jwt": "jwt"}
+		commonData.Backends = map[string]Backend{"files": testBackend{name: "Files"}}
+		setActiveBackends()
+
+		So(backends, ShouldResemble, []string{"files"})
+
+		retrying["jwt"] = true
+		retriedBackends <- retriedBackend{name: "jwt", backend: testBackend{name: "JWT"}}
+		startRetriedBackends()
+
+		So(backends, ShouldResemble, []string{"files", "jwt"})
+		So(commonData.Prefixes, ShouldResemble, map[string]string{"files": "files", "jwt": "jwt"})
+		So(retrying["jwt"], ShouldBeFalse)
+
+		Convey("Backends that failed again should be retried on the next reload", func() {
+			delete(commonData.Backends, "jwt")
+			setActiveBackends()
+
+			retrying["jwt"] = true
+			retriedBackends <- retriedBackend{name: "jwt", err: errors.New("connection refused")}
+			startRetriedBackends()
+
+			So(backends, ShouldResemble, []string{"files"})
+			So(retrying["jwt"], ShouldBeFalse)
+		})
+	})
+
+}
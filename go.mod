@@ -32,4 +32,5 @@ require (
 	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
 	google.golang.org/api v0.6.0 // indirect
 	google.golang.org/grpc v1.21.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,94 @@
+// +build files
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	commands["lint"] = lint
+}
+
+//lint prints every issue found in the files backend configuration, given as flags or read from a mosquitto conf file.
+func lint(args []string) error {
+
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	var conf = fs.String("c", "", "mosquitto conf file to read auth_opt_ options from")
+	//These are only read through Visit, as they override conf options just when given.
+	fs.String("files_format", "", "files format: mosquitto (default), yaml or json")
+	fs.String("password_path", "", "comma separated password files and directories")
+	fs.String("acl_path", "", "comma separated acl files and directories")
+	fs.String("policy_path", "", "comma separated policy files and directories")
+
+	fs.Parse(args)
+
+	//Keep backend logs out of the report.
+	bes.Log.SetLevel(log.ErrorLevel)
+
+	authOpts := make(map[string]string)
+
+	if *conf != "" {
+		if err := readAuthOpts(*conf, authOpts); err != nil {
+			return err
+		}
+	}
+
+	//Flags take precedence over conf options.
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "c" {
+			authOpts[f.Name] = f.Value.String()
+		}
+	})
+
+	issues, err := bes.LintFiles(authOpts)
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("%d issues found", len(issues))
+	}
+
+	fmt.Println("no issues found")
+
+	return nil
+}
+
+//readAuthOpts reads auth_opt_ options from a mosquitto conf file into authOpts, without the prefix.
+func readAuthOpts(path string, authOpts map[string]string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "auth_opt_") {
+			continue
+		}
+
+		lineArr := strings.SplitN(line, " ", 2)
+		if len(lineArr) != 2 {
+			continue
+		}
+
+		authOpts[strings.TrimPrefix(lineArr[0], "auth_opt_")] = strings.TrimSpace(lineArr[1])
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//readPasswordHash reads a password, confirming it, and hashes it.
+func readPasswordHash(opts common.HashOptions) (string, error) {
+	password, err := readPassword(true)
+	if err != nil {
+		return "", err
+	}
+
+	return common.GenerateHash(password, opts)
+}
+
+//readPassword reads a password. From a terminal, the password is prompted without echo, twice when confirm is set.
+//Otherwise, the first line of stdin is read, so passwords never need to be given as arguments.
+func readPassword(confirm bool) (string, error) {
+	var password string
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		first, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		if confirm {
+			fmt.Fprint(os.Stderr, "Confirm password: ")
+			second, err := terminal.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return "", err
+			}
+
+			if string(first) != string(second) {
+				return "", errors.New("passwords don't match")
+			}
+		}
+
+		password = string(first)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+
+	return password, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	commands["provision"] = provision
+}
+
+//Access values as stored by database backends.
+var provisionAccess = map[string]int32{
+	"read":      1,
+	"write":     2,
+	"readwrite": 3,
+	"subscribe": 4,
+}
+
+//Redis sets holding topics for each access.
+var redisAclSets = map[int32]string{
+	1: "racls",
+	2: "wacls",
+	3: "rwacls",
+}
+
+type provisionAcl struct {
+	Topic string `json:"topic"`
+	Acc   int32  `json:"acc"`
+}
+
+//provisionUser has the shape of a mongo backend user.
+type provisionUser struct {
+	Username  string         `json:"username"`
+	Password  string         `json:"password"`
+	Superuser bool           `json:"superuser"`
+	Acls      []provisionAcl `json:"acls"`
+}
+
+//aclFlag collects repeated -acl <access>:<topic> flags.
+type aclFlag []provisionAcl
+
+func (a *aclFlag) String() string {
+	rules := make([]string, 0, len(*a))
+	for _, acl := range *a {
+		rules = append(rules, fmt.Sprintf("%d:%s", acl.Acc, acl.Topic))
+	}
+	return strings.Join(rules, ",")
+}
+
+func (a *aclFlag) Set(value string) error {
+	accName, topic := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		accName, topic = value[:i], value[i+1:]
+	}
+
+	acc, ok := provisionAccess[accName]
+	if !ok || topic == "" {
+		return errors.Errorf("invalid acl %q, expected <read|write|readwrite|subscribe>:<topic>", value)
+	}
+
+	*a = append(*a, provisionAcl{Topic: topic, Acc: acc})
+
+	return nil
+}
+
+//provision prints the statements, commands or document that create a user and its acls in a database backend,
+//with a password read from the terminal or stdin.
+func provision(args []string) error {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	var backend = fs.String("backend", "", "backend to provision: postgres, mysql, sqlite, redis or mongo")
+	var superuser = fs.Bool("superuser", false, "make the user a superuser")
+	var userTable = fs.String("user_table", "test_user", "SQL users table")
+	var aclTable = fs.String("acl_table", "test_acl", "SQL acls table")
+	var acls aclFlag
+	fs.Var(&acls, "acl", "acl rule as <read|write|readwrite|subscribe>:<topic>, may be repeated")
+	hashOptions := hashFlags(fs)
+
+	fs.Parse(args)
+
+	if *backend == "" || fs.NArg() != 1 || fs.Arg(0) == "" {
+		return errors.New("usage: pw provision -backend <backend> [-superuser] [-acl <access>:<topic>]... [hash flags] <username>")
+	}
+
+	user := provisionUser{
+		Username:  fs.Arg(0),
+		Superuser: *superuser,
+		Acls:      acls,
+	}
+	if user.Acls == nil {
+		user.Acls = []provisionAcl{}
+	}
+
+	var write func(w io.Writer, user provisionUser) error
+
+	switch *backend {
+	case "postgres", "mysql", "sqlite":
+		engine := *backend
+		write = func(w io.Writer, user provisionUser) error {
+			return writeSQL(w, engine, *userTable, *aclTable, user)
+		}
+	case "redis":
+		for _, acl := range user.Acls {
+			if _, ok := redisAclSets[acl.Acc]; !ok {
+				return errors.New("redis has no subscribe rules, subscriptions are checked with read and readwrite rules")
+			}
+		}
+		write = writeRedis
+	case "mongo":
+		write = writeMongo
+	default:
+		return errors.Errorf("unknown backend %s", *backend)
+	}
+
+	pwHash, err := readPasswordHash(hashOptions())
+	if err != nil {
+		return err
+	}
+	user.Password = pwHash
+
+	return write(os.Stdout, user)
+}
+
+//writeSQL prints INSERT statements for the sample schema given in the README for each SQL backend.
+func writeSQL(w io.Writer, engine, userTable, aclTable string, user provisionUser) error {
+	isAdmin := "false"
+	if user.Superuser {
+		isAdmin = "true"
+	}
+	if engine == "sqlite" {
+		isAdmin = "0"
+		if user.Superuser {
+			isAdmin = "1"
+		}
+	}
+
+	username := sqlQuote(engine, user.Username)
+
+	if _, err := fmt.Fprintf(w, "INSERT INTO %s (username, password_hash, is_admin) VALUES (%s, %s, %s);\n",
+		userTable, username, sqlQuote(engine, user.Password), isAdmin); err != nil {
+		return err
+	}
+
+	for _, acl := range user.Acls {
+		if _, err := fmt.Fprintf(w, "INSERT INTO %s (test_user_id, topic, rw) VALUES ((SELECT id FROM %s WHERE username = %s), %s, %d);\n",
+			aclTable, userTable, username, sqlQuote(engine, acl.Topic), acl.Acc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//sqlQuote returns s as a string literal. MySQL treats backslashes as escapes by default, while postgres and sqlite don't.
+func sqlQuote(engine, s string) string {
+	if engine == "mysql" {
+		s = strings.Replace(s, `\`, `\\`, -1)
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+//writeRedis prints redis-cli commands setting the user's hash, superuser key and acl sets.
+func writeRedis(w io.Writer, user provisionUser) error {
+	commands := []string{
+		fmt.Sprintf("SET %s %s", redisQuote(user.Username), redisQuote(user.Password)),
+	}
+
+	if user.Superuser {
+		commands = append(commands, fmt.Sprintf("SET %s true", redisQuote(user.Username+":su")))
+	}
+
+	for _, acl := range user.Acls {
+		key := user.Username + ":" + redisAclSets[acl.Acc]
+		commands = append(commands, fmt.Sprintf("SADD %s %s", redisQuote(key), redisQuote(acl.Topic)))
+	}
+
+	for _, command := range commands {
+		if _, err := fmt.Fprintln(w, command); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//redisQuote returns s as a double quoted redis-cli argument. Line breaks are escaped too, so every command takes a single line.
+func redisQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s)
+	return `"` + s + `"`
+}
+
+//writeMongo prints the user as a JSON document for the mongo users collection.
+func writeMongo(w io.Writer, user provisionUser) error {
+	doc, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(doc))
+
+	return err
+}
@@ -3,26 +3,84 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/iegomez/mosquitto-go-auth/common"
 )
 
-// saltSize defines the salt size
-const saltSize = 16
+//commands holds pw subcommands by name. Commands that depend on a backend register themselves when built with its tag.
+var commands = make(map[string]func(args []string) error)
 
 func main() {
 
-	var algorithm = flag.String("a", "sha512", "algorithm (sha256 or default: sha512)")
-	var HashIterations = flag.Int("i", 100000, "hash iterations (default: 100000)")
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	hashOptions := hashFlags(flag.CommandLine)
 	var password = flag.String("p", "", "password")
 
+	flag.Usage = usage
+
 	flag.Parse()
 
-	pwHash, err := common.Hash(*password, saltSize, *HashIterations, *algorithm)
+	pwHash, err := common.GenerateHash(*password, hashOptions())
 	if err != nil {
-		fmt.Errorf("error: %s\n", err)
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
 	} else {
 		fmt.Println(pwHash)
 	}
 
 }
+
+//usage prints how to hash a password and the available subcommands, which depend on the tags pw was built with.
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] -p password\n       %s <command> [flags] [args]\n\n", os.Args[0], os.Args[0])
+	fmt.Fprintf(out, "Commands: %s\nRun %s <command> -h for a command's flags.\n\nFlags:\n", strings.Join(names, ", "), os.Args[0])
+	flag.PrintDefaults()
+}
+
+//hashFlags registers the hashing flags in fs and returns a func that builds hash options from them once parsed.
+func hashFlags(fs *flag.FlagSet) func() common.HashOptions {
+	var algorithm = fs.String("a", "sha512", "algorithm: sha256 or sha512 (PBKDF2), bcrypt, argon2id, scrypt, mosquitto6 or mosquitto7")
+	var HashIterations = fs.Int("i", 0, "PBKDF2 iterations (default: 100000), bcrypt cost, argon2id time or scrypt N")
+	var memory = fs.Int("m", 0, "argon2id memory in KiB")
+	var parallelism = fs.Int("l", 0, "argon2id threads or scrypt p")
+	var blockSize = fs.Int("r", 0, "scrypt r")
+	var salt = fs.Int("s", 0, "salt size in bytes")
+
+	return func() common.HashOptions {
+		opts := common.HashOptions{
+			Algorithm:   *algorithm,
+			Iterations:  *HashIterations,
+			Memory:      *memory,
+			Parallelism: *parallelism,
+			BlockSize:   *blockSize,
+			SaltSize:    *salt,
+		}
+
+		//sha256 and sha512 stand for PBKDF2 with that function, as they always have.
+		if *algorithm == "sha256" || *algorithm == "sha512" {
+			opts.Algorithm = common.HashPBKDF2
+			opts.Function = *algorithm
+		}
+
+		return opts
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//withStdin runs f with stdin reading input, as when a password is piped to pw.
+func withStdin(input string, f func()) {
+	r, w, err := os.Pipe()
+	So(err, ShouldBeNil)
+
+	_, err = w.WriteString(input)
+	So(err, ShouldBeNil)
+	w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = stdin
+		r.Close()
+	}()
+
+	f()
+}
+
+func TestProvision(t *testing.T) {
+
+	user := provisionUser{
+		Username:  `o'brien\x`,
+		Password:  "PBKDF2$sha512$100000$c2FsdA==$a2V5",
+		Superuser: true,
+		Acls: []provisionAcl{
+			{Topic: `it's/%u/#`, Acc: 1},
+			{Topic: `say "hi"`, Acc: 3},
+		},
+	}
+
+	Convey("Given a user, SQL statements should quote every value for each engine", t, func() {
+
+		Convey("Postgres and sqlite should double single quotes and keep backslashes", func() {
+			var out bytes.Buffer
+			So(writeSQL(&out, "postgres", "users", "acls", user), ShouldBeNil)
+			So(out.String(), ShouldEqual,
+				`INSERT INTO users (username, password_hash, is_admin) VALUES ('o''brien\x', 'PBKDF2$sha512$100000$c2FsdA==$a2V5', true);`+"\n"+
+					`INSERT INTO acls (test_user_id, topic, rw) VALUES ((SELECT id FROM users WHERE username = 'o''brien\x'), 'it''s/%u/#', 1);`+"\n"+
+					`INSERT INTO acls (test_user_id, topic, rw) VALUES ((SELECT id FROM users WHERE username = 'o''brien\x'), 'say "hi"', 3);`+"\n")
+
+			out.Reset()
+			So(writeSQL(&out, "sqlite", "users", "acls", user), ShouldBeNil)
+			So(out.String(), ShouldStartWith, `INSERT INTO users (username, password_hash, is_admin) VALUES ('o''brien\x', 'PBKDF2$sha512$100000$c2FsdA==$a2V5', 1);`)
+		})
+
+		Convey("Mysql should also escape backslashes", func() {
+			var out bytes.Buffer
+			So(writeSQL(&out, "mysql", "users", "acls", provisionUser{Username: `o'brien\x`, Password: "hash"}), ShouldBeNil)
+			So(out.String(), ShouldEqual, `INSERT INTO users (username, password_hash, is_admin) VALUES ('o''brien\\x', 'hash', false);`+"\n")
+		})
+
+	})
+
+	Convey("Given a user, redis commands should double quote and escape every argument", t, func() {
+		var out bytes.Buffer
+		So(writeRedis(&out, user), ShouldBeNil)
+		So(out.String(), ShouldEqual,
+			`SET "o'brien\\x" "PBKDF2$sha512$100000$c2FsdA==$a2V5"`+"\n"+
+				`SET "o'brien\\x:su" true`+"\n"+
+				`SADD "o'brien\\x:racls" "it's/%u/#"`+"\n"+
+				`SADD "o'brien\\x:rwacls" "say \"hi\""`+"\n")
+
+		Convey("Line breaks should be escaped, so every command takes a single line", func() {
+			So(redisQuote("a\nb\r"), ShouldEqual, `"a\nb\r"`)
+		})
+	})
+
+	Convey("Given a user, the mongo document should hold the user and its acls", t, func() {
+		var out bytes.Buffer
+		So(writeMongo(&out, user), ShouldBeNil)
+
+		var doc provisionUser
+		So(json.Unmarshal(out.Bytes(), &doc), ShouldBeNil)
+		So(doc, ShouldResemble, user)
+	})
+
+	Convey("Acl flags should take an access and a topic", t, func() {
+		var acls aclFlag
+		So(acls.Set("read:sensors/#"), ShouldBeNil)
+		So(acls.Set("subscribe:a:b"), ShouldBeNil)
+		So(acls, ShouldResemble, aclFlag{{Topic: "sensors/#", Acc: 1}, {Topic: "a:b", Acc: 4}})
+
+		So(acls.Set("raed:sensors/#"), ShouldNotBeNil)
+		So(acls.Set("read:"), ShouldNotBeNil)
+		So(acls.Set("sensors/#"), ShouldNotBeNil)
+	})
+
+	Convey("Redis should reject subscribe rules before reading a password", t, func() {
+		So(provision([]string{"-backend", "redis", "-acl", "subscribe:a/#", "test1"}), ShouldNotBeNil)
+		So(provision([]string{"-backend", "oracle", "test1"}), ShouldNotBeNil)
+	})
+
+}
+
+func TestVerify(t *testing.T) {
+
+	hash, err := common.GenerateHash("secret", common.HashOptions{Algorithm: common.HashPBKDF2, Iterations: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a hash, verify should check the password read from stdin", t, func() {
+		withStdin("secret\n", func() {
+			So(verify([]string{hash}), ShouldBeNil)
+		})
+		withStdin("wrong\n", func() {
+			So(verify([]string{hash}), ShouldNotBeNil)
+		})
+		withStdin("", func() {
+			So(verify([]string{hash}), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a malformed hash, verify should fail before reading a password", t, func() {
+		So(verify([]string{"PBKDF2$sha512$0$c2FsdA==$a2V5"}), ShouldNotBeNil)
+	})
+
+	Convey("Hash parameters should be printed as each algorithm names them", t, func() {
+		params, err := common.ParseHash("$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFi$8pJi4Pc31Un/WXt9hXFLypwybjc0WWTRUB6CgXLIxJs")
+		So(err, ShouldBeNil)
+
+		var out bytes.Buffer
+		printHashParams(&out, params)
+		So(out.String(), ShouldEqual, "algorithm: scrypt\nN: 16\np: 1\nr: 8\nsalt: 12 bytes\nkey: 32 bytes\n")
+	})
+
+}
+
+func TestCalibrate(t *testing.T) {
+
+	Convey("Calibrated options should be printed as pw flags and hash upgrade options", t, func() {
+		flags, upgradeOpts := calibratedOptions(common.HashOptions{Algorithm: common.HashPBKDF2, Function: "sha256", Iterations: 200000})
+		So(flags, ShouldResemble, []string{"-a", "sha256", "-i", "200000"})
+		So(upgradeOpts, ShouldResemble, []string{
+			"auth_opt_hash_upgrade_algorithm pbkdf2",
+			"auth_opt_hash_upgrade_function sha256",
+			"auth_opt_hash_upgrade_iterations 200000",
+		})
+
+		flags, upgradeOpts = calibratedOptions(common.HashOptions{Algorithm: common.HashScrypt, Iterations: 1 << 15, Parallelism: 1, BlockSize: 8})
+		So(flags, ShouldResemble, []string{"-a", "scrypt", "-i", "32768", "-l", "1", "-r", "8"})
+		So(upgradeOpts, ShouldContain, "auth_opt_hash_upgrade_blocksize 8")
+	})
+
+	Convey("The printed options should generate hashes with the calibrated costs", t, func() {
+		opts, _, err := common.CalibrateHash(common.HashOptions{Algorithm: common.HashArgon2id, Memory: 1024, Parallelism: 1}, time.Millisecond)
+		So(err, ShouldBeNil)
+
+		_, upgradeOpts := calibratedOptions(opts)
+		authOpts := make(map[string]string)
+		for _, opt := range upgradeOpts {
+			fields := strings.Fields(opt)
+			So(fields, ShouldHaveLength, 2)
+			authOpts[strings.TrimPrefix(fields[0], "auth_opt_")] = fields[1]
+		}
+
+		policy, err := common.NewHashPolicy(authOpts)
+		So(err, ShouldBeNil)
+
+		hash, err := common.GenerateHash("secret", opts)
+		So(err, ShouldBeNil)
+		params, err := common.ParseHash(hash)
+		So(err, ShouldBeNil)
+		So(policy.NeedsUpgrade(params), ShouldBeFalse)
+	})
+
+}
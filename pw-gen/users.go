@@ -0,0 +1,117 @@
+// +build files
+
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+)
+
+func init() {
+	commands["useradd"] = userAdd
+	commands["passwd"] = userPasswd
+	commands["userdel"] = userDel
+	commands["acladd"] = aclAdd
+	commands["acldel"] = aclDel
+}
+
+//userAdd adds a user to a password file with a password read from the terminal or stdin.
+func userAdd(args []string) error {
+	fs := flag.NewFlagSet("useradd", flag.ExitOnError)
+	var passwordPath = fs.String("password_path", "", "password file")
+	hashOptions := hashFlags(fs)
+
+	fs.Parse(args)
+
+	if *passwordPath == "" || fs.NArg() != 1 {
+		return errors.New("usage: pw useradd -password_path <file> [hash flags] <username>")
+	}
+
+	pwHash, err := readPasswordHash(hashOptions())
+	if err != nil {
+		return err
+	}
+
+	return bes.AddFilesUser(*passwordPath, fs.Arg(0), pwHash)
+}
+
+//userPasswd sets a new password, read from the terminal or stdin, for a user in a password file.
+func userPasswd(args []string) error {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	var passwordPath = fs.String("password_path", "", "password file")
+	hashOptions := hashFlags(fs)
+
+	fs.Parse(args)
+
+	if *passwordPath == "" || fs.NArg() != 1 {
+		return errors.New("usage: pw passwd -password_path <file> [hash flags] <username>")
+	}
+
+	pwHash, err := readPasswordHash(hashOptions())
+	if err != nil {
+		return err
+	}
+
+	return bes.SetFilesPassword(*passwordPath, fs.Arg(0), pwHash)
+}
+
+//userDel removes a user from a password file and, if given, its rules from an acl file.
+func userDel(args []string) error {
+	fs := flag.NewFlagSet("userdel", flag.ExitOnError)
+	var passwordPath = fs.String("password_path", "", "password file")
+	var aclPath = fs.String("acl_path", "", "acl file to remove the user's rules from")
+
+	fs.Parse(args)
+
+	if *passwordPath == "" || fs.NArg() != 1 {
+		return errors.New("usage: pw userdel -password_path <file> [-acl_path <file>] <username>")
+	}
+
+	if err := bes.RemoveFilesUser(*passwordPath, fs.Arg(0)); err != nil {
+		return err
+	}
+
+	if *aclPath == "" {
+		return nil
+	}
+
+	return bes.RemoveFilesAclUser(*aclPath, fs.Arg(0))
+}
+
+//aclAdd adds a topic or pattern rule to an acl file.
+func aclAdd(args []string) error {
+	aclPath, username, rule, err := aclRuleFlags("acladd", args)
+	if err != nil {
+		return err
+	}
+
+	return bes.AddFilesAclRule(aclPath, username, rule)
+}
+
+//aclDel removes a topic or pattern rule from an acl file.
+func aclDel(args []string) error {
+	aclPath, username, rule, err := aclRuleFlags("acldel", args)
+	if err != nil {
+		return err
+	}
+
+	return bes.RemoveFilesAclRule(aclPath, username, rule)
+}
+
+func aclRuleFlags(name string, args []string) (string, string, string, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var aclPath = fs.String("acl_path", "", "acl file")
+	var username = fs.String("u", "", "user the topic rule applies to, none for general rules and patterns")
+
+	fs.Parse(args)
+
+	if *aclPath == "" || fs.NArg() < 2 {
+		return "", "", "", errors.Errorf("usage: pw %s -acl_path <file> [-u <username>] topic|pattern [read|write|readwrite|subscribe|deny] <topic>", name)
+	}
+
+	return *aclPath, *username, strings.Join(fs.Args(), " "), nil
+}
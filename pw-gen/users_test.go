@@ -0,0 +1,146 @@
+// +build files
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUsers(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pw-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pwPath := filepath.Join(dir, "passwords")
+	aclPath := filepath.Join(dir, "acls")
+	hashFlags := []string{"-a", "sha512", "-i", "1000"}
+
+	//checkLogin reads the password file as the files backend does and checks a password.
+	checkLogin := func(username, password string) bool {
+		files, err := bes.NewFiles(map[string]string{"password_path": pwPath}, log.ErrorLevel)
+		So(err, ShouldBeNil)
+		return files.GetUser(username, password)
+	}
+
+	Convey("Given a password from stdin, users should be added, have their password changed and be removed", t, func() {
+		os.Remove(pwPath)
+
+		withStdin("one\n", func() {
+			So(userAdd(append(hashFlags, "-password_path", pwPath, "test1")), ShouldBeNil)
+		})
+		So(checkLogin("test1", "one"), ShouldBeTrue)
+
+		withStdin("other\n", func() {
+			So(userAdd(append(hashFlags, "-password_path", pwPath, "test1")), ShouldNotBeNil)
+		})
+
+		withStdin("two\n", func() {
+			So(userPasswd(append(hashFlags, "-password_path", pwPath, "test1")), ShouldBeNil)
+		})
+		So(checkLogin("test1", "two"), ShouldBeTrue)
+		So(checkLogin("test1", "one"), ShouldBeFalse)
+
+		withStdin("two\n", func() {
+			So(userPasswd(append(hashFlags, "-password_path", pwPath, "missing")), ShouldNotBeNil)
+		})
+
+		withStdin("", func() {
+			So(userAdd(append(hashFlags, "-password_path", pwPath, "test2")), ShouldNotBeNil)
+		})
+
+		So(userDel([]string{"-password_path", pwPath, "test1"}), ShouldBeNil)
+		So(checkLogin("test1", "two"), ShouldBeFalse)
+		So(userDel([]string{"-password_path", pwPath, "test1"}), ShouldNotBeNil)
+
+		So(userAdd([]string{"test1"}), ShouldNotBeNil)
+	})
+
+	Convey("Given a repeated user, passwd should change the password that's used", t, func() {
+		So(ioutil.WriteFile(pwPath, nil, 0600), ShouldBeNil)
+
+		withStdin("two\n", func() {
+			So(userAdd(append(hashFlags, "-password_path", pwPath, "test1")), ShouldBeNil)
+		})
+		content, err := ioutil.ReadFile(pwPath)
+		So(err, ShouldBeNil)
+		So(ioutil.WriteFile(pwPath, append(content, content...), 0600), ShouldBeNil)
+
+		withStdin("three\n", func() {
+			So(userPasswd(append(hashFlags, "-password_path", pwPath, "test1")), ShouldBeNil)
+		})
+		So(checkLogin("test1", "three"), ShouldBeTrue)
+		So(checkLogin("test1", "two"), ShouldBeFalse)
+	})
+
+	Convey("Acl rules should be added and removed, and removed along with their user", t, func() {
+		So(ioutil.WriteFile(pwPath, []byte("test1:hash\n"), 0600), ShouldBeNil)
+		os.Remove(aclPath)
+
+		So(aclAdd([]string{"-acl_path", aclPath, "-u", "test1", "topic", "read", "sensors/#"}), ShouldBeNil)
+		So(aclAdd([]string{"-acl_path", aclPath, "-u", "test1", "topic", "write", "sensors/test1"}), ShouldBeNil)
+		So(aclAdd([]string{"-acl_path", aclPath, "pattern", "read", "users/%u/#"}), ShouldBeNil)
+		So(aclAdd([]string{"-acl_path", aclPath, "-u", "test1", "topic", "read", "sensors/#"}), ShouldNotBeNil)
+		So(aclAdd([]string{"-acl_path", aclPath, "-u", "test1", "topic", "raed", "sensors/#"}), ShouldNotBeNil)
+		So(aclAdd([]string{"-acl_path", aclPath, "topic"}), ShouldNotBeNil)
+
+		So(aclDel([]string{"-acl_path", aclPath, "-u", "test1", "topic", "write", "sensors/test1"}), ShouldBeNil)
+		So(aclDel([]string{"-acl_path", aclPath, "-u", "test1", "topic", "write", "sensors/test1"}), ShouldNotBeNil)
+
+		content, err := ioutil.ReadFile(aclPath)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "pattern read users/%u/#\n\nuser test1\ntopic read sensors/#\n")
+
+		So(userDel([]string{"-password_path", pwPath, "-acl_path", aclPath, "test1"}), ShouldBeNil)
+
+		content, err = ioutil.ReadFile(aclPath)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "pattern read users/%u/#\n\n")
+	})
+
+}
+
+func TestLint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "pw-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+	badAclPath := filepath.Join(dir, "bad.acl")
+	confPath := filepath.Join(dir, "mosquitto.conf")
+
+	ioutil.WriteFile(badAclPath, []byte("user test1\ntopic raed test/#\n"), 0600)
+	ioutil.WriteFile(confPath, []byte("listener 1883\nauth_opt_backends files\n  auth_opt_password_path "+pwPath+"\nauth_opt_acl_path "+badAclPath+"\n"), 0600)
+
+	Convey("Auth options should be read from a mosquitto conf file without their prefix", t, func() {
+		authOpts := make(map[string]string)
+		So(readAuthOpts(confPath, authOpts), ShouldBeNil)
+		So(authOpts, ShouldResemble, map[string]string{
+			"backends":      "files",
+			"password_path": pwPath,
+			"acl_path":      badAclPath,
+		})
+
+		So(readAuthOpts(filepath.Join(dir, "missing.conf"), authOpts), ShouldNotBeNil)
+	})
+
+	Convey("Lint should fail when the files have issues, with flags taking precedence over the conf file", t, func() {
+		So(lint([]string{"-c", confPath}), ShouldNotBeNil)
+		So(lint([]string{"-c", confPath, "-acl_path", aclPath}), ShouldBeNil)
+		So(lint([]string{"-password_path", pwPath, "-acl_path", aclPath}), ShouldBeNil)
+	})
+
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+func init() {
+	commands["verify"] = verify
+	commands["calibrate"] = calibrate
+}
+
+//verify checks a password, read from the terminal or stdin, against a stored hash and prints the hash's parameters.
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: pw verify <hash>")
+	}
+
+	params, err := common.ParseHash(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	printHashParams(os.Stdout, params)
+
+	password, err := readPassword(false)
+	if err != nil {
+		return err
+	}
+
+	if !common.HashCompare(password, fs.Arg(0)) {
+		return errors.New("password doesn't match")
+	}
+
+	fmt.Println("password matches")
+
+	return nil
+}
+
+//calibrate finds the cost parameters that make hashing take about the target time and prints them as pw flags and hash upgrade options.
+func calibrate(args []string) error {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	var target = fs.Duration("t", 50*time.Millisecond, "target hashing time")
+	hashOptions := hashFlags(fs)
+
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return errors.New("usage: pw calibrate [-t <duration>] [hash flags]")
+	}
+
+	opts, elapsed, err := common.CalibrateHash(hashOptions(), *target)
+	if err != nil {
+		return err
+	}
+
+	sample, err := common.GenerateHash("", opts)
+	if err != nil {
+		return err
+	}
+
+	params, err := common.ParseHash(sample)
+	if err != nil {
+		return err
+	}
+
+	printHashParams(os.Stdout, params)
+	fmt.Printf("hashing time: %s\n\n", elapsed.Round(100*time.Microsecond))
+
+	flags, upgradeOpts := calibratedOptions(opts)
+
+	fmt.Printf("pw flags: %s\n\n", strings.Join(flags, " "))
+	fmt.Println("hash upgrade options:")
+	for _, opt := range upgradeOpts {
+		fmt.Println(opt)
+	}
+
+	return nil
+}
+
+//printHashParams prints the parameters used by the hash's algorithm, named as each algorithm does.
+func printHashParams(w io.Writer, params *common.HashParams) {
+	iterations := "iterations"
+	parallelism := "threads"
+	switch params.Algorithm {
+	case common.HashBcrypt:
+		iterations = "cost"
+	case common.HashArgon2id:
+		iterations = "time"
+	case common.HashScrypt:
+		iterations = "N"
+		parallelism = "p"
+	}
+
+	fmt.Fprintf(w, "algorithm: %s\n", params.Algorithm)
+	if params.Function != "" {
+		fmt.Fprintf(w, "function: %s\n", params.Function)
+	}
+	fmt.Fprintf(w, "%s: %d\n", iterations, params.Iterations)
+	if params.Memory != 0 {
+		fmt.Fprintf(w, "memory: %d KiB\n", params.Memory)
+	}
+	if params.Parallelism != 0 {
+		fmt.Fprintf(w, "%s: %d\n", parallelism, params.Parallelism)
+	}
+	if params.BlockSize != 0 {
+		fmt.Fprintf(w, "r: %d\n", params.BlockSize)
+	}
+	//Bcrypt salts and keys are not decoded, as it verifies against the whole hash.
+	if len(params.Salt) != 0 {
+		fmt.Fprintf(w, "salt: %d bytes\n", len(params.Salt))
+	}
+	if len(params.Key) != 0 {
+		fmt.Fprintf(w, "key: %d bytes\n", len(params.Key))
+	}
+}
+
+//calibratedOptions returns the pw flags and auth_opt_hash_upgrade_* options that generate hashes with opts.
+func calibratedOptions(opts common.HashOptions) ([]string, []string) {
+	algorithm := opts.Algorithm
+	if algorithm == common.HashPBKDF2 {
+		//pw takes the PBKDF2 digest as the algorithm.
+		algorithm = opts.Function
+	}
+
+	flags := []string{"-a", algorithm, "-i", fmt.Sprint(opts.Iterations)}
+	upgradeOpts := []string{"auth_opt_hash_upgrade_algorithm " + opts.Algorithm}
+
+	if opts.Algorithm == common.HashPBKDF2 {
+		upgradeOpts = append(upgradeOpts, "auth_opt_hash_upgrade_function "+opts.Function)
+	}
+	upgradeOpts = append(upgradeOpts, fmt.Sprintf("auth_opt_hash_upgrade_iterations %d", opts.Iterations))
+
+	if opts.Algorithm == common.HashArgon2id {
+		flags = append(flags, "-m", fmt.Sprint(opts.Memory))
+		upgradeOpts = append(upgradeOpts, fmt.Sprintf("auth_opt_hash_upgrade_memory %d", opts.Memory))
+	}
+	if opts.Algorithm == common.HashArgon2id || opts.Algorithm == common.HashScrypt {
+		flags = append(flags, "-l", fmt.Sprint(opts.Parallelism))
+		upgradeOpts = append(upgradeOpts, fmt.Sprintf("auth_opt_hash_upgrade_parallelism %d", opts.Parallelism))
+	}
+	if opts.Algorithm == common.HashScrypt {
+		flags = append(flags, "-r", fmt.Sprint(opts.BlockSize))
+		upgradeOpts = append(upgradeOpts, fmt.Sprintf("auth_opt_hash_upgrade_blocksize %d", opts.BlockSize))
+	}
+
+	return flags, upgradeOpts
+}